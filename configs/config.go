@@ -27,12 +27,35 @@ type DistillConfig struct {
 	Type string
 	Stats string `json:"stats"`
 	ImplicitDepsFile string `json:"implicit_dependencies"`
+	MaxRepeats int `json:"max_repeats"` /* collapse loops in traces to this many iterations, 0 disables */
+	Explain string `json:"explain"` /* directory for per-program explanations of why each call was kept */
+	Coverage string `json:"coverage"` /* select seeds on "pc" (default) or "edge" coverage */
+	Ranking string `json:"ranking"` /* "size" (default) or "rarity" */
+	PCWeights string `json:"pc_weights"` /* JSON file of extra per-PC weights for rarity ranking */
+	Baseline *BaselineConfig `json:"baseline"` /* coverage to only distill seeds beyond */
+	Target *TargetConfig `json:"target"` /* kernel code to direct distillation at */
+	Strategies map[string]json.RawMessage `json:"strategies"` /* config sections of the distiller strategies by name */
+}
+
+type BaselineConfig struct {
+	Cover string `json:"cover"` /* raw PC list as served on syz-manager's /rawcover */
+	Corpus string `json:"corpus"` /* syzkaller corpus.db */
+	CoverDir string `json:"cover_dir"` /* syz-execprog -coverfile output of each program of Corpus, see distiller/baseline.go */
+}
+
+type TargetConfig struct {
+	Vmlinux string `json:"vmlinux"` /* needed to match functions and files, defaults to -vmlinux */
+	Functions []string `json:"functions"` /* globs of function names */
+	Files []string `json:"files"` /* globs of source files or directories, e.g. "net/sctp" */
+	PCRanges []string `json:"pc_ranges"` /* e.g. "0xffffffff81a00000-0xffffffff81a10000" */
+	Proximity bool `json:"proximity"` /* also count PCs in the same files and directories as the target */
 }
 
 type ParserConfig struct {
 	Os   string
 	Arch string
 	Type string
+	BlockingCalls []string `json:"blocking_calls"`
 	LocalConfig
 }
 
@@ -71,3 +94,14 @@ func NewDistillConfig(location string) (config *DistillConfig) {
 	}
 	return
 }
+
+func NewParserConfig(location string) (config *ParserConfig) {
+	dat, fileErr := ioutil.ReadFile(location)
+	if fileErr != nil {
+		Failf("Unable to read parser config, exiting")
+	}
+	if err := json.Unmarshal(dat, &config); err != nil {
+		Failf("Unable to marshall parser config: %s", err.Error())
+	}
+	return
+}
@@ -0,0 +1,296 @@
+package cover
+
+import (
+	"math/bits"
+	"sort"
+)
+
+/*
+An Interner maps the PCs of a run to dense indices, in the order they are first seen,
+so that coverage can be kept in bitsets instead of maps keyed by PC.
+ */
+type Interner struct {
+	index map[uint64]uint32
+	pcs []uint64
+}
+
+func NewInterner() *Interner {
+	return &Interner{
+		index: make(map[uint64]uint32),
+		pcs: make([]uint64, 0),
+	}
+}
+
+// Intern returns the bitset of pcs, assigning indices to the ones not seen before
+func (in *Interner) Intern(pcs []uint64) *Bitset {
+	idxs := make([]uint32, 0, len(pcs))
+	for _, pc := range pcs {
+		idx, ok := in.index[pc]
+		if !ok {
+			idx = uint32(len(in.pcs))
+			in.index[pc] = idx
+			in.pcs = append(in.pcs, pc)
+		}
+		idxs = append(idxs, idx)
+	}
+	return FromIndices(idxs)
+}
+
+// Lookup returns the bitset of the pcs which were interned before, ignoring the rest
+func (in *Interner) Lookup(pcs []uint64) *Bitset {
+	idxs := make([]uint32, 0, len(pcs))
+	for _, pc := range pcs {
+		if idx, ok := in.index[pc]; ok {
+			idxs = append(idxs, idx)
+		}
+	}
+	return FromIndices(idxs)
+}
+
+func (in *Interner) PC(idx uint32) uint64 {
+	return in.pcs[idx]
+}
+
+func (in *Interner) PCs(b *Bitset) []uint64 {
+	pcs := make([]uint64, 0, b.Count())
+	b.ForEach(func(idx uint32) {
+		pcs = append(pcs, in.pcs[idx])
+	})
+	return pcs
+}
+
+// Len returns the number of distinct PCs interned
+func (in *Interner) Len() int {
+	return len(in.pcs)
+}
+
+/*
+A Bitset is an immutable set of PC indices. It's compressed by only keeping the 64 bit
+words which have bits set, along with their position, which suits the coverage of single
+calls: a few hundred PCs spread over an index space of millions.
+ */
+type Bitset struct {
+	keys []uint32 /* ascending position of each word, i.e. index / 64 */
+	words []uint64
+	count int
+}
+
+var empty = &Bitset{}
+
+func FromIndices(idxs []uint32) *Bitset {
+	if len(idxs) == 0 {
+		return empty
+	}
+	sorted := make([]uint32, len(idxs))
+	copy(sorted, idxs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	b := new(Bitset)
+	for _, idx := range sorted {
+		key := idx/64
+		if n := len(b.keys); n == 0 || b.keys[n-1] != key {
+			b.keys = append(b.keys, key)
+			b.words = append(b.words, 0)
+		}
+		b.words[len(b.words)-1] |= 1 << (idx%64)
+	}
+	b.recount()
+	return b
+}
+
+func (b *Bitset) recount() {
+	b.count = 0
+	for _, w := range b.words {
+		b.count += bits.OnesCount64(w)
+	}
+}
+
+func (b *Bitset) Count() int {
+	return b.count
+}
+
+func (b *Bitset) Has(idx uint32) bool {
+	key := idx/64
+	i := sort.Search(len(b.keys), func(i int) bool {
+		return b.keys[i] >= key
+	})
+	return i < len(b.keys) && b.keys[i] == key && b.words[i]&(1<<(idx%64)) != 0
+}
+
+func (b *Bitset) ForEach(fn func(idx uint32)) {
+	for i, w := range b.words {
+		for w != 0 {
+			bit := uint32(bits.TrailingZeros64(w))
+			fn(b.keys[i]*64 + bit)
+			w &= w-1
+		}
+	}
+}
+
+func (b *Bitset) Union(o *Bitset) *Bitset {
+	return merge(b, o, func(x, y uint64) uint64 { return x | y }, true, true)
+}
+
+func (b *Bitset) Intersect(o *Bitset) *Bitset {
+	return merge(b, o, func(x, y uint64) uint64 { return x & y }, false, false)
+}
+
+// Difference returns the indices in b which are not in o
+func (b *Bitset) Difference(o *Bitset) *Bitset {
+	return merge(b, o, func(x, y uint64) uint64 { return x &^ y }, true, false)
+}
+
+/*
+Union returns the union of all of sets. It stays sparse unlike adding them to a Set, so
+it's what to use for the coverage of a trace or a handful of calls.
+ */
+func Union(sets []*Bitset) *Bitset {
+	type word struct {
+		key uint32
+		bits uint64
+	}
+	words := make([]word, 0)
+	for _, b := range sets {
+		for i, key := range b.keys {
+			words = append(words, word{key, b.words[i]})
+		}
+	}
+	sort.Slice(words, func(i, j int) bool {
+		return words[i].key < words[j].key
+	})
+	ret := new(Bitset)
+	for _, w := range words {
+		if n := len(ret.keys); n > 0 && ret.keys[n-1] == w.key {
+			ret.words[n-1] |= w.bits
+			continue
+		}
+		ret.keys = append(ret.keys, w.key)
+		ret.words = append(ret.words, w.bits)
+	}
+	ret.recount()
+	return ret
+}
+
+/*
+merge combines the words of a and b with op. Words only present in a or b are kept as
+they are if keepA or keepB are set and dropped otherwise.
+ */
+func merge(a *Bitset, b *Bitset, op func(x, y uint64) uint64, keepA bool, keepB bool) *Bitset {
+	ret := &Bitset{
+		keys: make([]uint32, 0, len(a.keys)+len(b.keys)),
+		words: make([]uint64, 0, len(a.keys)+len(b.keys)),
+	}
+	add := func(key uint32, w uint64) {
+		if w != 0 {
+			ret.keys = append(ret.keys, key)
+			ret.words = append(ret.words, w)
+		}
+	}
+	i, j := 0, 0
+	for i < len(a.keys) || j < len(b.keys) {
+		switch {
+		case j == len(b.keys) || (i < len(a.keys) && a.keys[i] < b.keys[j]):
+			if keepA {
+				add(a.keys[i], a.words[i])
+			}
+			i++
+		case i == len(a.keys) || b.keys[j] < a.keys[i]:
+			if keepB {
+				add(b.keys[j], b.words[j])
+			}
+			j++
+		default:
+			add(a.keys[i], op(a.words[i], b.words[j]))
+			i++
+			j++
+		}
+	}
+	ret.recount()
+	return ret
+}
+
+/*
+A Set accumulates coverage, e.g. everything the seeds picked so far cover. Unlike a Bitset
+it is dense and mutable since it ends up holding most of the PCs of a run.
+ */
+type Set struct {
+	words []uint64
+	count int
+}
+
+func NewSet() *Set {
+	return &Set{
+		words: make([]uint64, 0),
+	}
+}
+
+// Add adds the indices of b to s and returns how many of them are new
+func (s *Set) Add(b *Bitset) int {
+	if n := len(b.keys); n > 0 && int(b.keys[n-1]) >= len(s.words) {
+		size := 2*len(s.words)
+		if int(b.keys[n-1]) >= size {
+			size = int(b.keys[n-1])+1
+		}
+		words := make([]uint64, size)
+		copy(words, s.words)
+		s.words = words
+	}
+	added := 0
+	for i, key := range b.keys {
+		added += bits.OnesCount64(b.words[i] &^ s.words[key])
+		s.words[key] |= b.words[i]
+	}
+	s.count += added
+	return added
+}
+
+// NewCount returns how many indices of b are not in s
+func (s *Set) NewCount(b *Bitset) int {
+	count := 0
+	for i, key := range b.keys {
+		w := b.words[i]
+		if int(key) < len(s.words) {
+			w &^= s.words[key]
+		}
+		count += bits.OnesCount64(w)
+	}
+	return count
+}
+
+// ForEachNew calls fn with every index of b which is not in s
+func (s *Set) ForEachNew(b *Bitset, fn func(idx uint32)) {
+	for i, key := range b.keys {
+		w := b.words[i]
+		if int(key) < len(s.words) {
+			w &^= s.words[key]
+		}
+		for w != 0 {
+			bit := uint32(bits.TrailingZeros64(w))
+			fn(key*64 + bit)
+			w &= w-1
+		}
+	}
+}
+
+func (s *Set) Has(idx uint32) bool {
+	key := int(idx/64)
+	return key < len(s.words) && s.words[key]&(1<<(idx%64)) != 0
+}
+
+func (s *Set) Count() int {
+	return s.count
+}
+
+// Bitset returns the indices currently in s
+func (s *Set) Bitset() *Bitset {
+	b := new(Bitset)
+	for key, w := range s.words {
+		if w != 0 {
+			b.keys = append(b.keys, uint32(key))
+			b.words = append(b.words, w)
+		}
+	}
+	b.count = s.count
+	return b
+}
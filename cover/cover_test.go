@@ -0,0 +1,158 @@
+package cover
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func indices(b *Bitset) []uint32 {
+	idxs := make([]uint32, 0)
+	b.ForEach(func(idx uint32) {
+		idxs = append(idxs, idx)
+	})
+	return idxs
+}
+
+func TestBitsetOps(t *testing.T) {
+	a := FromIndices([]uint32{0, 63, 64, 200})
+	b := FromIndices([]uint32{63, 65, 127, 128})
+	tests := []struct {
+		name string
+		got *Bitset
+		want []uint32
+	}{
+		{"union", a.Union(b), []uint32{0, 63, 64, 65, 127, 128, 200}},
+		{"intersect", a.Intersect(b), []uint32{63}},
+		{"difference", a.Difference(b), []uint32{0, 64, 200}},
+		{"difference reversed", b.Difference(a), []uint32{65, 127, 128}},
+		{"union of all", Union([]*Bitset{a, b, FromIndices([]uint32{64, 1000})}),
+			[]uint32{0, 63, 64, 65, 127, 128, 200, 1000}},
+		{"union of none", Union(nil), []uint32{}},
+		{"intersect disjoint words", FromIndices([]uint32{63}).Intersect(FromIndices([]uint32{64})), []uint32{}},
+	}
+	for _, test := range tests {
+		if got := indices(test.got); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+		if test.got.Count() != len(test.want) {
+			t.Errorf("%s: count is %d, want %d", test.name, test.got.Count(), len(test.want))
+		}
+	}
+}
+
+func TestBitsetHas(t *testing.T) {
+	b := FromIndices([]uint32{64, 63, 63})
+	for idx, want := range map[uint32]bool{62: false, 63: true, 64: true, 65: false, 127: false, 128: false} {
+		if b.Has(idx) != want {
+			t.Errorf("Has(%d) = %v, want %v", idx, !want, want)
+		}
+	}
+	if b.Count() != 2 {
+		t.Errorf("count is %d, want 2", b.Count())
+	}
+}
+
+func TestSetAdd(t *testing.T) {
+	s := NewSet()
+	steps := []struct {
+		add []uint32
+		added int
+		newCount int /* of add before adding it */
+	}{
+		{[]uint32{63}, 1, 1},
+		{[]uint32{63, 64}, 1, 1},
+		{[]uint32{0, 64, 127, 128}, 3, 3},
+		{[]uint32{4096, 63}, 1, 1},
+		{[]uint32{0, 63, 64}, 0, 0},
+	}
+	total := 0
+	for i, step := range steps {
+		b := FromIndices(step.add)
+		if n := s.NewCount(b); n != step.newCount {
+			t.Errorf("step %d: NewCount = %d, want %d", i, n, step.newCount)
+		}
+		if n := s.Add(b); n != step.added {
+			t.Errorf("step %d: Add = %d, want %d", i, n, step.added)
+		}
+		total += step.added
+		if s.Count() != total {
+			t.Errorf("step %d: count is %d, want %d", i, s.Count(), total)
+		}
+	}
+	want := []uint32{0, 63, 64, 127, 128, 4096}
+	if got := indices(s.Bitset()); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, idx := range want {
+		if !s.Has(idx) {
+			t.Errorf("Has(%d) = false", idx)
+		}
+	}
+	if s.Has(65) || s.Has(1<<20) {
+		t.Errorf("set has indices it wasn't given")
+	}
+}
+
+/*
+benchCovers makes covers shaped like those of traced calls: a few hundred PCs each, most
+of them shared with other calls, spread over a kernel sized range.
+ */
+func benchCovers() [][]uint64 {
+	rnd := rand.New(rand.NewSource(0))
+	covers := make([][]uint64, 20000)
+	for i := range covers {
+		cov := make([]uint64, 200+rnd.Intn(400))
+		for j := range cov {
+			cov[j] = 0xffffffff81000000 + uint64(rnd.Intn(1<<22))&^3
+		}
+		covers[i] = cov
+	}
+	return covers
+}
+
+/*
+The benchmarks run the greedy selection the distillers do, picking every cover adding PCs
+not covered by the ones before it, once with a map keyed by PC and once on interned bitsets.
+ */
+func BenchmarkContributesMap(b *testing.B) {
+	covers := benchCovers()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		seenIps := make(map[uint64]bool)
+		contributing := 0
+		for _, cov := range covers {
+			total := 0
+			for _, ip := range cov {
+				if !seenIps[ip] {
+					seenIps[ip] = true
+					total += 1
+				}
+			}
+			if total > 0 {
+				contributing += 1
+			}
+		}
+	}
+}
+
+func BenchmarkContributesBitset(b *testing.B) {
+	covers := benchCovers()
+	in := NewInterner()
+	sets := make([]*Bitset, len(covers))
+	for i, cov := range covers {
+		sets[i] = in.Intern(cov)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		seen := NewSet()
+		contributing := 0
+		for _, set := range sets {
+			if seen.Add(set) > 0 {
+				contributing += 1
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package cover
+
+/*
+Signal derives the signal syz-manager uses to decide whether coverage is new from the PCs
+a call hit, in the order kcov reported them. Like syz-executor it hashes every PC with the
+one before it, so a signal stands for an edge of the control flow rather than a single PC.
+Duplicates are removed.
+ */
+func Signal(pcs []uint64) []uint64 {
+	signal := make([]uint64, 0, len(pcs))
+	seen := make(map[uint32]bool, len(pcs))
+	var prev uint32
+	for _, pc := range pcs {
+		sig := uint32(pc) ^ prev
+		prev = hash(uint32(pc))
+		if seen[sig] {
+			continue
+		}
+		seen[sig] = true
+		signal = append(signal, uint64(sig))
+	}
+	return signal
+}
+
+// hash is the hash syz-executor mixes previous PCs with
+func hash(a uint32) uint32 {
+	a = (a ^ 61) ^ (a >> 16)
+	a = a + (a << 3)
+	a = a ^ (a >> 4)
+	a = a * 0x27d4eb2d
+	a = a ^ (a >> 15)
+	return a
+}
@@ -0,0 +1,130 @@
+package distiller
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/google/syzkaller/pkg/db"
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/shankarapailoor/moonshine/configs"
+	"github.com/shankarapailoor/moonshine/cover"
+	. "github.com/shankarapailoor/moonshine/logging"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+A baseline is the coverage an existing fuzzing campaign already reaches. Seeds are only
+distilled for what they cover beyond it. It's read from a raw PC list, i.e. what
+syz-manager serves on /rawcover, and/or from a syzkaller corpus along with the coverage
+of its programs. syz-manager doesn't keep that, so it's collected by running the corpus
+again:
+
+	syz-db unpack corpus.db progs
+	for p in progs/*; do syz-execprog -coverfile=cover/$(basename $p) $p; done
+
+syz-db names the programs by their key in the corpus and syz-execprog writes the PCs each
+call hits to <key>.<call>, one per line in the order they were hit, which is what the
+cover_dir of a baseline holds. Edge coverage needs that order, so raw PC lists only count
+towards PC coverage.
+ */
+func LoadBaseline(conf *config.BaselineConfig, edges bool) []uint64 {
+	values := make([]uint64, 0)
+	if conf.Cover != "" {
+		if edges {
+			log.Logf(0, "Ignoring baseline %s, edges can't be derived from a raw PC list", conf.Cover)
+		} else {
+			values = append(values, readPCs(conf.Cover)...)
+		}
+	}
+	if conf.Corpus != "" || conf.CoverDir != "" {
+		if conf.Corpus == "" || conf.CoverDir == "" {
+			Failf("A baseline corpus needs both the corpus and its cover dump")
+		}
+		values = append(values, corpusCover(conf.Corpus, conf.CoverDir, edges)...)
+	}
+	return values
+}
+
+func corpusCover(corpus string, dir string, edges bool) []uint64 {
+	corpusDB, err := db.Open(corpus)
+	if err != nil {
+		Failf("Unable to open baseline corpus %s: %s", corpus, err.Error())
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		Failf("Unable to read baseline cover dump %s: %s", dir, err.Error())
+	}
+	values := make([]uint64, 0)
+	dumped := make(map[string]bool)
+	for _, info := range infos {
+		key := strings.SplitN(info.Name(), ".", 2)[0]
+		if _, ok := corpusDB.Records[key]; !ok {
+			continue // cover of a program which has left the corpus
+		}
+		dumped[key] = true
+		pcs := readPCs(filepath.Join(dir, info.Name()))
+		if edges {
+			values = append(values, cover.Signal(pcs)...)
+		} else {
+			values = append(values, pcs...)
+		}
+	}
+	if missing := len(corpusDB.Records) - len(dumped); missing > 0 {
+		log.Logf(0, "No cover dumped for %d of the %d baseline corpus programs", missing, len(corpusDB.Records))
+	}
+	return values
+}
+
+func readPCs(location string) []uint64 {
+	f, err := os.Open(location)
+	if err != nil {
+		Failf("Unable to read %s", location)
+	}
+	defer f.Close()
+	pcs := make([]uint64, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pc, err := strconv.ParseUint(line, 0, 64)
+		if err != nil {
+			Failf("Bad pc %s in %s", line, location)
+		}
+		pcs = append(pcs, pc)
+	}
+	if err := scanner.Err(); err != nil {
+		Failf("Unable to read %s: %s", location, err.Error())
+	}
+	return pcs
+}
+
+// NewSeen returns the coverage distillation starts out with, the baseline if there is one
+func (d *DistillerMetadata) NewSeen() *cover.Set {
+	seen := cover.NewSet()
+	if d.Baseline != nil {
+		seen.Add(d.Baseline)
+	}
+	return seen
+}
+
+// reportBaseline tells how much of the coverage of the picked seeds is new to the baseline
+func (d *DistillerMetadata) reportBaseline(seen *cover.Set) {
+	if d.Baseline == nil {
+		return
+	}
+	known := d.Baseline.Count()
+	fmt.Fprintf(os.Stderr, "Baseline already covers %d of the %d %s in the traces, the seeds add %d new ones\n",
+		known, d.Interner.Len(), d.coverUnit(), seen.Count()-known)
+}
+
+func (d *DistillerMetadata) coverUnit() string {
+	if d.Coverage == EdgeCoverage {
+		return "edges"
+	}
+	return "PCs"
+}
@@ -0,0 +1,343 @@
+package distiller
+
+import (
+	"container/heap"
+	"fmt"
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
+	"github.com/shankarapailoor/moonshine/cover"
+	"math"
+	"os"
+	"sort"
+)
+
+/*
+The budget distiller picks the coverage it can get within explicit limits on its output.
+Limits left at 0 are not enforced. The memory limit is in bytes per program and applies on
+top of the memory syzkaller makes available to a program.
+ */
+type BudgetConfig struct {
+	MaxProgs int `json:"max_programs"`
+	MaxCallsPerProg int `json:"max_calls_per_program"`
+	MaxCalls int `json:"max_calls"`
+	MaxMemory uint64 `json:"max_memory"`
+}
+
+type BudgetDistiller struct {
+	*DistillerMetadata
+	conf *BudgetConfig
+}
+
+func init() {
+	Register("budget", &Strategy{
+		Config: func(_ *config.DistillConfig) interface{} {
+			return new(BudgetConfig)
+		},
+		New: func(dm *DistillerMetadata, _ *config.DistillConfig, conf interface{}) Distiller {
+			return &BudgetDistiller{
+				DistillerMetadata: dm,
+				conf: conf.(*BudgetConfig),
+			}
+		},
+	})
+}
+
+/*
+A unit is the smallest piece the budget distiller picks: a seed with all its upstream
+dependencies. Its cover is that of every seed among its calls.
+ */
+type unit struct {
+	seed *Seed
+	calls map[*prog.Call]bool
+	cover *cover.Bitset
+	ratio float64 /* weight of the new PCs per added call when last evaluated */
+}
+
+type budgetProg struct {
+	seed *Seed /* any seed of the trace the program is taken from */
+	calls map[*prog.Call]bool
+}
+
+type budget struct {
+	conf *BudgetConfig
+	progs []*budgetProg
+	owner map[*prog.Call]*budgetProg
+	totalCalls int
+	emitted int /* programs returned so far, after splitting */
+}
+
+/*
+Distill solves the weighted set cover of the PCs with the lazy greedy heuristic: units are
+picked by the new PCs they add per call they add to the output. A unit sharing calls with
+programs already picked is merged into them, like the explicit distiller does, otherwise
+it starts a new program. Units which would break a limit are skipped. Programs which don't
+fit the executor are split when they are emitted, which can add programs and duplicate calls,
+so the limits are checked again on the programs we return and chunks breaking them are dropped.
+ */
+func (d *BudgetDistiller) Distill(progs []*prog.Prog) (distilled []*prog.Prog) {
+	d.TrackAll(progs)
+	known := 0
+	if d.Baseline != nil {
+		known = d.Baseline.Count()
+	}
+	optimum := d.Interner.Len() - known /* everything new to the baseline */
+	b := &budget{
+		conf: d.conf,
+		progs: make([]*budgetProg, 0),
+		owner: make(map[*prog.Call]*budgetProg),
+	}
+	units := d.units()
+	heap.Init(&units)
+	seenIps := d.NewSeen()
+	picked := make(Seeds, 0)
+	for units.Len() > 0 {
+		u := heap.Pop(&units).(*unit)
+		gain := 0.0
+		seenIps.ForEachNew(u.cover, func(idx uint32) {
+			gain += d.pcWeight(idx)
+		})
+		if gain == 0 {
+			continue
+		}
+		owners, merged, cost, ok := b.merge(u)
+		if !ok {
+			continue
+		}
+		u.ratio = gain / math.Max(float64(cost), 0.5)
+		if units.Len() > 0 && u.ratio < units[0].ratio {
+			//Others might do better now, come back to it later
+			heap.Push(&units, u)
+			continue
+		}
+		if !d.fitsMemory(u.seed, merged) {
+			log.Logf(2, "Skipping %s: program would exceed the memory budget", u.seed.Call.Meta.Name)
+			continue
+		}
+		b.place(u, owners, merged, cost)
+		for call := range u.calls {
+			if seed, ok := d.CallToSeed[call]; ok {
+				if ips := d.Contributes(seed, seenIps); ips > 0 {
+					picked.Add(seed)
+				}
+			}
+		}
+		d.GetAllUpstreamDependents(u.seed, make(map[int]bool, 0))
+	}
+	out := &budget{conf: d.conf}
+	for _, p := range b.progs {
+		calls := make([]*prog.Call, 0, len(p.calls))
+		for call := range p.calls {
+			calls = append(calls, call)
+		}
+		for _, chunk := range d.Emit(d.BuildDistilledProg(p.seed, calls), nil) {
+			if d.admit(out, chunk) {
+				distilled = append(distilled, chunk)
+			}
+		}
+	}
+	coverage := seenIps.Count() - known
+	percent := 0.0
+	if optimum > 0 {
+		percent = 100 * float64(coverage) / float64(optimum)
+	}
+	fmt.Fprintf(os.Stderr, "Budget distillation covers %d of %d %s (%.1f%%) in %d programs of %d calls\n",
+		coverage, optimum, d.coverUnit(), percent, len(b.progs), b.totalCalls)
+	if len(distilled) != len(b.progs) {
+		fmt.Fprintf(os.Stderr, "Splitting programs to fit the executor left %d programs of %d calls\n",
+			len(distilled), out.totalCalls)
+	}
+	d.reportBaseline(seenIps)
+	d.Stats(picked)
+	return
+}
+
+func (d *BudgetDistiller) units() unitHeap {
+	units := make(unitHeap, 0, len(d.Seeds))
+	for _, seed := range d.Seeds {
+		if seed.Bits.Count() == 0 {
+			continue
+		}
+		u := &unit{
+			seed: seed,
+			calls: make(map[*prog.Call]bool),
+		}
+		d.closeUpstream(seed, u.calls)
+		covers := make([]*cover.Bitset, 0, len(u.calls))
+		for call := range u.calls {
+			if s, ok := d.CallToSeed[call]; ok {
+				covers = append(covers, s.Bits)
+			}
+		}
+		u.cover = cover.Union(covers)
+		u.ratio = d.weight(u.cover) / float64(len(u.calls))
+		units = append(units, u)
+	}
+	return units
+}
+
+/*
+closeUpstream adds the seed and its upstream dependencies to calls. Unlike
+GetAllUpstreamDependents it doesn't record reasons since most units are never picked.
+ */
+func (d *BudgetDistiller) closeUpstream(seed *Seed, calls map[*prog.Call]bool) {
+	if calls[seed.Call] {
+		return
+	}
+	calls[seed.Call] = true
+	for idx := range d.UpstreamDependencyGraph[seed] {
+		call := seed.Prog.Calls[idx]
+		if s, ok := d.CallToSeed[call]; ok {
+			d.closeUpstream(s, calls)
+		} else {
+			calls[call] = true
+		}
+	}
+}
+
+func (d *BudgetDistiller) fitsMemory(seed *Seed, calls map[*prog.Call]bool) bool {
+	ordered := make([]*prog.Call, 0, len(calls))
+	for call := range calls {
+		ordered = append(ordered, call)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		return d.CallToIdx[ordered[i]] < d.CallToIdx[ordered[j]]
+	})
+	m := seed.State.Tracker
+	if !m.FitsInMemory(ordered) {
+		return false
+	}
+	return d.conf.MaxMemory == 0 || m.MemoryNeeded(ordered) <= d.conf.MaxMemory
+}
+
+/*
+admit returns whether chunk, a program as emitted, fits within the limits left in out
+and counts it against them if it does. The mmap calls backing its memory aren't counted.
+ */
+func (d *BudgetDistiller) admit(out *budget, chunk *prog.Prog) bool {
+	calls := 0
+	for _, call := range chunk.Calls {
+		if _, ok := d.CallToIdx[origin(call, d.Origins)]; ok {
+			calls += 1
+		}
+	}
+	switch {
+	case d.conf.MaxProgs > 0 && out.emitted >= d.conf.MaxProgs:
+		log.Logf(2, "Dropping program of %d calls: it exceeds the program budget", calls)
+	case d.conf.MaxCallsPerProg > 0 && calls > d.conf.MaxCallsPerProg,
+		d.conf.MaxCalls > 0 && out.totalCalls+calls > d.conf.MaxCalls:
+		log.Logf(2, "Dropping program of %d calls: it exceeds the call budget", calls)
+	case d.conf.MaxMemory > 0 && memoryOf(chunk) > d.conf.MaxMemory:
+		log.Logf(2, "Dropping program of %d calls: it exceeds the memory budget", calls)
+	default:
+		out.emitted += 1
+		out.totalCalls += calls
+		return true
+	}
+	return false
+}
+
+// memoryOf returns the end of the memory the pointers of a filled out program point into
+func memoryOf(p *prog.Prog) uint64 {
+	end := uint64(0)
+	for _, call := range p.Calls {
+		prog.ForeachArg(call, func(arg prog.Arg, _ *prog.ArgCtx) {
+			a, ok := arg.(*prog.PointerArg)
+			if !ok {
+				return
+			}
+			size := a.VmaSize
+			if a.Res != nil {
+				size = a.Res.Size()
+			}
+			if a.Address+size > end {
+				end = a.Address + size
+			}
+		})
+	}
+	return end
+}
+
+/*
+merge returns the programs u has to be merged with, the calls of the resulting program and
+how many calls that adds to the output. Returns false if it breaks the call or program limits.
+ */
+func (b *budget) merge(u *unit) ([]*budgetProg, map[*prog.Call]bool, int, bool) {
+	owners := make([]*budgetProg, 0)
+	seen := make(map[*budgetProg]bool)
+	merged := make(map[*prog.Call]bool, len(u.calls))
+	for call := range u.calls {
+		merged[call] = true
+		if p, ok := b.owner[call]; ok && !seen[p] {
+			seen[p] = true
+			owners = append(owners, p)
+		}
+	}
+	added := len(merged)
+	for _, p := range owners {
+		for call := range p.calls {
+			if !merged[call] {
+				merged[call] = true
+			} else {
+				added -= 1
+			}
+		}
+	}
+	if b.conf.MaxCallsPerProg > 0 && len(merged) > b.conf.MaxCallsPerProg {
+		return nil, nil, 0, false
+	}
+	if b.conf.MaxCalls > 0 && b.totalCalls+added > b.conf.MaxCalls {
+		return nil, nil, 0, false
+	}
+	if b.conf.MaxProgs > 0 && len(owners) == 0 && len(b.progs) >= b.conf.MaxProgs {
+		return nil, nil, 0, false
+	}
+	return owners, merged, added, true
+}
+
+func (b *budget) place(u *unit, owners []*budgetProg, merged map[*prog.Call]bool, cost int) {
+	p := &budgetProg{
+		seed: u.seed,
+		calls: merged,
+	}
+	replaced := make(map[*budgetProg]bool)
+	for _, o := range owners {
+		replaced[o] = true
+	}
+	progs := make([]*budgetProg, 0, len(b.progs)+1)
+	for _, o := range b.progs {
+		if !replaced[o] {
+			progs = append(progs, o)
+		}
+	}
+	b.progs = append(progs, p)
+	for call := range merged {
+		b.owner[call] = p
+	}
+	b.totalCalls += cost
+}
+
+type unitHeap []*unit
+
+func (h unitHeap) Len() int {
+	return len(h)
+}
+
+func (h unitHeap) Less(i, j int) bool {
+	return h[i].ratio > h[j].ratio
+}
+
+func (h unitHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *unitHeap) Push(x interface{}) {
+	*h = append(*h, x.(*unit))
+}
+
+func (h *unitHeap) Pop() interface{} {
+	old := *h
+	u := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return u
+}
@@ -0,0 +1,66 @@
+package distiller
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
+)
+
+func TestBudgetLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		conf BudgetConfig
+		traces [][]int /* sizes of the writes of each trace */
+		progs int
+		calls int
+	}{
+		{"no limits", BudgetConfig{}, [][]int{{100, 100}, {100}}, 2, 5},
+		{"programs", BudgetConfig{MaxProgs: 1}, [][]int{{100, 100}, {100, 100}}, 1, 3},
+		{"calls per program", BudgetConfig{MaxCallsPerProg: 2}, [][]int{{100, 100}, {100}}, 2, 4},
+		{"calls", BudgetConfig{MaxCalls: 3}, [][]int{{100, 100}, {100}}, 2, 3},
+		{"memory", BudgetConfig{MaxMemory: 4 << 10}, [][]int{{8 << 10}, {100}}, 2, 3},
+		//A write of 1MB fills half the executor buffer, so the trace is split into 3 programs
+		{"split", BudgetConfig{}, [][]int{{1 << 20, 1 << 20, 1 << 20}}, 3, 6},
+		{"programs after splitting", BudgetConfig{MaxProgs: 2}, [][]int{{1 << 20, 1 << 20, 1 << 20}}, 2, 4},
+		{"calls after splitting", BudgetConfig{MaxCalls: 4}, [][]int{{1 << 20, 1 << 20, 1 << 20}}, 2, 4},
+	}
+	for _, test := range tests {
+		progs := make([]*prog.Prog, 0)
+		seeds := make(Seeds, 0)
+		for i, sizes := range test.traces {
+			p, s := trace(t, uint64(i) << 8, sizes...)
+			progs = append(progs, p)
+			seeds = append(seeds, s...)
+		}
+		conf := test.conf
+		d := &BudgetDistiller{DistillerMetadata: NewDistillerMetadata(&config.DistillConfig{}), conf: &conf}
+		d.Add(seeds)
+		distilled := d.Distill(progs)
+		if len(distilled) != test.progs {
+			t.Errorf("%s: got %d programs, want %d", test.name, len(distilled), test.progs)
+		}
+		total := 0
+		for _, p := range distilled {
+			calls := 0
+			for _, call := range p.Calls {
+				if call.Meta.Name != "mmap" {
+					calls += 1
+				}
+			}
+			total += calls
+			if conf.MaxCallsPerProg > 0 && calls > conf.MaxCallsPerProg {
+				t.Errorf("%s: program of %d calls, want at most %d", test.name, calls, conf.MaxCallsPerProg)
+			}
+			if conf.MaxMemory > 0 && memoryOf(p) > conf.MaxMemory {
+				t.Errorf("%s: program uses %d bytes, want at most %d", test.name, memoryOf(p), conf.MaxMemory)
+			}
+		}
+		if test.calls != 0 && total != test.calls {
+			t.Errorf("%s: got %d calls, want %d", test.name, total, test.calls)
+		}
+		if conf.MaxCalls > 0 && total > conf.MaxCalls {
+			t.Errorf("%s: got %d calls, want at most %d", test.name, total, conf.MaxCalls)
+		}
+	}
+}
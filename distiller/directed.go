@@ -0,0 +1,184 @@
+package distiller
+
+import (
+	"fmt"
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/shankarapailoor/moonshine/configs"
+	"github.com/shankarapailoor/moonshine/cover"
+	. "github.com/shankarapailoor/moonshine/logging"
+	"github.com/shankarapailoor/moonshine/symbolizer"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	sameFileWeight = 0.5
+	sameDirWeight = 0.25
+)
+
+type pcRange struct {
+	start uint64
+	end uint64
+}
+
+/*
+A Target is the kernel code distillation is directed at: functions, source files or
+directories, and PC ranges. Only the PCs of seeds inside it count, so the distillers pick
+the seeds reaching it, and whatever those depend on still comes along through the upstream
+and implicit dependencies. With proximity, PCs in the same file as a target PC count for
+half and those in the same directory for a quarter, for when the target itself is barely
+reached by the traces.
+ */
+type Target struct {
+	conf *config.TargetConfig
+	ranges []pcRange
+}
+
+func LoadTarget(conf *config.TargetConfig) *Target {
+	t := &Target{
+		conf: conf,
+	}
+	for _, r := range conf.PCRanges {
+		bounds := strings.SplitN(r, "-", 2)
+		if len(bounds) != 2 {
+			Failf("Bad pc range %s, expected start-end", r)
+		}
+		start, err := strconv.ParseUint(strings.TrimSpace(bounds[0]), 0, 64)
+		if err != nil {
+			Failf("Bad start of pc range %s: %s", r, err.Error())
+		}
+		end, err := strconv.ParseUint(strings.TrimSpace(bounds[1]), 0, 64)
+		if err != nil {
+			Failf("Bad end of pc range %s: %s", r, err.Error())
+		}
+		t.ranges = append(t.ranges, pcRange{start, end})
+	}
+	if t.needsSymbols() && conf.Vmlinux == "" {
+		Failf("Directing distillation at functions, files or their proximity needs a vmlinux")
+	}
+	return t
+}
+
+func (t *Target) needsSymbols() bool {
+	return len(t.conf.Functions) > 0 || len(t.conf.Files) > 0 || t.conf.Proximity
+}
+
+func (t *Target) inRange(pc uint64) bool {
+	for _, r := range t.ranges {
+		if pc >= r.start && pc < r.end {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Target) contains(pc uint64, frame *symbolizer.Frame) bool {
+	if t.inRange(pc) {
+		return true
+	}
+	if frame == nil {
+		return false
+	}
+	for _, pattern := range t.conf.Functions {
+		if ok, _ := filepath.Match(pattern, frame.Func); ok && frame.Func != "" {
+			return true
+		}
+	}
+	if frame.File == "" {
+		return false
+	}
+	for _, pattern := range t.conf.Files {
+		//A pattern matching any directory of the file covers all of it
+		for path := frame.File; path != "." && path != "/"; path = filepath.Dir(path) {
+			if ok, _ := filepath.Match(pattern, path); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+weights returns how much each PC of the interner counts towards the target, 1 for PCs
+inside it and 0 for those unrelated to it.
+ */
+func (t *Target) weights(in *cover.Interner) []float64 {
+	weights := make([]float64, in.Len())
+	pcs := make([]uint64, in.Len())
+	for idx := range pcs {
+		pcs[idx] = in.PC(uint32(idx))
+	}
+	var frames map[uint64]*symbolizer.Frame
+	if t.needsSymbols() {
+		s, err := symbolizer.Open(t.conf.Vmlinux)
+		if err != nil {
+			Failf("failed to open vmlinux: %v", err)
+		}
+		frames = s.Symbolize(pcs)
+		s.Close()
+	}
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for idx, pc := range pcs {
+		frame := frames[pc]
+		if !t.contains(pc, frame) {
+			continue
+		}
+		weights[idx] = 1
+		if frame != nil && frame.File != "" {
+			files[frame.File] = true
+			dirs[filepath.Dir(frame.File)] = true
+		}
+	}
+	if !t.conf.Proximity {
+		return weights
+	}
+	for idx, pc := range pcs {
+		frame := frames[pc]
+		if weights[idx] > 0 || frame == nil || frame.File == "" {
+			continue
+		}
+		if files[frame.File] {
+			weights[idx] = sameFileWeight
+		} else if dirs[filepath.Dir(frame.File)] {
+			weights[idx] = sameDirWeight
+		}
+	}
+	return weights
+}
+
+/*
+direct restricts the coverage of the seeds to the target, and its proximity, and keeps
+how much each PC counts for ranking.
+ */
+func (d *DistillerMetadata) direct(seeds Seeds) {
+	d.directed = d.Target.weights(d.Interner)
+	idxs := make([]uint32, 0)
+	inside := 0
+	for idx, w := range d.directed {
+		if w > 0 {
+			idxs = append(idxs, uint32(idx))
+		}
+		if w == 1 {
+			inside += 1
+		}
+	}
+	mask := cover.FromIndices(idxs)
+	reaching := 0
+	for _, seed := range seeds {
+		seed.Bits = seed.Bits.Intersect(mask)
+		if seed.Bits.Count() > 0 {
+			reaching += 1
+		}
+	}
+	if d.Baseline != nil {
+		d.Baseline = d.Baseline.Intersect(mask)
+	}
+	if inside == 0 {
+		log.Logf(0, "None of the PCs the traces hit are in the distillation target")
+	}
+	fmt.Fprintf(os.Stderr, "Distillation target: %d of the %d PCs in the traces, %d near it, reached by %d of %d seeds\n",
+		inside, len(d.directed), len(idxs)-inside, reaching, len(seeds))
+}
@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"sort"
 	"os"
+	"github.com/shankarapailoor/moonshine/cover"
+	"github.com/shankarapailoor/moonshine/splitter"
 	"github.com/shankarapailoor/moonshine/tracker"
 )
 
 type DistillerMetadata struct {
+	ProgTarget *prog.Target /* syscall descriptions the traces were parsed with */
 	StatFile string
 	Seeds Seeds
 	DistilledProgs []*prog.Prog
@@ -17,6 +20,143 @@ type DistillerMetadata struct {
 	CallToIdx map[*prog.Call]int
 	UpstreamDependencyGraph map[*Seed]map[int]map[prog.Arg][]prog.Arg
 	DownstreamDependents map[*Seed]map[int]bool
+	Reasons map[*prog.Call][]string /* why a traced call was pulled into a distilled program */
+	Explanations map[*prog.Prog][]string /* one line per call of each output program, see explain.go */
+	Origins map[*prog.Call]*prog.Call /* calls copied while splitting -> traced call */
+	Contribution map[*prog.Call]int /* unique PCs a seed added when it was picked */
+	ImplicitEdges map[*prog.Call]map[*prog.Call]bool /* call -> calls it was implicitly pulled in for */
+	Ranking string /* how seeds are weighted, see ranking.go */
+	PCWeights map[uint64]float64 /* extra weights of PCs for rarity ranking */
+	weights []float64 /* weight of each interned PC, nil if every PC counts the same */
+	Target *Target /* code to direct distillation at, see directed.go */
+	directed []float64 /* how much each interned PC counts towards Target */
+	Interner *cover.Interner /* dense indices of the PCs, or edges, of all seeds */
+	Coverage string /* whether seeds are selected on PCs or edges */
+	Baseline *cover.Bitset /* coverage of the seeds already reached by a fuzzing campaign, see baseline.go */
+	baseline []uint64 /* the baseline as loaded, interned once the seeds are */
+}
+
+/*
+Add ingests the seeds. It builds out CallToIdx, which is used for sorting calls in
+distilled programs, and an empty upstream dependency for every call a seed depends on.
+The coverage of the seeds is interned, restricted to the target if there is one, and
+they are weighted for ranking.
+ */
+func (d *DistillerMetadata) Add(seeds Seeds) {
+	d.Seeds = seeds
+	for _, seed := range seeds {
+		d.CallToSeed[seed.Call] = seed
+		if d.Coverage == EdgeCoverage {
+			seed.Bits = d.Interner.Intern(seed.Signal)
+		} else {
+			seed.Bits = d.Interner.Intern(seed.Cover)
+		}
+		d.UpstreamDependencyGraph[seed] = make(map[int]map[prog.Arg][]prog.Arg, 0)
+		seed.ArgMeta = make(map[prog.Arg]bool, 0)
+		for call, idx := range seed.DependsOn {
+			if _, ok := d.UpstreamDependencyGraph[seed][idx]; !ok {
+				d.UpstreamDependencyGraph[seed][idx] = make(map[prog.Arg][]prog.Arg, 0)
+			}
+			d.CallToIdx[call] = idx
+		}
+		d.CallToIdx[seed.Call] = seed.CallIdx
+	}
+	if d.baseline != nil {
+		//Coverage none of the seeds reach doesn't matter
+		d.Baseline = d.Interner.Lookup(d.baseline)
+		d.baseline = nil
+	}
+	if d.Target != nil {
+		d.direct(seeds)
+	}
+	d.rank(seeds)
+}
+
+// TrackAll tracks the resource dependencies of all traced programs
+func (d *DistillerMetadata) TrackAll(progs []*prog.Prog) {
+	for _, p := range progs {
+		d.TrackDependencies(p)
+	}
+}
+
+/*
+MergeDistilledProg puts calls into a new distilled program along with every distilled
+program any of them is already part of.
+ */
+func (d *DistillerMetadata) MergeDistilledProg(seed *Seed, calls []*prog.Call) *prog.Prog {
+	if distinctProgs := d.getAllProgs(calls); len(distinctProgs) > 0 {
+		calls = append(d.getCalls(distinctProgs), calls...)
+	}
+	return d.BuildDistilledProg(seed, calls)
+}
+
+/*
+BuildDistilledProg puts calls, which have to come from the program of seed, into a new
+distilled program in their original order and links their resources.
+ */
+func (d *DistillerMetadata) BuildDistilledProg(seed *Seed, calls []*prog.Call) *prog.Prog {
+	distilledProg := new(prog.Prog)
+	distilledProg.Calls = make([]*prog.Call, 0)
+	for _, idx := range d.uniqueCallIdxs(calls) {
+		call := seed.Prog.Calls[idx]
+		d.CallToDistilledProg[call] = distilledProg  // set calls to point to new, merged program
+		distilledProg.Calls = append(distilledProg.Calls, call)
+	}
+	d.BuildDependency(seed, distilledProg)  // set args to point to dependent args.
+	return distilledProg
+}
+
+// DistilledProgsOf returns the distinct distilled programs the seeds ended up in
+func (d *DistillerMetadata) DistilledProgsOf(seeds Seeds) []*prog.Prog {
+	seen := make(map[*prog.Prog]bool)
+	progs := make([]*prog.Prog, 0)
+	for _, seed := range seeds {
+		if p, ok := d.CallToDistilledProg[seed.Call]; ok && !seen[p] {
+			seen[p] = true
+			progs = append(progs, p)
+		}
+	}
+	return progs
+}
+
+/*
+Emit fills out the memory of a distilled program and returns the programs to write for it,
+more than one if it had to be split. Unless m is given the tracker of the program's trace
+is reduced to the calls of p.
+ */
+func (d *DistillerMetadata) Emit(p *prog.Prog, m *tracker.MemoryTracker) []*prog.Prog {
+	seed := d.CallToSeed[p.Calls[0]]
+	if m == nil {
+		m = seed.State.Tracker.Simplify(seed.Prog, p)
+	}
+	p.Target = seed.State.Target
+	chunks, origins := splitter.SplitWithOrigins(p, m)
+	d.explainProgs(chunks, origins)
+	return chunks
+}
+
+// TraceCover returns the PCs hit by all the traced calls
+func (d *DistillerMetadata) TraceCover() []uint64 {
+	pcs := make([]uint64, 0)
+	for _, seed := range d.Seeds {
+		pcs = append(pcs, seed.Cover...)
+	}
+	return pcs
+}
+
+// DistilledCover returns the PCs the traced calls copied into progs hit
+func (d *DistillerMetadata) DistilledCover(progs []*prog.Prog) []uint64 {
+	pcs := make([]uint64, 0)
+	seen := make(map[*Seed]bool)
+	for _, p := range progs {
+		for _, call := range p.Calls {
+			if seed, ok := d.CallToSeed[origin(call, d.Origins)]; ok && !seen[seed] {
+				seen[seed] = true
+				pcs = append(pcs, seed.Cover...)
+			}
+		}
+	}
+	return pcs
 }
 
 func (d *DistillerMetadata) GetAllDownstreamDependents(seed *Seed, seen map[int]bool) []*prog.Call {
@@ -28,6 +168,7 @@ func (d *DistillerMetadata) GetAllDownstreamDependents(seed *Seed, seen map[int]
 			continue
 		}
 		seen[idx] = true
+		d.addReason(call, "downstream dependent of %s (call %d)", seed.Call.Meta.Name, seed.CallIdx)
 		if s, ok := d.CallToSeed[call]; ok {
 			calls = append(calls, call)
 			calls = append(calls, d.GetAllDownstreamDependents(s, seen)...)
@@ -54,6 +195,7 @@ func (d *DistillerMetadata) GetAllUpstreamDependents(seed *Seed, seen map[int]bo
 			continue  // skip calls we've already added, and skip the current seed
 		}
 		seen[idx] = true  // mark that we're adding this call at position idx
+		d.addDependencyReason(seed, idx)
 		if s, ok := d.CallToSeed[call]; ok {
 			calls = append(calls, call)
 			/* recursively add upstream dependents */
@@ -74,6 +216,7 @@ func (d *DistillerMetadata) GetAllUpstreamDependents(seed *Seed, seen map[int]bo
 
 func (d *DistillerMetadata) TrackDependencies(prg *prog.Prog) {
 	args := make(map[prog.Arg]int, 0)
+	var uses map[prog.Arg]*tracker.VirtualMapping
 	for i, call := range prg.Calls {
 		var seed *Seed
 		var ok bool
@@ -82,8 +225,12 @@ func (d *DistillerMetadata) TrackDependencies(prg *prog.Prog) {
 			//fmt.Printf("Call: %s\n", call.Meta.CallName)
 			continue
 		}
+		if uses == nil {
+			//All calls of a program share the tracker of their trace
+			uses = seed.State.Tracker.MappingUses()
+		}
 		for _, arg := range call.Args {
-			upstream_maps := d.isDependent(arg, seed, seed.State, i, args)
+			upstream_maps := d.isDependent(arg, seed, seed.State, i, args, uses)
 			/* upstream_maps: given a call at index k that uses arg, what are the upstream args that arg depends on? */
 			for k, argMap := range upstream_maps {
 				if d.UpstreamDependencyGraph[seed][k] == nil {
@@ -122,7 +269,14 @@ func (d *DistillerMetadata) BuildDependency(seed *Seed, distilledProg *prog.Prog
 				upstreamSeed := d.CallToSeed[seed.Prog.Calls[idx]]
 				for argK, argVs := range argMap {
 					//fmt.Printf("dealing with argMap\n")
+					if _, ok := argK.(*prog.ResultArg); !ok {
+						//Only resources need their uses linked, pointer dependencies just order calls
+						continue
+					}
 					for _, argV := range argVs {
+						if _, ok := argV.(*prog.ResultArg); !ok {
+							continue
+						}
 						if _, ok := upstreamSeed.ArgMeta[argK]; !ok {
 							//fmt.Printf("UpstreamedSeed: %s, for call: %s index: %d\n", upstreamSeed.Call.Meta.CallName, seed.Call.Meta.CallName, idx)
 							argK.(*prog.ResultArg).Set(nil)
@@ -154,8 +308,11 @@ func (d *DistillerMetadata) Stats(distilledSeeds Seeds) {
 		data := fmt.Sprintf("Total Calls: %d, Distilled: %d\n", totalCalls, distilledCalls)
 		f.WriteString(data)
 		for _, seed := range distilledSeeds {
-			data = fmt.Sprintf("%s Contributes: %d\n", seed.Call.Meta.CallName, len(seed.Cover))
+			data = fmt.Sprintf("%s Contributes: %d\n", seed.Call.Meta.CallName, seed.Bits.Count())
 			f.WriteString(data)
+			for _, note := range seed.Notes {
+				f.WriteString(fmt.Sprintf("\t%s\n", note))
+			}
 		}
 	}
 }
@@ -196,18 +353,28 @@ func (d *DistillerMetadata) getCalls(progs []*prog.Prog) (ret []*prog.Call) {
 	return
 }
 
-func (d *DistillerMetadata) Contributes(seed *Seed, seenIps map[uint64]bool) int {
-	total := 0
-	for _, ip := range seed.Cover {
-		if _, ok := seenIps[ip]; !ok {
-			seenIps[ip] = true
-			total += 1
-		}
+func (d *DistillerMetadata) Contributes(seed *Seed, seenIps *cover.Set) int {
+	total := seenIps.Add(seed.Bits)
+	if total > 0 {
+		d.recordContribution(seed.Call, total)
 	}
 	return total
 }
 
-func (d *DistillerMetadata) isDependent(arg prog.Arg, seed *Seed, state *tracker.State, callIdx int, args map[prog.Arg]int) map[int]map[prog.Arg][]prog.Arg {
+func (d *DistillerMetadata) recordContribution(call *prog.Call, total int) {
+	if d.Contribution == nil {
+		d.Contribution = make(map[*prog.Call]int, 0)
+	}
+	d.Contribution[call] = total
+	d.addReason(call, "coverage seed contributing %d unique PCs", total)
+}
+
+/*
+isDependent returns the calls before callIdx which arg depends on, along with the args
+linking them. uses maps the pointers into mappings to their mapping, see MappingUses.
+ */
+func (d *DistillerMetadata) isDependent(arg prog.Arg, seed *Seed, state *tracker.State, callIdx int,
+	args map[prog.Arg]int, uses map[prog.Arg]*tracker.VirtualMapping) map[int]map[prog.Arg][]prog.Arg {
 	upstreamSet := make(map[int]map[prog.Arg][]prog.Arg, 0)
 	if arg == nil {
 		return nil
@@ -225,11 +392,21 @@ func (d *DistillerMetadata) isDependent(arg prog.Arg, seed *Seed, state *tracker
 			upstreamSet[args[a.Res]][a.Res] = append(upstreamSet[args[a.Res]][a.Res], arg)
 		}
 	case *prog.PointerArg:
-		if _, ok := args[a.Res]; ok {
-			dep := upstreamSet[args[a.Res]][a.Res]
-			dep = append(dep, arg)
-		} else {
-			for k, argMap := range d.isDependent(a.Res, seed, state, callIdx, args) {
+		/*
+		Pointees are never shared between calls, so a pointer depends on the call which
+		created the mapping it points into, as recorded by the memory tracker.
+		 */
+		if mapping, ok := uses[arg]; ok {
+			idx := mapping.GetCallIdx()
+			if idx < callIdx && idx < len(seed.Prog.Calls) && seed.Prog.Calls[idx] == mapping.GetCall() {
+				if upstreamSet[idx] == nil {
+					upstreamSet[idx] = make(map[prog.Arg][]prog.Arg, 0)
+				}
+				upstreamSet[idx][arg] = append(upstreamSet[idx][arg], arg)
+			}
+		}
+		if a.Res != nil {
+			for k, argMap := range d.isDependent(a.Res, seed, state, callIdx, args, uses) {
 				if upstreamSet[k] == nil {
 					upstreamSet[k] = make(map[prog.Arg][]prog.Arg, 0)
 					upstreamSet[k] = argMap
@@ -242,7 +419,7 @@ func (d *DistillerMetadata) isDependent(arg prog.Arg, seed *Seed, state *tracker
 		}
 	case *prog.GroupArg:
 		for _, inner_arg := range a.Inner {
-			for k, argMap := range d.isDependent(inner_arg, seed, state, callIdx, args) {
+			for k, argMap := range d.isDependent(inner_arg, seed, state, callIdx, args, uses) {
 				if upstreamSet[k] == nil {
 					upstreamSet[k] = make(map[prog.Arg][]prog.Arg, 0)
 					upstreamSet[k] = argMap
@@ -254,7 +431,7 @@ func (d *DistillerMetadata) isDependent(arg prog.Arg, seed *Seed, state *tracker
 			}
 		}
 	case *prog.UnionArg:
-		for k, argMap := range d.isDependent(a.Option, seed, state, callIdx, args) {
+		for k, argMap := range d.isDependent(a.Option, seed, state, callIdx, args, uses) {
 			if upstreamSet[k] == nil {
 				upstreamSet[k] = make(map[prog.Arg][]prog.Arg, 0)
 				upstreamSet[k] = argMap
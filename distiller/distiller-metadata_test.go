@@ -0,0 +1,46 @@
+package distiller
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
+	"github.com/shankarapailoor/moonshine/tracker"
+)
+
+func TestPointerIntoMappingDependsOnCreator(t *testing.T) {
+	vmaType := &prog.VmaType{TypeCommon: prog.TypeCommon{TypeName: "vma", ArgDir: prog.DirIn}}
+	bufType := &prog.BufferType{TypeCommon: prog.TypeCommon{TypeName: "buf", ArgDir: prog.DirOut, IsVarlen: true}}
+	ptrType := &prog.PtrType{TypeCommon: prog.TypeCommon{TypeName: "ptr", ArgDir: prog.DirIn}, Type: bufType}
+	mmap := &prog.Call{
+		Meta: &prog.Syscall{Name: "mmap", CallName: "mmap", Args: []prog.Type{vmaType}},
+		Args: []prog.Arg{prog.MakeVmaPointerArg(vmaType, 0, 1)},
+	}
+	readArg := prog.MakePointerArg(ptrType, 0, prog.MakeOutDataArg(bufType, 16))
+	read := &prog.Call{
+		Meta: &prog.Syscall{Name: "read", CallName: "read", Args: []prog.Type{ptrType}},
+		Args: []prog.Arg{readArg},
+	}
+	p := &prog.Prog{Calls: []*prog.Call{mmap, read}}
+	state := tracker.NewState(nil)
+	state.Tracker.CreateMapping(mmap, 0, mmap.Args[0], 0x1000, 0x2000)
+	mapping := state.Tracker.FindMapping(0x1000, 0x1010)
+	mapping.AddDependency(tracker.NewMemDependency(1, readArg, 0x1000, 0x1010))
+
+	mmapSeed := NewSeed(mmap, state, nil, p, 0, []uint64{0x10})
+	readSeed := NewSeed(read, state, nil, p, 1, []uint64{0x20})
+	d := NewDistillerMetadata(&config.DistillConfig{})
+	d.Add(Seeds{mmapSeed, readSeed})
+	d.TrackDependencies(p)
+
+	deps, ok := d.UpstreamDependencyGraph[readSeed][0]
+	if !ok {
+		t.Fatalf("read doesn't depend on the mmap it reads into: %v", d.UpstreamDependencyGraph[readSeed])
+	}
+	if len(deps[readArg]) != 1 {
+		t.Fatalf("dependency isn't linked through the pointer: %v", deps)
+	}
+	if !d.DownstreamDependents[mmapSeed][1] {
+		t.Fatalf("mmap doesn't know read depends on it")
+	}
+}
@@ -1,104 +1,114 @@
 package distiller
 
 import (
+	"encoding/json"
 	"github.com/google/syzkaller/prog"
 	"github.com/shankarapailoor/moonshine/configs"
-	"github.com/shankarapailoor/moonshine/implicit-dependencies"
+	"github.com/shankarapailoor/moonshine/cover"
+	. "github.com/shankarapailoor/moonshine/logging"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultStrategy = "weak"
+	PCCoverage = "pc"
+	EdgeCoverage = "edge"
 )
 
 type Distiller interface {
 	Distill([]*prog.Prog) []*prog.Prog
 	Add(Seeds)
 	Stats(Seeds)
+	Explain(*prog.Prog) []string
+	Graph(*prog.Prog) *Graph
+	TraceCover() []uint64
+	DistilledCover([]*prog.Prog) []uint64
 }
 
-type ExplicitDistiller struct {
-	*DistillerMetadata
+/*
+A Strategy creates a distiller. Config returns the strategy's typed config filled with its
+defaults, or is nil if the strategy has none. The section of the distill config under
+"strategies" named after the strategy is unmarshalled into it before it is passed to New.
+New gets the metadata shared by all distillers, which it should embed to get seed
+ingestion, dependency tracking and memory fixup.
+ */
+type Strategy struct {
+	Config func(conf *config.DistillConfig) interface{}
+	New func(dm *DistillerMetadata, conf *config.DistillConfig, strategyConf interface{}) Distiller
 }
 
-func NewDistiller(conf *config.DistillConfig) (d Distiller){
-	switch (conf.Type) {
-	case "weak":
-		d = NewWeakDistiller(conf)
-	case "explicit":
-		d = NewExplicitDistiller(conf)
-	case "implicit":
-		d = NewImplicitDistiller(conf)
-	case "trace":
-		d = NewTraceDistiller(conf)
-	case "random":
-		d = NewRandomDistiller(conf)
-	default:
-		d = NewWeakDistiller(conf)
-	}
-	return
-}
+var strategies = make(map[string]*Strategy)
 
-func NewRandomDistiller(conf *config.DistillConfig) (d *RandomDistiller) {
-	d = new(RandomDistiller)
-	dm := &DistillerMetadata{
-		StatFile: conf.Stats,
-		DistilledProgs: make([]*prog.Prog, 0),
-		CallToSeed: make(map[*prog.Call]*Seed, 0),
-		CallToDistilledProg: make(map[*prog.Call]*prog.Prog, 0),
-		CallToIdx: make(map[*prog.Call]int, 0),
-		UpstreamDependencyGraph: make(map[*Seed]map[int]map[prog.Arg][]prog.Arg, 0),
-		DownstreamDependents: make(map[*Seed]map[int]bool, 0),
+/*
+Register makes a distillation strategy selectable by name through the "Type" of the
+distill config. Packages outside of moonshine register their strategies from init and
+are picked up by any binary importing them.
+ */
+func Register(name string, s *Strategy) {
+	if _, ok := strategies[name]; ok {
+		panic("distiller strategy " + name + " registered twice")
 	}
-	d.DistillerMetadata = dm
-	return
-}
-
-
-func NewTraceDistiller(conf *config.DistillConfig) (d *TraceDistiller) {
-	d = new(TraceDistiller)
-	dm := &DistillerMetadata{
-		StatFile: conf.Stats,
-		DistilledProgs: make([]*prog.Prog, 0),
-		CallToSeed: make(map[*prog.Call]*Seed, 0),
-		CallToDistilledProg: make(map[*prog.Call]*prog.Prog, 0),
-		CallToIdx: make(map[*prog.Call]int, 0),
-		UpstreamDependencyGraph: make(map[*Seed]map[int]map[prog.Arg][]prog.Arg, 0),
-		DownstreamDependents: make(map[*Seed]map[int]bool, 0),
+	if s.New == nil {
+		panic("distiller strategy " + name + " has no constructor")
 	}
-	d.DistillerMetadata = dm
-	return
+	strategies[name] = s
 }
 
-
-func NewExplicitDistiller(conf *config.DistillConfig) (d *ExplicitDistiller) {
-	d = new(ExplicitDistiller)
-	dm := &DistillerMetadata{
-		StatFile: conf.Stats,
-		DistilledProgs: make([]*prog.Prog, 0),
-		CallToSeed: make(map[*prog.Call]*Seed, 0),
-		CallToDistilledProg: make(map[*prog.Call]*prog.Prog, 0),
-		CallToIdx: make(map[*prog.Call]int, 0),
-		UpstreamDependencyGraph: make(map[*Seed]map[int]map[prog.Arg][]prog.Arg, 0),
-		DownstreamDependents: make(map[*Seed]map[int]bool, 0),
+/*
+NewDistiller creates the distiller of the strategy named by the config's type, the default
+one if it names none. An unknown type is fatal rather than silently distilling differently.
+ */
+func NewDistiller(conf *config.DistillConfig, target *prog.Target) Distiller {
+	name := conf.Type
+	if name == "" {
+		name = DefaultStrategy
+	}
+	s, ok := strategies[name]
+	if !ok {
+		Failf("Unknown distiller type %q, registered types are: %s", name, strings.Join(Strategies(), ", "))
 	}
-	d.DistillerMetadata = dm
-	return
+	var strategyConf interface{}
+	if s.Config != nil {
+		strategyConf = s.Config(conf)
+		if raw, ok := conf.Strategies[name]; ok {
+			if err := json.Unmarshal(raw, strategyConf); err != nil {
+				Failf("Unable to read config of distiller %s: %s", name, err.Error())
+			}
+		}
+	}
+	dm := NewDistillerMetadata(conf)
+	dm.ProgTarget = target
+	return s.New(dm, conf, strategyConf)
 }
 
-func NewWeakDistiller(conf *config.DistillConfig) (d *WeakDistiller) {
-	d = new(WeakDistiller)
-	dm := &DistillerMetadata{
-		StatFile: conf.Stats,
-		DistilledProgs: make([]*prog.Prog, 0),
-		CallToSeed: make(map[*prog.Call]*Seed, 0),
-		CallToDistilledProg: make(map[*prog.Call]*prog.Prog, 0),
-		CallToIdx: make(map[*prog.Call]int, 0),
-		UpstreamDependencyGraph: make(map[*Seed]map[int]map[prog.Arg][]prog.Arg, 0),
-		DownstreamDependents: make(map[*Seed]map[int]bool, 0),
+// Strategies returns the names of the registered strategies, sorted
+func Strategies() []string {
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
 	}
-	d.DistillerMetadata = dm
-	return
+	sort.Strings(names)
+	return names
 }
 
-func NewImplicitDistiller(conf *config.DistillConfig) (d *ImplicitDistiller) {
-	d = new(ImplicitDistiller)
-	dm := &DistillerMetadata{
+func NewDistillerMetadata(conf *config.DistillConfig) *DistillerMetadata {
+	var weights map[uint64]float64
+	if conf.PCWeights != "" {
+		weights = LoadPCWeights(conf.PCWeights)
+	}
+	var baseline []uint64
+	if conf.Baseline != nil {
+		baseline = LoadBaseline(conf.Baseline, conf.Coverage == EdgeCoverage)
+	}
+	var target *Target
+	if conf.Target != nil {
+		if conf.Coverage == EdgeCoverage {
+			Failf("Directed distillation needs pc coverage, edges can't be symbolized")
+		}
+		target = LoadTarget(conf.Target)
+	}
+	return &DistillerMetadata{
 		StatFile: conf.Stats,
 		DistilledProgs: make([]*prog.Prog, 0),
 		CallToSeed: make(map[*prog.Call]*Seed, 0),
@@ -106,9 +116,11 @@ func NewImplicitDistiller(conf *config.DistillConfig) (d *ImplicitDistiller) {
 		CallToIdx: make(map[*prog.Call]int, 0),
 		UpstreamDependencyGraph: make(map[*Seed]map[int]map[prog.Arg][]prog.Arg, 0),
 		DownstreamDependents: make(map[*Seed]map[int]bool, 0),
+		Interner: cover.NewInterner(),
+		Coverage: conf.Coverage,
+		baseline: baseline,
+		Ranking: conf.Ranking,
+		PCWeights: weights,
+		Target: target,
 	}
-	impl_deps := implicit_dependencies.LoadImplicitDependencies(conf.ImplicitDepsFile)
-	d.DistillerMetadata = dm
-	d.impl_deps = *impl_deps
-	return
-}
\ No newline at end of file
+}
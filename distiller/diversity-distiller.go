@@ -0,0 +1,189 @@
+package distiller
+
+import (
+	"fmt"
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
+	"github.com/shankarapailoor/moonshine/cover"
+	"hash/fnv"
+	"math/bits"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+/*
+The diversity distiller works without coverage, for traces taken on kernels without kcov.
+Every call is described by features instead of PCs: its syscall variant, the values of its
+arguments and the calls before it in its trace, see features. Seeds are picked greedily
+like PCs would be, so the output keeps one call of each kind of call, argument and context
+the traces show, along with the calls it depends on.
+ */
+type DiversityConfig struct {
+	NGram int `json:"ngram"` /* length of the call sequences ending in a call that are features of it */
+	ImplicitConfig /* also pull in implicit dependencies if a file is set */
+}
+
+type DiversityDistiller struct {
+	*DistillerMetadata
+	conf *DiversityConfig
+	closer interface {
+		AddToDistilledProg(seed *Seed)
+	}
+}
+
+func init() {
+	Register("diversity", &Strategy{
+		Config: func(conf *config.DistillConfig) interface{} {
+			return &DiversityConfig{
+				NGram: 3,
+				ImplicitConfig: ImplicitConfig{ImplicitDepsFile: conf.ImplicitDepsFile},
+			}
+		},
+		New: func(dm *DistillerMetadata, _ *config.DistillConfig, conf interface{}) Distiller {
+			d := &DiversityDistiller{
+				DistillerMetadata: dm,
+				conf: conf.(*DiversityConfig),
+				closer: &ExplicitDistiller{dm},
+			}
+			if d.conf.ImplicitDepsFile != "" {
+				d.closer = NewImplicitDistiller(dm, &d.conf.ImplicitConfig)
+			}
+			return d
+		},
+	})
+}
+
+/*
+Add ingests the seeds like any distiller and then replaces their coverage with their
+features, so the rest of the distiller machinery, e.g. ranking and explanations, works on
+features instead. A baseline or target are about coverage and don't apply.
+ */
+func (d *DiversityDistiller) Add(seeds Seeds) {
+	if d.baseline != nil || d.Target != nil {
+		log.Logf(0, "Ignoring the baseline and target, the diversity distiller doesn't use coverage")
+		d.baseline = nil
+		d.Target = nil
+	}
+	d.DistillerMetadata.Add(seeds)
+	d.Interner = cover.NewInterner()
+	d.Baseline = nil
+	producers := make(map[*prog.Prog]map[*prog.ResultArg]*prog.Call)
+	for _, seed := range seeds {
+		if _, ok := producers[seed.Prog]; !ok {
+			producers[seed.Prog] = resultProducers(seed.Prog)
+		}
+		seed.Bits = d.Interner.Intern(d.features(seed, producers[seed.Prog]))
+	}
+	d.rank(seeds)
+}
+
+func (d *DiversityDistiller) Distill(progs []*prog.Prog) (distilled []*prog.Prog) {
+	seen := cover.NewSet()
+	seeds := d.Seeds
+	fmt.Printf("Computing diverse cover with %d seeds and %d features\n", len(seeds), d.Interner.Len())
+	sort.Sort(sort.Reverse(seeds))
+	heavyHitters := make(Seeds, 0)
+	d.TrackAll(progs)
+	for _, seed := range seeds {
+		if d.Contributes(seed, seen) > 0 {
+			heavyHitters.Add(seed)
+		}
+	}
+	for _, seed := range heavyHitters {
+		d.closer.AddToDistilledProg(seed)
+	}
+	distilledProgs := d.DistilledProgsOf(seeds)
+	for _, prog_ := range distilledProgs {
+		distilled = append(distilled, d.Emit(prog_, nil)...)
+	}
+	d.Stats(heavyHitters)
+	fmt.Fprintf(os.Stderr, "Total diverse seeds: %d out of %d, covering %d features, in %d programs\n",
+		len(heavyHitters), len(seeds), seen.Count(), len(distilled))
+	return
+}
+
+/*
+features describes a call by strings which are hashed to stand in for PCs:
+	- its syscall variant, e.g. open$dir
+	- the call sequence of the ngram calls up to it in its trace
+	- for every argument, named by its field, the value class it takes: the value of
+	  flags and special values of resources, the order of magnitude of integers and
+	  buffer sizes, strings, the directory of filenames, the chosen union option, and
+	  whether pointers are null
+	- for every resource argument the call it was produced by
+ */
+func (d *DiversityDistiller) features(seed *Seed, producers map[*prog.ResultArg]*prog.Call) []uint64 {
+	call := seed.Call
+	name := call.Meta.Name
+	features := []string{"call " + name}
+	ngram := []string{name}
+	for i := seed.CallIdx-1; i >= 0 && i > seed.CallIdx-d.conf.NGram; i-- {
+		ngram = append([]string{seed.Prog.Calls[i].Meta.Name}, ngram...)
+		features = append(features, "seq "+strings.Join(ngram, " "))
+	}
+	prog.ForeachArg(call, func(arg prog.Arg, _ *prog.ArgCtx) {
+		field := name + "." + arg.Type().FieldName()
+		switch a := arg.(type) {
+		case *prog.ConstArg:
+			switch t := a.Type().(type) {
+			case *prog.FlagsType:
+				features = append(features, fmt.Sprintf("%s=%#x", field, a.Val))
+				for _, v := range t.Vals {
+					if v != 0 && a.Val&v == v {
+						features = append(features, fmt.Sprintf("%s|%#x", field, v))
+					}
+				}
+			case *prog.IntType:
+				features = append(features, fmt.Sprintf("%s~%d", field, bits.Len64(a.Val)))
+			}
+		case *prog.DataArg:
+			t, ok := a.Type().(*prog.BufferType)
+			switch {
+			case ok && t.Kind == prog.BufferString:
+				features = append(features, fmt.Sprintf("%s=%q", field, a.Data()))
+			case ok && t.Kind == prog.BufferFilename:
+				file := strings.TrimRight(string(a.Data()), "\x00")
+				features = append(features, fmt.Sprintf("%s=%s", field, path.Dir(file)))
+			default:
+				features = append(features, fmt.Sprintf("%s~%d", field, bits.Len64(a.Size())))
+			}
+		case *prog.UnionArg:
+			features = append(features, fmt.Sprintf("%s:%s", field, a.Option.Type().FieldName()))
+		case *prog.PointerArg:
+			if a.IsNull() {
+				features = append(features, field+"=nil")
+			}
+		case *prog.ResultArg:
+			if a.Res == nil {
+				features = append(features, fmt.Sprintf("%s=%#x", field, a.Val))
+			} else if producer, ok := producers[a.Res]; ok && producer != call {
+				features = append(features, fmt.Sprintf("%s<-%s", field, producer.Meta.Name))
+			}
+		}
+	})
+	hashes := make([]uint64, len(features))
+	for i, feature := range features {
+		h := fnv.New64a()
+		h.Write([]byte(feature))
+		hashes[i] = h.Sum64()
+	}
+	return hashes
+}
+
+// resultProducers maps every resource of p to the call it's an argument or the result of
+func resultProducers(p *prog.Prog) map[*prog.ResultArg]*prog.Call {
+	producers := make(map[*prog.ResultArg]*prog.Call)
+	for _, call := range p.Calls {
+		prog.ForeachArg(call, func(arg prog.Arg, _ *prog.ArgCtx) {
+			if a, ok := arg.(*prog.ResultArg); ok {
+				if _, ok := producers[a]; !ok {
+					producers[a] = call
+				}
+			}
+		})
+	}
+	return producers
+}
@@ -0,0 +1,53 @@
+package distiller
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
+)
+
+func TestDiversityPicks(t *testing.T) {
+	tests := []struct {
+		ngram int
+		same int /* picks among the two identical writes */
+	}{
+		//Only the sizes of the writes tell them apart
+		{1, 1},
+		//The second write is the first to follow a write
+		{3, 2},
+	}
+	for _, test := range tests {
+		p, seeds := trace(t, 0x100, 16, 16, 4096)
+		for _, seed := range seeds {
+			seed.Cover = nil
+		}
+		dm := NewDistillerMetadata(&config.DistillConfig{})
+		d := &DiversityDistiller{
+			DistillerMetadata: dm,
+			conf: &DiversityConfig{NGram: test.ngram},
+			closer: &ExplicitDistiller{dm},
+		}
+		d.Add(seeds)
+		distilled := d.Distill([]*prog.Prog{p})
+		if len(distilled) != 1 {
+			t.Fatalf("ngram %d: got %d programs, want 1", test.ngram, len(distilled))
+		}
+		picked := func(seed *Seed) bool {
+			_, ok := d.Contribution[seed.Call]
+			return ok
+		}
+		same := 0
+		for _, seed := range seeds[1:3] {
+			if picked(seed) {
+				same += 1
+			}
+		}
+		if same != test.same {
+			t.Errorf("ngram %d: picked %d of the identical writes, want %d", test.ngram, same, test.same)
+		}
+		if !picked(seeds[0]) || !picked(seeds[3]) {
+			t.Errorf("ngram %d: open or the larger write wasn't picked", test.ngram)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package distiller
+
+import (
+	"fmt"
+	"github.com/google/syzkaller/prog"
+	"sort"
+	"strings"
+)
+
+/*
+Explanations record why each call ends up in a distilled program. While distilling we
+collect reasons for the calls of the traced programs, e.g. being a coverage seed or an
+upstream dependency of one. Once the output programs are final, each of their calls is
+mapped back to the traced call it came from and described by its origin and reasons.
+ */
+func (d *DistillerMetadata) addReason(call *prog.Call, format string, args ...interface{}) {
+	if d.Reasons == nil {
+		d.Reasons = make(map[*prog.Call][]string, 0)
+	}
+	reason := fmt.Sprintf(format, args...)
+	for _, r := range d.Reasons[call] {
+		if r == reason {
+			return
+		}
+	}
+	d.Reasons[call] = append(d.Reasons[call], reason)
+}
+
+// addDependencyReason records why the call at idx is an upstream dependency of seed
+func (d *DistillerMetadata) addDependencyReason(seed *Seed, idx int) {
+	call := seed.Prog.Calls[idx]
+	resources := make([]string, 0)
+	for argK := range d.UpstreamDependencyGraph[seed][idx] {
+		resources = append(resources, argK.Type().Name())
+	}
+	sort.Strings(resources)
+	via := "a shared file"
+	if len(resources) > 0 {
+		via = "resource " + strings.Join(resources, ", ")
+	} else if _, ok := seed.DependsOn[call]; ok {
+		via = "memory or a value it returned"
+	}
+	d.addReason(call, "explicit dependency of %s (call %d) via %s", seed.Call.Meta.Name, seed.CallIdx, via)
+}
+
+/*
+Explain returns one line per call of a distilled program: its index, name, the trace,
+pid and index it was taken from and the reasons it was included.
+ */
+func (d *DistillerMetadata) Explain(p *prog.Prog) []string {
+	return d.Explanations[p]
+}
+
+/*
+explainProgs builds the explanations of programs produced from the same distilled
+program. origins maps their calls back to the traced calls they were copied from.
+Calls without an origin are our own, e.g. the mmap backing the program's memory.
+ */
+func (d *DistillerMetadata) explainProgs(progs []*prog.Prog, origins map[*prog.Call]*prog.Call) {
+	if d.Explanations == nil {
+		d.Explanations = make(map[*prog.Prog][]string, 0)
+	}
+	if d.Origins == nil {
+		d.Origins = make(map[*prog.Call]*prog.Call, 0)
+	}
+	for call, orig := range origins {
+		d.Origins[call] = orig
+	}
+	copies := make(map[*prog.Call]int, 0)
+	for _, p := range progs {
+		for _, call := range p.Calls {
+			copies[origin(call, origins)] += 1
+		}
+	}
+	for _, p := range progs {
+		lines := make([]string, 0, len(p.Calls))
+		for i, call := range p.Calls {
+			orig := origin(call, origins)
+			seed, ok := d.CallToSeed[orig]
+			if !ok {
+				lines = append(lines, fmt.Sprintf("%d %s: added to back the program's memory", i, call.Meta.Name))
+				continue
+			}
+			reasons := d.Reasons[orig]
+			if len(reasons) == 0 {
+				reasons = []string{"kept along with the rest of its program"}
+			}
+			if copies[orig] > 1 {
+				reasons = append(reasons, fmt.Sprintf("duplicated into %d programs when splitting", copies[orig]))
+			}
+			lines = append(lines, fmt.Sprintf("%d %s: %s:%d:%d %s", i, call.Meta.Name,
+				seed.ProgName, seed.Pid, seed.CallIdx, strings.Join(reasons, "; ")))
+		}
+		d.Explanations[p] = lines
+	}
+}
+
+func origin(call *prog.Call, origins map[*prog.Call]*prog.Call) *prog.Call {
+	if orig, ok := origins[call]; ok {
+		return orig
+	}
+	return call
+}
@@ -0,0 +1,221 @@
+package distiller
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/syzkaller/prog"
+	"sort"
+	"strings"
+)
+
+const (
+	ResourceEdge = "resource"
+	FileEdge = "file"
+	MemoryEdge = "memory"
+	ValueEdge = "value"
+	ImplicitEdge = "implicit"
+)
+
+var edgeColors = map[string]string{
+	ResourceEdge: "blue",
+	FileEdge: "darkgreen",
+	MemoryEdge: "orange",
+	ValueEdge: "purple",
+	ImplicitEdge: "red",
+}
+
+/*
+A Graph is the dependency graph of a traced or distilled program as the distiller sees
+it. There is a node per call and an edge from every call to the calls depending on it.
+ */
+type Graph struct {
+	Nodes []*GraphNode `json:"nodes"`
+	Edges []*GraphEdge `json:"edges"`
+}
+
+type GraphNode struct {
+	Id int `json:"id"` /* index of the call in the program */
+	Name string `json:"name"`
+	Trace string `json:"trace,omitempty"`
+	Pid int64 `json:"pid,omitempty"`
+	CallIdx int `json:"call_idx"` /* index of the call in its trace, -1 for calls we added */
+	Cover int `json:"cover"` /* unique PCs the call contributed, 0 if it wasn't picked for its coverage */
+	Seed bool `json:"seed"`
+}
+
+type GraphEdge struct {
+	From int `json:"from"`
+	To int `json:"to"`
+	Kind string `json:"kind"`
+	Label string `json:"label,omitempty"`
+}
+
+/*
+Graph builds the dependency graph of p, which is either one of the traced programs or one
+of the programs returned by Distill. Calls of distilled programs are mapped back to the
+traced calls they came from, so the edges are those found while distilling.
+ */
+func (d *DistillerMetadata) Graph(p *prog.Prog) *Graph {
+	g := &Graph{
+		Nodes: make([]*GraphNode, 0, len(p.Calls)),
+		Edges: make([]*GraphEdge, 0),
+	}
+	nodes := make(map[*prog.Call]int, len(p.Calls)) /* traced call -> node */
+	for i, call := range p.Calls {
+		orig := origin(call, d.Origins)
+		node := &GraphNode{
+			Id: i,
+			Name: call.Meta.Name,
+			CallIdx: -1,
+		}
+		if seed, ok := d.CallToSeed[orig]; ok {
+			node.Trace = seed.ProgName
+			node.Pid = seed.Pid
+			node.CallIdx = seed.CallIdx
+			node.Cover = d.Contribution[orig]
+			node.Seed = node.Cover > 0
+			nodes[orig] = i
+		}
+		g.Nodes = append(g.Nodes, node)
+	}
+	mappings := make(map[*prog.Prog]map[*prog.Call]map[int]bool, 0)
+	for _, call := range p.Calls {
+		orig := origin(call, d.Origins)
+		seed, ok := d.CallToSeed[orig]
+		if !ok {
+			continue
+		}
+		if _, ok := mappings[seed.Prog]; !ok {
+			mappings[seed.Prog] = callMappings(seed)
+		}
+		to := nodes[orig]
+		for idx, argMap := range d.UpstreamDependencyGraph[seed] {
+			from, ok := nodes[seed.Prog.Calls[idx]]
+			if !ok || from == to {
+				continue
+			}
+			g.Edges = append(g.Edges, dependencyEdge(seed, idx, argMap, mappings[seed.Prog], from, to))
+		}
+		for requiredBy := range d.ImplicitEdges[orig] {
+			if idx, ok := nodes[requiredBy]; ok && idx != nodes[orig] {
+				g.Edges = append(g.Edges, &GraphEdge{
+					From: nodes[orig],
+					To: idx,
+					Kind: ImplicitEdge,
+					Label: syscallKeyword(requiredBy.Meta.Name) + " -> " + syscallKeyword(orig.Meta.Name),
+				})
+			}
+		}
+	}
+	sort.SliceStable(g.Edges, func(i, j int) bool {
+		if g.Edges[i].To != g.Edges[j].To {
+			return g.Edges[i].To < g.Edges[j].To
+		}
+		return g.Edges[i].From < g.Edges[j].From
+	})
+	return g
+}
+
+/*
+dependencyEdge types the dependency of seed on the call at idx. Resources are what the
+distiller links explicitly, otherwise the calls either share a mapping, a value flowed
+from one to the other or, if the parser didn't record a dependency, a file.
+ */
+func dependencyEdge(seed *Seed, idx int, argMap map[prog.Arg][]prog.Arg,
+	mappings map[*prog.Call]map[int]bool, from int, to int) *GraphEdge {
+	edge := &GraphEdge{
+		From: from,
+		To: to,
+	}
+	call := seed.Prog.Calls[idx]
+	resources := make([]string, 0)
+	for argK := range argMap {
+		if _, ok := argK.(*prog.ResultArg); ok {
+			resources = append(resources, argK.Type().Name())
+		}
+	}
+	if len(resources) > 0 {
+		sort.Strings(resources)
+		edge.Kind = ResourceEdge
+		edge.Label = strings.Join(resources, ", ")
+		return edge
+	}
+	for mapping := range mappings[call] {
+		if mappings[seed.Call][mapping] {
+			edge.Kind = MemoryEdge
+			return edge
+		}
+	}
+	if _, ok := seed.DependsOn[call]; ok {
+		edge.Kind = ValueEdge
+	} else {
+		edge.Kind = FileEdge
+	}
+	return edge
+}
+
+// callMappings returns the mappings, by index, each call of the seed's program points into
+func callMappings(seed *Seed) map[*prog.Call]map[int]bool {
+	owners := make(map[prog.Arg]*prog.Call, 0)
+	for _, call := range seed.Prog.Calls {
+		prog.ForeachArg(call, func(arg prog.Arg, _ *prog.ArgCtx) {
+			owners[arg] = call
+		})
+	}
+	ret := make(map[*prog.Call]map[int]bool, 0)
+	for i, args := range seed.State.Tracker.MappingArgs() {
+		for _, arg := range args {
+			if call, ok := owners[arg]; ok {
+				if ret[call] == nil {
+					ret[call] = make(map[int]bool, 0)
+				}
+				ret[call][i] = true
+			}
+		}
+	}
+	return ret
+}
+
+/*
+DOT renders the graph for Graphviz. Seeds are filled and edges are colored by their kind.
+Labels are quoted like Go strings, which escapes quotes and backslashes in trace names
+and turns line breaks into the \n Graphviz breaks labels on.
+ */
+func (g *Graph) DOT(name string) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "digraph %q {\n", name)
+	fmt.Fprintf(buf, "\tnode [shape=box];\n")
+	for _, n := range g.Nodes {
+		label := fmt.Sprintf("%d: %s", n.Id, n.Name)
+		if n.CallIdx >= 0 {
+			label += fmt.Sprintf("\n%s:%d:%d", n.Trace, n.Pid, n.CallIdx)
+		}
+		if n.Cover > 0 {
+			label += fmt.Sprintf("\ncover %d", n.Cover)
+		}
+		style := ""
+		if n.Seed {
+			style = ", style=filled, fillcolor=lightgrey"
+		}
+		fmt.Fprintf(buf, "\tn%d [label=%q%s];\n", n.Id, label, style)
+	}
+	for _, e := range g.Edges {
+		label := e.Kind
+		if e.Label != "" {
+			label += ": " + e.Label
+		}
+		fmt.Fprintf(buf, "\tn%d -> n%d [label=%q, color=%s];\n", e.From, e.To, label, edgeColors[e.Kind])
+	}
+	fmt.Fprintf(buf, "}\n")
+	return buf.Bytes()
+}
+
+func (d *DistillerMetadata) addImplicitEdge(call *prog.Call, requiredBy *prog.Call) {
+	if d.ImplicitEdges == nil {
+		d.ImplicitEdges = make(map[*prog.Call]map[*prog.Call]bool, 0)
+	}
+	if d.ImplicitEdges[call] == nil {
+		d.ImplicitEdges[call] = make(map[*prog.Call]bool, 0)
+	}
+	d.ImplicitEdges[call][requiredBy] = true
+}
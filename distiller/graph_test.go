@@ -0,0 +1,49 @@
+package distiller
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
+)
+
+func TestGraph(t *testing.T) {
+	p, seeds := trace(t, 0x100, 16, 16)
+	for _, seed := range seeds {
+		seed.ProgName = `trace "quoted"`
+	}
+	d := NewDistillerMetadata(&config.DistillConfig{})
+	d.Add(seeds)
+	distilled := (&ExplicitDistiller{d}).Distill([]*prog.Prog{p})
+	if len(distilled) != 1 {
+		t.Fatalf("got %d distilled programs, want 1", len(distilled))
+	}
+	for _, g := range []*Graph{d.Graph(p), d.Graph(distilled[0])} {
+		calls := make([]*GraphNode, 0)
+		for _, n := range g.Nodes {
+			if n.CallIdx >= 0 {
+				calls = append(calls, n)
+			}
+		}
+		if len(calls) != 3 {
+			t.Fatalf("got %d nodes of traced calls, want open and 2 writes", len(calls))
+		}
+		open := calls[0].Id
+		for _, write := range calls[1:] {
+			if !write.Seed || write.Cover != 1 {
+				t.Errorf("write %d isn't a seed contributing 1 PC", write.Id)
+			}
+			found := false
+			for _, e := range g.Edges {
+				found = found || e.From == open && e.To == write.Id && e.Kind == ResourceEdge && e.Label == "fd"
+			}
+			if !found {
+				t.Errorf("no fd edge from open to write %d: %+v", write.Id, g.Edges)
+			}
+		}
+		if dot := g.DOT("graph"); !bytes.Contains(dot, []byte(`trace \"quoted\"`)) {
+			t.Errorf("trace name isn't escaped:\n%s", dot)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package distiller
 import (
 	"github.com/google/syzkaller/pkg/log"
 	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
 	"github.com/shankarapailoor/moonshine/implicit-dependencies"
 	"fmt"
 	"sort"
@@ -14,28 +15,40 @@ import (
 
 type ImplicitDistiller struct {
 	*DistillerMetadata
-	impl_deps implicit_dependencies.ImplicitDependencies
+	impl_deps *implicit_dependencies.ImplicitDependencies
+	maxDepth int
 }
 
-func (d *ImplicitDistiller) Add(seeds Seeds) {
-	//fmt.Println(d.impl_deps["msync"])
-	d.Seeds = seeds
-	for _, seed := range seeds {
-		d.CallToSeed[seed.Call] = seed
-		d.UpstreamDependencyGraph[seed] = make(map[int]map[prog.Arg][]prog.Arg, 0)
-		seed.ArgMeta = make(map[prog.Arg]bool, 0)
-		for call,idx := range seed.DependsOn {
-			if _, ok := d.UpstreamDependencyGraph[seed][idx]; !ok {
-				d.UpstreamDependencyGraph[seed][idx] = make(map[prog.Arg][]prog.Arg, 0)
-			}
-			d.CallToIdx[call] = idx
-		}
-		d.CallToIdx[seed.Call] = seed.CallIdx
+type ImplicitConfig struct {
+	ImplicitDepsFile string `json:"implicit_dependencies"`
+	MinConfidence float64 `json:"min_confidence"` /* drop weaker dependencies */
+	MaxDepth int `json:"max_depth"` /* rounds of implicit dependencies of implicit dependencies, 0 for no limit */
+}
+
+func init() {
+	Register("implicit", &Strategy{
+		Config: func(conf *config.DistillConfig) interface{} {
+			//The top level implicit_dependencies predates per strategy configs
+			return &ImplicitConfig{ImplicitDepsFile: conf.ImplicitDepsFile}
+		},
+		New: func(dm *DistillerMetadata, _ *config.DistillConfig, conf interface{}) Distiller {
+			return NewImplicitDistiller(dm, conf.(*ImplicitConfig))
+		},
+	})
+}
+
+func NewImplicitDistiller(dm *DistillerMetadata, conf *ImplicitConfig) *ImplicitDistiller {
+	impl_deps := implicit_dependencies.LoadImplicitDependencies(conf.ImplicitDepsFile, dm.ProgTarget, conf.MinConfidence)
+	log.Logf(1, "Loaded %d implicit dependencies", impl_deps.Len())
+	return &ImplicitDistiller{
+		DistillerMetadata: dm,
+		impl_deps: impl_deps,
+		maxDepth: conf.MaxDepth,
 	}
 }
 
 func (d *ImplicitDistiller) getHeavyHitters(seeds Seeds) Seeds {
-	seenIps := make(map[uint64]bool)
+	seenIps := d.NewSeen()
 	heavyHitters := make(Seeds, 0)
 	contributing_seeds := 0
 	for _, seed := range seeds {
@@ -46,6 +59,7 @@ func (d *ImplicitDistiller) getHeavyHitters(seeds Seeds) Seeds {
 		}
 	}
 	log.Logf(2, "TOTAL HEAVY HITTERS: %d\n", contributing_seeds)
+	d.reportBaseline(seenIps)
 	return heavyHitters
 }
 
@@ -66,47 +80,17 @@ func (d *ImplicitDistiller) Distill(progs []*prog.Prog) (distilled []*prog.Prog)
 	fmt.Printf("Performing implicit distillation with %d calls contributing coverage\n", len(seeds))
 	sort.Sort(sort.Reverse(seeds))  // sort seeds by inidividual coverage.
 	heavyHitters := make(Seeds, 0)
-	var target *prog.Target = nil
-	for _, prog := range progs {
-		if target == nil {
-			target = prog.Target
-		}
-		d.TrackDependencies(prog)
-	}
+	d.TrackAll(progs)
 	heavyHitters = d.getHeavyHitters(seeds)
 	//heavyHitters = seeds
 	for _, seed := range heavyHitters {
 		d.AddToDistilledProg(seed)
 	}
-	distilledProgs := make(map[*prog.Prog]bool)
-	for _, seed := range seeds {
-		if _, ok := d.CallToDistilledProg[seed.Call]; ok {
-			distilledProgs[d.CallToDistilledProg[seed.Call]] = true
-		}
-	}
+	distilledProgs := d.DistilledProgsOf(seeds)
 	fmt.Printf("Total Distilled Progs: %d\n", len(distilledProgs))
-	for prog_, _ := range distilledProgs {
+	for _, prog_ := range distilledProgs {
 		log.Logf(5, "Filling out prog")
-		parentProg := d.CallToSeed[prog_.Calls[0]].Prog
-		memoryTracker := d.CallToSeed[prog_.Calls[0]].State.Tracker
-		newMemoryTracker := memoryTracker.Simplify(parentProg, prog_)
-		if err := newMemoryTracker.FillOutMemory(prog_); err != nil {
-			log.Logf(4, "Error filling out memory in distilled prog: %s", err)
-			continue
-		}
-		totalMemoryAllocations := newMemoryTracker.GetTotalMemoryAllocations(prog_)
-		calls := make([]*prog.Call, 0)
-		state := d.CallToSeed[prog_.Calls[0]].State
-		if totalMemoryAllocations > 0 {
-			mmapCall := state.Target.MakeMmap(0, uint64(totalMemoryAllocations))
-			calls = append(calls, mmapCall)
-		}
-
-		calls = append(calls, prog_.Calls...)
-
-		prog_.Calls = calls
-		prog_.Target = target
-		distilled = append(distilled, prog_)
+		distilled = append(distilled, d.Emit(prog_, nil)...)
 	}
 	totalLen := 0
 	progs_ := 0
@@ -130,11 +114,6 @@ func (d *ImplicitDistiller) Distill(progs []*prog.Prog) (distilled []*prog.Prog)
 }
 
 func (d *ImplicitDistiller) AddToDistilledProg(seed *Seed) {
-	distilledProg := new(prog.Prog)
-	distilledProg.Calls = make([]*prog.Call, 0)
-	callIndexes := make([]int, 0)
-	totalCalls := make([]*prog.Call, 0)
-
 	if d.CallToDistilledProg[seed.Call] != nil {
 		return  /* skip call if already in a distilled program */
 	}
@@ -143,23 +122,8 @@ func (d *ImplicitDistiller) AddToDistilledProg(seed *Seed) {
 
 	upstreamCalls = append(upstreamCalls, d.GetAllUpstreamDependents(seed, seenMap)...)
 	upstreamCalls = append(upstreamCalls, seed.Call) // add seed as last call
-	upstreamCalls = d.AddImplicitDependencies(upstreamCalls, seed, seenMap)
-
-	distinctProgs := d.getAllProgs(upstreamCalls)
-	if len(distinctProgs) > 0 {  // we need to merge!
-		// collect all the calls from all distinct progs, plus our upstreamCalls together
-		totalCalls = append(d.getCalls(distinctProgs), upstreamCalls...)
-	} else {
-		totalCalls = upstreamCalls
-	}
-
-	callIndexes = d.uniqueCallIdxs(totalCalls)  // dedups and sorts calls by their program idx
-	for _, idx := range callIndexes {
-		call := seed.Prog.Calls[idx]
-		d.CallToDistilledProg[call] = distilledProg  // set calls to point to new, merged program
-		distilledProg.Calls = append(distilledProg.Calls, call)
-	}
-	d.BuildDependency(seed, distilledProg)  // set args to point to dependent args.
+	upstreamCalls = d.AddImplicitDependencies(upstreamCalls, seed, seenMap, 1)
+	d.MergeDistilledProg(seed, upstreamCalls)  // merge with the programs our calls are already part of
 }
 
 func syscallKeyword(syscall string) string {
@@ -179,30 +143,46 @@ func dedupSyscalls(calls []*prog.Call) []*prog.Call {
 	return ret
 }
 
+/*
+AddImplicitDependencies adds the explicit dependencies of the calls before seed which calls
+implicitly depend on. Those can have implicit dependencies in turn, which are added in
+further rounds up to the depth limit.
+ */
 func (d *ImplicitDistiller) AddImplicitDependencies(
 	calls []*prog.Call,
 	seed *Seed,
-	seenMap map[int]bool) []*prog.Call {
+	seenMap map[int]bool,
+	depth int) []*prog.Call {
 	/* Recursively collect implicit --> explicit --> implicit ... dependencies */
-	implicit_callmap := make(map[string]bool, 0)
+	type requirement struct {
+		dep *implicit_dependencies.Dependency
+		requiredBy *prog.Call
+	}
+	requirements := make([]requirement, 0)
 	implicit_calls := make([]*prog.Call, 0)
 	orig_call_len := len(dedupSyscalls(calls))
 
 	for _, call := range calls {
-		impl_deps, ok := d.impl_deps[syscallKeyword(call.Meta.Name)]
-		if !ok {
-			//fmt.Fprintf(os.Stderr, "no implicit dependencies for %s\n", call.Meta.Name)
-			continue
-		}
-		for _, impl_dep := range impl_deps {
-			implicit_callmap[impl_dep] = true
+		for _, impl_dep := range d.impl_deps.Of(call.Meta.Name) {
+			requirements = append(requirements, requirement{impl_dep, call})
 		}
 	}
 
 	for i := 0; i < seed.CallIdx; i++ {
-		if _, ok := implicit_callmap[syscallKeyword(seed.Prog.Calls[i].Meta.Name)]; ok {
-			//fmt.Fprintf(os.Stderr, "Adding implicit call %s\n", seed.Prog.Calls[i].Meta.Name)
-			implicit_calls = append(implicit_calls, seed.Prog.Calls[i])
+		call := seed.Prog.Calls[i]
+		for _, req := range requirements {
+			if req.requiredBy == call || !req.dep.Matches(call.Meta.Name) {
+				continue
+			}
+			reason := fmt.Sprintf("implicit dependency from rule %s -> %s (confidence %.2f",
+				req.dep.Call, req.dep.DependsOn, req.dep.Confidence)
+			if req.dep.Source != "" {
+				reason += ", " + req.dep.Source
+			}
+			d.addReason(call, "%s)", reason)
+			d.addImplicitEdge(call, req.requiredBy)
+			implicit_calls = append(implicit_calls, call)
+			break
 		}
 	}
 
@@ -218,9 +198,9 @@ func (d *ImplicitDistiller) AddImplicitDependencies(
 	}
 	calls = append(calls, upstreamOfImplCalls...)
 	calls = dedupSyscalls(calls)
-	if len(calls) > orig_call_len {
+	if len(calls) > orig_call_len && (d.maxDepth == 0 || depth < d.maxDepth) {
 		// if we added more calls, need to recursively readd implicit deps of these new calls
-		return d.AddImplicitDependencies(calls, seed, seenMap)
+		return d.AddImplicitDependencies(calls, seed, seenMap, depth+1)
 	}
 	return calls
 }
@@ -2,6 +2,7 @@ package distiller
 
 import (
 	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
 	"fmt"
 	"os"
 	"time"
@@ -11,6 +12,11 @@ import (
 
 type RandomDistiller struct {
 	*DistillerMetadata
+	totalCalls int
+}
+
+type RandomConfig struct {
+	TotalCalls int `json:"total_calls"` /* random calls to spread over the programs */
 }
 
 // Number of calls generated by distilling LTP + Kself + Posix + Glibc
@@ -22,8 +28,23 @@ const NumCallsLTPKselfPosix = 15333
 // Number of calls generated by distilling LTP + Kself
 const NumCallsLTPKself = 12712
 
+func init() {
+	Register("random", &Strategy{
+		Config: func(_ *config.DistillConfig) interface{} {
+			// change this to test different corpuses, e.g. NumCallsLTPKselfPosixGlibc
+			return &RandomConfig{TotalCalls: NumCallsLTPKself}
+		},
+		New: func(dm *DistillerMetadata, _ *config.DistillConfig, conf interface{}) Distiller {
+			return &RandomDistiller{
+				DistillerMetadata: dm,
+				totalCalls: conf.(*RandomConfig).TotalCalls,
+			}
+		},
+	})
+}
+
 func (d *RandomDistiller) getHeavyHitters(seeds Seeds) map[*Seed]int {
-	seenIps := make(map[uint64]bool)
+	seenIps := d.NewSeen()
 	heavyHitters := make(map[*Seed]int)
 	for i, seed := range seeds {
 		ips := d.Contributes(seed, seenIps)  /* how many unique Ips does seed contribute */
@@ -32,6 +53,7 @@ func (d *RandomDistiller) getHeavyHitters(seeds Seeds) map[*Seed]int {
 			fmt.Printf("Seed: %s contributes: %d ips out of its total of: %d\n", seed.Call.Meta.Name, ips, len(seed.Cover))
 		}
 	}
+	d.reportBaseline(seenIps)
 	return heavyHitters
 }
 
@@ -51,31 +73,13 @@ func (d *RandomDistiller) getRandomCallIndices(seeds Seeds, N int, total int) ma
 	return randIndices
 }
 
-func (d *RandomDistiller) Add(seeds Seeds) {
-	d.Seeds = seeds
-	for _, seed := range seeds {
-		d.CallToSeed[seed.Call] = seed
-		d.UpstreamDependencyGraph[seed] = make(map[int]map[prog.Arg][]prog.Arg, 0)
-		seed.ArgMeta = make(map[prog.Arg]bool, 0)
-		for call,idx := range seed.DependsOn {
-			if _, ok := d.UpstreamDependencyGraph[seed][idx]; !ok {
-				d.UpstreamDependencyGraph[seed][idx] = make(map[prog.Arg][]prog.Arg, 0)
-			}
-			d.CallToIdx[call] = idx
-		}
-		d.CallToIdx[seed.Call] = seed.CallIdx
-	}
-}
-
 func (d *RandomDistiller) Distill(progs []*prog.Prog) (distilled []*prog.Prog) {
 	fmt.Fprintf(os.Stderr, "Distilling %d programs with Random Distillation\n", len(progs))
 	seeds := d.Seeds
 	heavyHitters := d.getHeavyHitters(seeds)
 	N := len(heavyHitters)
 	fmt.Fprintf(os.Stderr, "Generating random progs around %d heavy hitters and %d seeds\n", N, len(seeds))
-	// change this to test different corpuses
-	// totalRandCalls :=  NumCallsLTPKselfPosixGlibc 
-	totalRandCalls := NumCallsLTPKself
+	totalRandCalls := d.totalCalls
 	seedsWithoutHeavy := make(Seeds, 0)
 	for _, seed := range seeds{
 		if _, ok := heavyHitters[seed]; !ok {
@@ -92,6 +96,7 @@ func (d *RandomDistiller) Distill(progs []*prog.Prog) (distilled []*prog.Prog) {
 		randProg := new(prog.Prog)
 		randProg.Calls = make([]*prog.Call, 0)
 		for _, j := range randIndices[i] {
+			d.addReason(seeds[j].Call, "random call added around %s", heavyHitter.Call.Meta.Name)
 			totalAddedCalls = totalAddedCalls + 1
 			randProg.Calls = append(randProg.Calls, seeds[j].Call)
 		}
@@ -101,6 +106,7 @@ func (d *RandomDistiller) Distill(progs []*prog.Prog) (distilled []*prog.Prog) {
 		i++
 	}
 	distilled = d.StripDependencies(distilled)
+	d.explainProgs(distilled, nil)
 	fmt.Fprintf(os.Stderr, "Collected %d random calls in %d programs", totalAddedCalls, len(distilled))
 	return distilled
 }
@@ -0,0 +1,115 @@
+package distiller
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"github.com/shankarapailoor/moonshine/cover"
+	. "github.com/shankarapailoor/moonshine/logging"
+	"strconv"
+)
+
+const (
+	SizeRanking = "size"
+	RarityRanking = "rarity"
+)
+
+/*
+Seeds are ranked by their Weight before the greedy distillers pick them. By default it's
+the size of their cover. With rarity ranking each PC instead counts with the inverse of the
+number of traces hitting it, so a call reaching code few traces reach outranks one hitting
+many PCs every trace hits, like the first open of every LTP test. PCs can further be
+weighted through a JSON file mapping PCs, e.g. "0xffffffff8123abcd", to their weights.
+When distillation is directed, PCs near the target count for less than those inside it.
+Coverage the baseline already reaches counts for nothing. Ranking only orders the seeds:
+the distillers still keep every seed adding a PC not covered yet, however little it weighs,
+but seeds ranked first leave less for the ones after them to add.
+ */
+func (d *DistillerMetadata) rank(seeds Seeds) {
+	d.weights = nil
+	if d.Ranking == RarityRanking {
+		d.weights = d.rarity(seeds)
+	}
+	if d.directed != nil {
+		if d.weights == nil {
+			d.weights = make([]float64, len(d.directed))
+			for idx := range d.weights {
+				d.weights[idx] = 1
+			}
+		}
+		for idx, w := range d.directed {
+			d.weights[idx] *= w
+		}
+	}
+	for _, seed := range seeds {
+		bits := seed.Bits
+		if d.Baseline != nil {
+			bits = bits.Difference(d.Baseline)
+		}
+		seed.Weight = d.weight(bits)
+	}
+}
+
+func (d *DistillerMetadata) rarity(seeds Seeds) []float64 {
+	traces := make(map[string][]*cover.Bitset)
+	for _, seed := range seeds {
+		key := seed.ProgName + ":" + strconv.FormatInt(seed.Pid, 10)
+		traces[key] = append(traces[key], seed.Bits)
+	}
+	hits := make([]int, d.Interner.Len()) /* traces hitting each PC */
+	for _, covers := range traces {
+		cover.Union(covers).ForEach(func(idx uint32) {
+			hits[idx] += 1
+		})
+	}
+	rarity := make([]float64, len(hits))
+	for idx, n := range hits {
+		if n == 0 {
+			continue // outside the target
+		}
+		weight := 1.0
+		if w, ok := d.PCWeights[d.Interner.PC(uint32(idx))]; ok {
+			weight = w
+		}
+		rarity[idx] = weight / float64(n)
+	}
+	return rarity
+}
+
+// pcWeight is how much covering the PC at idx is worth, 1 unless PCs are weighted
+func (d *DistillerMetadata) pcWeight(idx uint32) float64 {
+	if d.weights == nil {
+		return 1
+	}
+	return d.weights[idx]
+}
+
+func (d *DistillerMetadata) weight(bits *cover.Bitset) float64 {
+	if d.weights == nil {
+		return float64(bits.Count())
+	}
+	weight := 0.0
+	bits.ForEach(func(idx uint32) {
+		weight += d.weights[idx]
+	})
+	return weight
+}
+
+func LoadPCWeights(location string) map[uint64]float64 {
+	data, err := ioutil.ReadFile(location)
+	if err != nil {
+		Failf("Unable to read %s", location)
+	}
+	raw := make(map[string]float64)
+	if err := json.Unmarshal(data, &raw); err != nil {
+		Failf("Parse error in pc weights %s", err.Error())
+	}
+	weights := make(map[uint64]float64, len(raw))
+	for pc, weight := range raw {
+		ip, err := strconv.ParseUint(pc, 0, 64)
+		if err != nil {
+			Failf("Bad pc %s in pc weights: %s", pc, err.Error())
+		}
+		weights[ip] = weight
+	}
+	return weights
+}
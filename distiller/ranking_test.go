@@ -0,0 +1,45 @@
+package distiller
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
+)
+
+func TestRankingChangesPicks(t *testing.T) {
+	/*
+	write0 covers what write1 and write2 cover together, except 0x5 and 0x6, which only they
+	reach. By size write0 comes first, so all three are kept. Weighting 0x5 and 0x6 makes
+	write1 and write2 outrank it, and together they leave nothing for write0 to add.
+	 */
+	covers := [][]uint64{{0x1, 0x2, 0x3, 0x4}, {0x1, 0x2, 0x5}, {0x3, 0x4, 0x6}}
+	tests := []struct {
+		ranking string
+		picked []bool
+	}{
+		{SizeRanking, []bool{true, true, true}},
+		{RarityRanking, []bool{false, true, true}},
+	}
+	for _, test := range tests {
+		d := NewDistillerMetadata(&config.DistillConfig{Ranking: test.ranking})
+		d.PCWeights = map[uint64]float64{0x5: 2, 0x6: 2}
+		progs := make([]*prog.Prog, 0)
+		seeds := make(Seeds, 0)
+		writes := make([]*prog.Call, 0)
+		for i, cover := range covers {
+			p, s := trace(t, uint64(i+1) << 8, 16)
+			s[1].Cover = cover
+			progs = append(progs, p)
+			seeds = append(seeds, s...)
+			writes = append(writes, s[1].Call)
+		}
+		d.Add(seeds)
+		(&ExplicitDistiller{d}).Distill(progs)
+		for i, write := range writes {
+			if _, ok := d.Contribution[write]; ok != test.picked[i] {
+				t.Errorf("%s ranking: write%d picked: %v, want %v", test.ranking, i, ok, test.picked[i])
+			}
+		}
+	}
+}
@@ -2,18 +2,24 @@ package distiller
 
 import (
 	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/cover"
 	"github.com/shankarapailoor/moonshine/tracker"
 )
 
 type Seed struct {
 	Call *prog.Call
 	Prog *prog.Prog
-	ProgName string
+	ProgName string /* trace file the call was parsed from */
+	Pid int64
 	State *tracker.State
 	Cover []uint64
+	Signal []uint64 /* edges between the PCs of Cover, see cover.Signal */
+	Bits *cover.Bitset /* Cover or Signal interned by DistillerMetadata.Add, what the distillers work on */
+	Weight float64 /* rank of the seed, see ranking.go */
 	ArgMeta map[prog.Arg]bool
 	CallIdx int /* Index in the Prog call array */
 	DependsOn map[*prog.Call]int
+	Notes []string /* Provenance of the call, e.g. loop iterations collapsed into it */
 }
 
 type Seeds []*Seed
@@ -27,7 +33,7 @@ func (s Seeds) Swap(i, j int) {
 }
 
 func (s Seeds) Less(i, j int) bool {
-	return len(s[i].Cover) < len(s[j].Cover)
+	return s[i].Weight < s[j].Weight
 }
 
 func (s *Seeds) Add(seed *Seed) {
@@ -39,6 +45,7 @@ func NewSeed(call *prog.Call, state *tracker.State, dependsOn map[*prog.Call]int
 		Call: call,
 		Prog: prog,
 		Cover: cover,
+		Weight: float64(len(cover)),
 		State: state,
 		CallIdx: idx,
 		DependsOn: dependsOn,
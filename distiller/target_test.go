@@ -0,0 +1,111 @@
+package distiller
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/sys/targets"
+	"github.com/shankarapailoor/moonshine/tracker"
+)
+
+const (
+	testOS = "moonshine"
+	testArch = "distiller"
+)
+
+var registerTestTarget sync.Once
+
+/*
+testTarget returns a target with just the calls the distiller tests trace: open returns an fd
+that write writes a buffer to. Programs distilled from them are valid and can be serialized.
+ */
+func testTarget(t *testing.T) *prog.Target {
+	registerTestTarget.Do(func() {
+		prog.RegisterTarget(newTestTarget(), func(target *prog.Target) {
+			target.MakeMmap = targets.MakePosixMmap(target)
+		})
+	})
+	target, err := prog.GetTarget(testOS, testArch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+func common(name string, field string, size uint64, dir prog.Dir) prog.TypeCommon {
+	return prog.TypeCommon{TypeName: name, FldName: field, TypeSize: size, ArgDir: dir}
+}
+
+func intType(field string, size uint64) *prog.IntType {
+	return &prog.IntType{IntTypeCommon: prog.IntTypeCommon{TypeCommon: common("int", field, size, prog.DirIn)}}
+}
+
+func newTestTarget() *prog.Target {
+	fd := func(dir prog.Dir) *prog.ResourceType {
+		return &prog.ResourceType{TypeCommon: common("fd", "fd", 4, dir)}
+	}
+	buffer := &prog.BufferType{TypeCommon: common("buffer", "buf", 0, prog.DirIn)}
+	buffer.IsVarlen = true
+	return &prog.Target{
+		OS: testOS,
+		Arch: testArch,
+		PtrSize: 8,
+		PageSize: 4 << 10,
+		NumPages: 4 << 10,
+		DataOffset: 512 << 20,
+		Syscalls: []*prog.Syscall{
+			{Name: "mmap", CallName: "mmap", NR: 9, Args: []prog.Type{
+				&prog.VmaType{TypeCommon: common("vma", "addr", 8, prog.DirIn)},
+				&prog.LenType{IntTypeCommon: prog.IntTypeCommon{TypeCommon: common("len", "len", 8, prog.DirIn)}, Buf: "addr"},
+				intType("prot", 4), intType("flags", 4), fd(prog.DirIn), intType("offset", 8),
+			}},
+			{Name: "open", CallName: "open", NR: 2, Ret: fd(prog.DirOut)},
+			{Name: "write", CallName: "write", NR: 1, Args: []prog.Type{
+				fd(prog.DirIn),
+				&prog.PtrType{TypeCommon: common("ptr", "buf", 8, prog.DirIn), Type: buffer},
+				&prog.LenType{IntTypeCommon: prog.IntTypeCommon{TypeCommon: common("len", "count", 8, prog.DirIn)}, Buf: "buf"},
+			}},
+		},
+		Resources: []*prog.ResourceDesc{{
+			Name: "fd",
+			Type: intType("", 4),
+			Kind: []string{"fd"},
+			Values: []uint64{^uint64(0)},
+		}},
+	}
+}
+
+/*
+trace makes a traced program which opens a file and writes a buffer of each size to it, along
+with a seed for each call. open covers the PC base and the i-th write base+i+1.
+ */
+func trace(t *testing.T, base uint64, sizes ...int) (*prog.Prog, Seeds) {
+	target := testTarget(t)
+	open := &prog.Call{Meta: target.SyscallMap["open"]}
+	open.Ret = prog.MakeReturnArg(open.Meta.Ret)
+	p := &prog.Prog{Target: target, Calls: []*prog.Call{open}}
+	state := tracker.NewState(target)
+	seeds := Seeds{NewSeed(open, state, nil, p, 0, []uint64{base})}
+	for i, size := range sizes {
+		meta := target.SyscallMap["write"]
+		buf := prog.MakePointerArg(meta.Args[1], 0, prog.MakeDataArg(meta.Args[1].(*prog.PtrType).Type, make([]byte, size)))
+		write := &prog.Call{
+			Meta: meta,
+			Args: []prog.Arg{
+				prog.MakeResultArg(meta.Args[0], open.Ret, 0), buf, prog.MakeConstArg(meta.Args[2], uint64(size)),
+			},
+			Ret: prog.MakeReturnArg(meta.Ret),
+		}
+		if err := state.Tracker.AddAllocation(write, uint64(size), buf); err != nil {
+			t.Fatal(err)
+		}
+		p.Calls = append(p.Calls, write)
+		seeds = append(seeds, NewSeed(write, state, nil, p, i+1, []uint64{base+uint64(i)+1}))
+	}
+	for _, seed := range seeds {
+		seed.ProgName = fmt.Sprintf("trace%d", base)
+	}
+	return p, seeds
+}
@@ -2,6 +2,8 @@ package distiller
 
 import (
 	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
+	"github.com/shankarapailoor/moonshine/cover"
 	"sort"
 	"fmt"
 	"os"
@@ -11,11 +13,19 @@ type TraceDistiller struct {
 	*DistillerMetadata
 }
 
+func init() {
+	Register("trace", &Strategy{
+		New: func(dm *DistillerMetadata, _ *config.DistillConfig, _ interface{}) Distiller {
+			return &TraceDistiller{dm}
+		},
+	})
+}
+
 type Traces []*Trace
 
 type Trace struct {
 	Prog *prog.Prog
-	Cover []uint64
+	Cover *cover.Bitset
 }
 
 func (t Traces) Len() int {
@@ -27,7 +37,7 @@ func (t Traces) Swap(i, j int) {
 }
 
 func (t Traces) Less(i, j int) bool {
-	return len(t[i].Cover) < len(t[j].Cover)
+	return t[i].Cover.Count() < t[j].Cover.Count()
 }
 
 func (t *Traces) Add(trace *Trace) {
@@ -46,79 +56,41 @@ func (d *TraceDistiller) traces(progs []*prog.Prog) Traces {
 }
 
 func (d *TraceDistiller) trace(p *prog.Prog) *Trace {
-	coverMap := make(map[uint64]bool, 0)
-	cover := make([]uint64, 0)
+	covers := make([]*cover.Bitset, 0, len(p.Calls))
 	trace := new(Trace)
 	for _, call := range p.Calls {
 		if s, ok := d.CallToSeed[call]; ok {
-			for _, ip := range s.Cover {
-				if _, ok := coverMap[ip]; !ok {
-					coverMap[ip] = true
-				}
-			}
+			covers = append(covers, s.Bits)
 		}
 	}
-	for ip, _ := range coverMap {
-		cover = append(cover, ip)
-	}
-	trace.Cover = cover
+	trace.Cover = cover.Union(covers)
 	trace.Prog = p
 	return trace
 }
 
-func (d *TraceDistiller) Add(seeds Seeds) {
-	d.Seeds = seeds
-	for _, seed := range seeds {
-		d.CallToSeed[seed.Call] = seed
-		d.UpstreamDependencyGraph[seed] = make(map[int]map[prog.Arg][]prog.Arg, 0)
-		seed.ArgMeta = make(map[prog.Arg]bool, 0)
-		for call,idx := range seed.DependsOn {
-			if _, ok := d.UpstreamDependencyGraph[seed][idx]; !ok {
-				d.UpstreamDependencyGraph[seed][idx] = make(map[prog.Arg][]prog.Arg, 0)
-			}
-			d.CallToIdx[call] = idx
-		}
-		d.CallToIdx[seed.Call] = seed.CallIdx
-	}
-}
-
 func (d *TraceDistiller) Distill(progs []*prog.Prog) (distilled []*prog.Prog) {
 	fmt.Fprintf(os.Stderr, "Distilling %d programs with trace method\n", len(progs))
-	seenIps := make(map[uint64]bool)
+	seenIps := d.NewSeen()
 	traces := d.traces(progs)
 	sort.Sort(sort.Reverse(traces))
 	distilledProgs := make([]*prog.Prog, 0)
 
 	for _, trace := range traces {
-		if d.Contributes(trace, seenIps) > 0 {
+		if ips := d.Contributes(trace, seenIps); ips > 0 {
+			for _, call := range trace.Prog.Calls {
+				d.addReason(call, "part of a trace contributing %d unique PCs", ips)
+			}
 			distilledProgs = append(distilledProgs, trace.Prog)
 		}
 	}
 	for _, prog_ := range distilledProgs {
-		if err := d.CallToSeed[prog_.Calls[0]].State.Tracker.FillOutMemory(prog_); err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-			continue
-		}
-		totalMemoryAllocations := d.CallToSeed[prog_.Calls[0]].State.Tracker.GetTotalMemoryAllocations(prog_)
-		state := d.CallToSeed[prog_.Calls[0]].State
-		mmapCall := state.Target.MakeMmap(0, uint64(totalMemoryAllocations/pageSize)+1)
-		calls := make([]*prog.Call, 0)
-		calls = append(append(calls, mmapCall), prog_.Calls...)
-
-		prog_.Calls = calls
-		distilled = append(distilled, prog_)
+		distilled = append(distilled, d.Emit(prog_, d.CallToSeed[prog_.Calls[0]].State.Tracker)...)
 	}
+	d.reportBaseline(seenIps)
 	fmt.Fprintf(os.Stderr, "Only: %d programs contribute new coverage\n", len(distilled))
 	return
 }
 
-func (d *TraceDistiller) Contributes(trace *Trace, seenIps map[uint64]bool) int {
-	total := 0
-	for _, ip := range trace.Cover {
-		if _, ok := seenIps[ip]; !ok {
-			seenIps[ip] = true
-			total += 1
-		}
-	}
-	return total
+func (d *TraceDistiller) Contributes(trace *Trace, seenIps *cover.Set) int {
+	return seenIps.Add(trace.Cover)
 }
\ No newline at end of file
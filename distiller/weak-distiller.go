@@ -2,6 +2,7 @@ package distiller
 
 import (
 	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
 	"fmt"
 	"sort"
 	"os"
@@ -19,34 +20,22 @@ type WeakDistiller struct {
 	*DistillerMetadata
 }
 
-func (d *WeakDistiller) Add(seeds Seeds) {
-	/* identical to strong distiller */
-	d.Seeds = seeds
-	for _, seed := range seeds {
-		d.CallToSeed[seed.Call] = seed
-		d.UpstreamDependencyGraph[seed] = make(map[int]map[prog.Arg][]prog.Arg, 0)
-		seed.ArgMeta = make(map[prog.Arg]bool, 0)
-		for call, idx := range seed.DependsOn {
-			if _, ok := d.UpstreamDependencyGraph[seed][idx]; !ok {
-				d.UpstreamDependencyGraph[seed][idx] = make(map[prog.Arg][]prog.Arg, 0)
-			}
-			d.CallToIdx[call] = idx
-		}
-		d.CallToIdx[seed.Call] = seed.CallIdx
-	}
+func init() {
+	Register("weak", &Strategy{
+		New: func(dm *DistillerMetadata, _ *config.DistillConfig, _ interface{}) Distiller {
+			return &WeakDistiller{dm}
+		},
+	})
 }
 
-
 func (d *WeakDistiller) Distill(progs []*prog.Prog) (distilled []*prog.Prog) {
-	seenIps := make(map[uint64]bool)
+	seenIps := d.NewSeen()
 	seeds := d.Seeds
 	fmt.Printf("Computing Min Cover with %d seeds\n", len(seeds))
 	sort.Sort(sort.Reverse(seeds))
 	contributing_progs := 0
 	heavyHitters := make(Seeds, 0)
-	for _, prog := range progs {
-		d.TrackDependencies(prog)
-	}
+	d.TrackAll(progs)
 	for _, seed := range seeds {
 		var ips int = d.Contributes(seed, seenIps)
 		if ips > 0 {
@@ -55,32 +44,13 @@ func (d *WeakDistiller) Distill(progs []*prog.Prog) (distilled []*prog.Prog) {
 			contributing_progs += 1
 		}
 	}
+	d.reportBaseline(seenIps)
 	d.Stats(heavyHitters)
 	for _, seed := range heavyHitters {
 		d.AddToDistilledProg(seed)
 	}
-	distilledProgs := make(map[*prog.Prog]bool)
-	for _, seed := range seeds {
-		if _, ok := d.CallToDistilledProg[seed.Call]; ok {
-			distilledProgs[d.CallToDistilledProg[seed.Call]] = true
-		}
-	}
-	for prog_, _ := range distilledProgs {
-		seed := d.CallToSeed[prog_.Calls[0]]
-		state := seed.State
-		if err := d.CallToSeed[prog_.Calls[0]].State.Tracker.FillOutMemory(prog_); err != nil {
-			fmt.Printf("Error: %s\n", err.Error())
-            continue
-		}
-		totalMemory := state.Tracker.GetTotalMemoryAllocations(prog_)
-		mmapCall := state.Target.MakeMmap(0, uint64(totalMemory/pageSize)+1)
-		calls := make([]*prog.Call, 0)
-		calls = append(append(calls, mmapCall), prog_.Calls...)
-
-		prog_.Calls = calls
-
-		//fmt.Printf("Prog: %v\n", prog)
-		distilled = append(distilled, prog_)
+	for _, prog_ := range d.DistilledProgsOf(seeds) {
+		distilled = append(distilled, d.Emit(prog_, d.CallToSeed[prog_.Calls[0]].State.Tracker)...)
 	}
 	fmt.Fprintf(os.Stderr, "Total Contributing seeds: %d out of %d, in %d weak-distilled programs\n",
 		contributing_progs, len(seeds), len(distilled))
@@ -88,23 +58,16 @@ func (d *WeakDistiller) Distill(progs []*prog.Prog) (distilled []*prog.Prog) {
 }
 
 func (d *WeakDistiller) AddToDistilledProg(seed *Seed) {
-	distilledProg := new(prog.Prog)
-	distilledProg.Calls = make([]*prog.Call, 0)
-	callIndexes := make([]int, 0)
-
 	if d.CallToDistilledProg[seed.Call] != nil {
 		return
 	}
 	seedCalls := d.GetNeighbors(seed)
-	totalCalls := d.GetDependents(seedCalls)
-	callIndexes = d.uniqueCallIdxs(totalCalls)
-
-	for _, idx := range callIndexes {
-		call := seed.Prog.Calls[idx]
-		d.CallToDistilledProg[call] = distilledProg
-		distilledProg.Calls = append(distilledProg.Calls, call)
+	for _, call := range seedCalls {
+		if call != seed.Call {
+			d.addReason(call, "neighbor of %s (call %d)", seed.Call.Meta.Name, seed.CallIdx)
+		}
 	}
-	d.BuildDependency(seed, distilledProg)
+	d.BuildDistilledProg(seed, d.GetDependents(seedCalls))
 }
 
 func (d *WeakDistiller) GetNeighbors(seed *Seed) []*prog.Call {
@@ -1,20 +1,147 @@
 package implicit_dependencies
 
 import (
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
 	"io/ioutil"
 	. "github.com/shankarapailoor/moonshine/logging"
 	"encoding/json"
+	"sort"
+	"strings"
 )
 
-type ImplicitDependencies map[string][]string
+/*
+Version of the dependency file format:
+	1: dependencies with confidences, as written by Mine
+	2: calls may be syscall variants, e.g. ioctl$DRM_IOCTL_VERSION, and dependencies
+	   can say where they come from
+Files without a version are the original map of syscalls to the syscalls they depend on.
+ */
+const Version = 2
 
-func LoadImplicitDependencies(location string) (impl_deps *ImplicitDependencies) {
+/*
+File is the versioned format of implicit dependencies. Unlike the original bare map every
+dependency has a confidence and the file tells where it came from.
+ */
+type File struct {
+	Version int `json:"version"`
+	Source string `json:"source"` /* how the dependencies were obtained */
+	Dependencies []*Dependency `json:"dependencies"`
+}
+
+/*
+A Dependency says Call needs DependsOn to have been called before it. Either can be a
+syscall, which stands for all of its variants, or a single variant.
+ */
+type Dependency struct {
+	Call string `json:"call"`
+	DependsOn string `json:"depends_on"`
+	Confidence float64 `json:"confidence"` /* 0 to 1 */
+	With int `json:"with,omitempty"` /* calls seen with DependsOn before them, if mined */
+	Without int `json:"without,omitempty"` /* calls seen without */
+	Source string `json:"source,omitempty"` /* e.g. the checker or person that found it */
+}
+
+// Matches tells whether the syscall variant name is what dep depends on
+func (dep *Dependency) Matches(name string) bool {
+	return dep.DependsOn == name || dep.DependsOn == Syscall(name)
+}
+
+type ImplicitDependencies struct {
+	deps map[string][]*Dependency /* by Call */
+}
+
+// Syscall strips the variant off a syscall name
+func Syscall(name string) string {
+	return strings.Split(name, "$")[0]
+}
+
+// Of returns the dependencies of the syscall variant name, including those of its syscall
+func (d *ImplicitDependencies) Of(name string) []*Dependency {
+	deps := d.deps[name]
+	if syscall := Syscall(name); syscall != name {
+		deps = append(deps[:len(deps):len(deps)], d.deps[syscall]...)
+	}
+	return deps
+}
+
+func (d *ImplicitDependencies) Len() int {
+	n := 0
+	for _, deps := range d.deps {
+		n += len(deps)
+	}
+	return n
+}
+
+/*
+LoadImplicitDependencies reads a dependency file of any version. Dependencies below
+minConfidence are dropped, those of the original format are taken as certain. If target
+is given, dependencies naming syscalls it doesn't have are dropped too, e.g. those of
+other architectures.
+ */
+func LoadImplicitDependencies(location string, target *prog.Target, minConfidence float64) *ImplicitDependencies {
 	json_data, e := ioutil.ReadFile(location)
 	if e != nil {
 		Failf("Unable to read %s", location)
 	}
-	if e := json.Unmarshal(json_data, &impl_deps); e != nil {
+	var top map[string]json.RawMessage
+	if e := json.Unmarshal(json_data, &top); e != nil {
+		Failf("Parse error in implicit_dependencies %s", e.Error())
+	}
+	file := new(File)
+	if _, ok := top["version"]; !ok {
+		legacy := make(map[string][]string)
+		if e := json.Unmarshal(json_data, &legacy); e != nil {
+			Failf("Parse error in implicit_dependencies %s", e.Error())
+		}
+		for call, deps := range legacy {
+			for _, dep := range deps {
+				file.Dependencies = append(file.Dependencies, &Dependency{
+					Call: call,
+					DependsOn: dep,
+					Confidence: 1,
+				})
+			}
+		}
+	} else if e := json.Unmarshal(json_data, file); e != nil {
 		Failf("Parse error in implicit_dependencies %s", e.Error())
 	}
-	return
-}
\ No newline at end of file
+	if file.Version > Version {
+		Failf("implicit_dependencies %s has version %d, only up to %d is supported", location, file.Version, Version)
+	}
+	var known map[string]bool
+	if target != nil {
+		known = make(map[string]bool, 2*len(target.Syscalls))
+		for name, meta := range target.SyscallMap {
+			known[name] = true
+			known[meta.CallName] = true
+		}
+	}
+	unknown := make(map[string]bool)
+	d := &ImplicitDependencies{
+		deps: make(map[string][]*Dependency),
+	}
+	for _, dep := range file.Dependencies {
+		if dep.Confidence < minConfidence {
+			continue
+		}
+		if known != nil && (!known[dep.Call] || !known[dep.DependsOn]) {
+			for _, name := range []string{dep.Call, dep.DependsOn} {
+				if !known[name] {
+					unknown[name] = true
+				}
+			}
+			continue
+		}
+		d.deps[dep.Call] = append(d.deps[dep.Call], dep)
+	}
+	if len(unknown) > 0 {
+		names := make([]string, 0, len(unknown))
+		for name := range unknown {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Logf(0, "Dropped implicit dependencies on syscalls the target doesn't have: %s", strings.Join(names, ", "))
+	}
+	return d
+}
@@ -0,0 +1,64 @@
+package implicit_dependencies
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+)
+
+func TestLoadImplicitDependencies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moonshine-deps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, data string) string {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	legacy := write("legacy.json", `{"ioctl": ["mount", "socket"]}`)
+	versioned := write("versioned.json", `{"version": 2, "source": "test", "dependencies": [
+		{"call": "ioctl$DRM_IOCTL_VERSION", "depends_on": "mount", "confidence": 0.8, "source": "smatch"},
+		{"call": "ioctl", "depends_on": "open", "confidence": 0.3},
+		{"call": "ioctl", "depends_on": "kexec_load", "confidence": 1}
+	]}`)
+	syscalls := map[string]*prog.Syscall{}
+	for _, name := range []string{"ioctl$DRM_IOCTL_VERSION", "ioctl", "mount", "open", "socket"} {
+		syscalls[name] = &prog.Syscall{Name: name, CallName: Syscall(name)}
+	}
+	target := &prog.Target{SyscallMap: syscalls}
+
+	tests := []struct {
+		name string
+		file string
+		minConfidence float64
+		of string
+		want []string /* what it depends on */
+	}{
+		{"legacy", legacy, 0.5, "ioctl", []string{"mount", "socket"}},
+		{"legacy variant", legacy, 0.5, "ioctl$DRM_IOCTL_VERSION", []string{"mount", "socket"}},
+		{"variant", versioned, 0, "ioctl$DRM_IOCTL_VERSION", []string{"mount", "open"}},
+		{"other variant", versioned, 0, "ioctl$FIONREAD", []string{"open"}},
+		{"confidence", versioned, 0.5, "ioctl$DRM_IOCTL_VERSION", []string{"mount"}},
+	}
+	for _, test := range tests {
+		deps := LoadImplicitDependencies(test.file, target, test.minConfidence).Of(test.of)
+		got := make([]string, 0)
+		for _, dep := range deps {
+			got = append(got, dep.DependsOn)
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%s: %s depends on %v, want %v", test.name, test.of, got, test.want)
+		}
+	}
+	if n := LoadImplicitDependencies(versioned, nil, 0).Len(); n != 3 {
+		t.Errorf("got %d dependencies without a target, want 3", n)
+	}
+}
@@ -0,0 +1,141 @@
+package implicit_dependencies
+
+import (
+	"fmt"
+	"github.com/shankarapailoor/moonshine/cover"
+	"sort"
+)
+
+type TracedCall struct {
+	Name string /* syscall without variant */
+	Cover []uint64
+	DependsOn []int /* indices of the earlier calls of the process it has explicit dependencies on */
+}
+
+type MineConfig struct {
+	MinSupport int /* calls needed both with and without the dependency */
+	MinConfidence float64
+	MaxSamples int /* calls of each syscall looked at, 0 for all */
+}
+
+type occurrence struct {
+	bits *cover.Bitset
+	before map[int]bool /* syscalls earlier in the process, by id, not explicitly depended on */
+}
+
+/*
+Mine finds candidate implicit dependencies in the calls of traced processes. B depends on
+A if the coverage of B changes depending on whether A was called before it in the same
+process: the confidence is the fraction of the calls of B after A which hit PCs none of the
+calls of B without A hit. Calls A which B explicitly depends on, e.g. the open of the fd it
+reads from, don't count as they are kept anyway. Calls without coverage are ignored.
+ */
+func Mine(procs [][]*TracedCall, conf MineConfig) *File {
+	in := cover.NewInterner()
+	ids := make(map[string]int)
+	names := make([]string, 0)
+	id := func(name string) int {
+		if i, ok := ids[name]; ok {
+			return i
+		}
+		ids[name] = len(names)
+		names = append(names, name)
+		return ids[name]
+	}
+	occurrences := make(map[int][]*occurrence)
+	for _, calls := range procs {
+		counts := make(map[int]int) /* calls of each syscall so far */
+		for i, call := range calls {
+			b := id(call.Name)
+			if len(call.Cover) > 0 {
+				explicit := make(map[int]int)
+				for _, dep := range call.DependsOn {
+					if dep < i {
+						explicit[id(calls[dep].Name)] += 1
+					}
+				}
+				before := make(map[int]bool)
+				for a, n := range counts {
+					if n > explicit[a] {
+						before[a] = true
+					}
+				}
+				occurrences[b] = append(occurrences[b], &occurrence{in.Intern(call.Cover), before})
+			}
+			counts[b] += 1
+		}
+	}
+	file := &File{
+		Version: Version,
+		Source: fmt.Sprintf("mined from the coverage of %d processes, min support %d",
+			len(procs), conf.MinSupport),
+		Dependencies: make([]*Dependency, 0),
+	}
+	for b, occs := range occurrences {
+		occs = sample(occs, conf.MaxSamples)
+		candidates := make(map[int]bool)
+		for _, occ := range occs {
+			for a := range occ.before {
+				candidates[a] = true
+			}
+		}
+		for a := range candidates {
+			if a == b {
+				continue
+			}
+			with := make([]*cover.Bitset, 0)
+			without := make([]*cover.Bitset, 0)
+			for _, occ := range occs {
+				if occ.before[a] {
+					with = append(with, occ.bits)
+				} else {
+					without = append(without, occ.bits)
+				}
+			}
+			if len(with) < conf.MinSupport || len(without) < conf.MinSupport {
+				continue
+			}
+			unreached := cover.Union(without)
+			changed := 0
+			for _, bits := range with {
+				if bits.Difference(unreached).Count() > 0 {
+					changed += 1
+				}
+			}
+			confidence := float64(changed) / float64(len(with))
+			if confidence < conf.MinConfidence {
+				continue
+			}
+			file.Dependencies = append(file.Dependencies, &Dependency{
+				Call: names[b],
+				DependsOn: names[a],
+				Confidence: confidence,
+				With: len(with),
+				Without: len(without),
+			})
+		}
+	}
+	sort.Slice(file.Dependencies, func(i, j int) bool {
+		x, y := file.Dependencies[i], file.Dependencies[j]
+		if x.Confidence != y.Confidence {
+			return x.Confidence > y.Confidence
+		}
+		if x.Call != y.Call {
+			return x.Call < y.Call
+		}
+		return x.DependsOn < y.DependsOn
+	})
+	return file
+}
+
+// sample keeps max occurrences spread evenly over occs
+func sample(occs []*occurrence, max int) []*occurrence {
+	if max <= 0 || len(occs) <= max {
+		return occs
+	}
+	ret := make([]*occurrence, 0, max)
+	for i := 0; i < max; i++ {
+		ret = append(ret, occs[i*len(occs)/max])
+	}
+	return ret
+}
@@ -0,0 +1,45 @@
+package implicit_dependencies
+
+import (
+	"testing"
+)
+
+func call(name string, cover []uint64, deps ...int) *TracedCall {
+	return &TracedCall{Name: name, Cover: cover, DependsOn: deps}
+}
+
+func TestMine(t *testing.T) {
+	base := []uint64{0x1, 0x2}
+	extra := []uint64{0x1, 0x2, 0x10}
+	//read hits 0x10 in the processes calling ioctl before it, the open it reads from doesn't matter
+	procs := [][]*TracedCall{
+		{call("open", nil), call("ioctl", []uint64{0x20}), call("read", extra, 0)},
+		{call("open", nil), call("ioctl", []uint64{0x20}), call("read", extra, 0)},
+		{call("open", nil), call("ioctl", []uint64{0x20}), call("read", base, 0)},
+		{call("read", base)},
+		{call("read", base)},
+	}
+	tests := []struct {
+		name string
+		conf MineConfig
+		want []*Dependency
+	}{
+		{"found", MineConfig{MinSupport: 2, MinConfidence: 0.5}, []*Dependency{
+			{Call: "read", DependsOn: "ioctl", Confidence: 2.0/3, With: 3, Without: 2},
+		}},
+		{"confidence", MineConfig{MinSupport: 2, MinConfidence: 0.9}, nil},
+		{"support", MineConfig{MinSupport: 3, MinConfidence: 0.5}, nil},
+	}
+	for _, test := range tests {
+		file := Mine(procs, test.conf)
+		if len(file.Dependencies) != len(test.want) {
+			t.Errorf("%s: got %d dependencies, want %d", test.name, len(file.Dependencies), len(test.want))
+			continue
+		}
+		for i, dep := range file.Dependencies {
+			if *dep != *test.want[i] {
+				t.Errorf("%s: got %+v, want %+v", test.name, *dep, *test.want[i])
+			}
+		}
+	}
+}
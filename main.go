@@ -2,31 +2,48 @@ package main
 
 import (
 	"github.com/google/syzkaller/pkg/log"
-	. "github.com/shankarapailoor/moonshine/scanner"
 	. "github.com/shankarapailoor/moonshine/parser"
 	"github.com/google/syzkaller/prog"
 	"github.com/google/syzkaller/pkg/hash"
 	"fmt"
 	"os"
+	"encoding/json"
 	"github.com/google/syzkaller/pkg/db"
 	"io/ioutil"
 	"path/filepath"
+	"sort"
 	"strings"
 	"strconv"
 	"flag"
+	"time"
 	"github.com/shankarapailoor/moonshine/strace_types"
 	. "github.com/shankarapailoor/moonshine/logging"
 	"github.com/google/syzkaller/sys"
 	"path"
-	"github.com/shankarapailoor/moonshine/tracker"
 	"github.com/shankarapailoor/moonshine/distiller"
 	"github.com/shankarapailoor/moonshine/configs"
+	"github.com/shankarapailoor/moonshine/implicit-dependencies"
+	"github.com/shankarapailoor/moonshine/splitter"
+	"github.com/shankarapailoor/moonshine/symbolizer"
 )
 
 var (
 	flagFile = flag.String("file", "", "file to parse")
 	flagDir = flag.String("dir", "", "director to parse")
 	flagDistill = flag.String("distill", "", "Path to distillation config")
+	flagParse = flag.String("parse", "", "Path to parser config")
+	flagGraph = flag.String("graph", "", "Directory to dump dependency graphs to when distilling")
+	flagVmlinux = flag.String("vmlinux", "", "vmlinux of the traced kernel, to symbolize coverage for -report and the distillation target")
+	flagReport = flag.String("report", "", "Write a per-subsystem coverage report of distillation here, HTML if it ends in .html")
+	flagReportDepth = flag.Int("report_depth", 2, "Directory depth of the subsystems in the coverage report")
+	flagMineDeps = flag.String("mine_deps", "", "Mine implicit dependencies from the coverage of the traces into this file instead of converting them")
+	flagMineSupport = flag.Int("mine_support", 5, "Calls needed with and without a mined dependency")
+	flagMineConfidence = flag.Float64("mine_confidence", 0.5, "Confidence mined dependencies need to be written")
+	flagMineSamples = flag.Int("mine_samples", 2000, "Calls of each syscall to mine dependencies on, 0 for all")
+	flagCache = flag.String("cache", "", "Directory to cache parsed traces in, so reruns only parse new or changed traces")
+	flagWatchPoll = flag.Duration("watch_poll", 10*time.Second, "How often watch looks for new traces")
+	flagWatchPeriod = flag.Duration("watch_period", 5*time.Minute, "How often watch rebuilds the corpus if traces were added, SIGHUP rebuilds it right away")
+	flagAddr = flag.String("addr", "localhost:8081", "Address serve listens on")
 )
 
 const (
@@ -38,10 +55,41 @@ const (
 
 func main() {
 	rev := sys.GitRevision
-	flag.Parse()
+	/*
+	moonshine watch [flags] <dir> keeps a corpus up to date, see watch.go
+	moonshine serve [flags] converts traces over HTTP, see server.go
+	moonshine graph [flags] <dir> only dumps the dependency graphs of distillation
+	 */
+	command := ""
+	if len(os.Args) > 1 && (os.Args[1] == "watch" || os.Args[1] == "serve" || os.Args[1] == "graph") {
+		command = os.Args[1]
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
+	if *flagParse != "" {
+		parseConf := config.NewParserConfig(*flagParse)
+		if parseConf.BlockingCalls != nil {
+			strace_types.KeepBlockingCalls(parseConf.BlockingCalls)
+		}
+	}
 	target, err := prog.GetTarget(OS, Arch)
 	if err != nil {
 		Failf("error getting target: %v, git revision: %v", err.Error(), rev)
+	} else if command == "watch" {
+		if flag.NArg() != 1 {
+			Failf("usage: moonshine watch [flags] <dir>")
+		}
+		Watch(target, flag.Arg(0))
+	} else if command == "serve" {
+		Serve(target, *flagAddr)
+	} else if command == "graph" {
+		if flag.NArg() != 1 || *flagDistill == "" {
+			Failf("usage: moonshine graph -distill <config> [flags] <dir>")
+		}
+		WriteGraphs(target, flag.Arg(0))
+	} else if *flagMineDeps != "" {
+		MineDependencies(target, *flagMineDeps)
 	} else {
 		ParseTraces(target)
 		pack("deserialized", "corpus.db")
@@ -59,7 +107,6 @@ func progIsTooLarge(prog_ *prog.Prog) bool {
 func ParseTraces(target *prog.Target) []*Context {
 	ret := make([]*Context, 0)
 	names := make([]string, 0)
-	distill := false
 	if *flagFile != "" {
 		names = append(names, *flagFile)
 	} else if *flagDir != "" {
@@ -68,72 +115,286 @@ func ParseTraces(target *prog.Target) []*Context {
 		panic("Flag or FlagDir required")
 	}
 
-	if *flagDistill != "" {
-		distill = true
-	}
+	distillConf := loadDistillConfig()
+	distill := distillConf != nil
 	seeds := make(distiller.Seeds, 0)
 	totalFiles := len(names)
 	fmt.Printf("Total Number of Files: %d\n", totalFiles)
+	cache := openParseCache(target)
 	for i, file := range(names) {
 		fmt.Printf("Parsing File %d/%d: %s\n", i+1, totalFiles, path.Base(names[i]))
-		tree := Parse(file)
-		if tree == nil {
-			fmt.Fprintf(os.Stderr, "File: %s is empty\n", path.Base(file))
-			continue
-		}
-		ctxs := ParseTree(tree, tree.RootPid, target)
-		log.Logf(2, "Context size: ", len(ctxs))
+		ctxs := parseFile(file, target, cache)
+		log.Logf(2, "Context size: %v", len(ctxs))
 		ret = append(ret, ctxs...)
 		i := 0
 		for _, ctx := range ctxs {
-			ctx.Prog.Target = ctx.Target
 			if !distill {
-				if err := FillOutMemory(ctx.Prog, ctx.State.Tracker); err != nil {
-					log.Logf(2, "Failed to fill out memory: %s", err)
-					continue
-				}
-				if progIsTooLarge(ctx.Prog) {
-					fmt.Fprintln(os.Stderr, "Prog is too large\n")
-					continue
-				}
-				i += 1
-				s_name := "deserialized/" + filepath.Base(file) + strconv.Itoa(i)
-				if err := ioutil.WriteFile(s_name, ctx.Prog.Serialize(), 0640); err != nil {
-					Failf("failed to output file: %v", err)
+				for _, prog_ := range splitter.Split(ctx.Prog, ctx.State.Tracker) {
+					i += 1
+					s_name := "deserialized/" + filepath.Base(file) + strconv.Itoa(i)
+					if err := ioutil.WriteFile(s_name, prog_.Serialize(), 0640); err != nil {
+						Failf("failed to output file: %v", err)
+					}
 				}
 			} else {
-				newSeeds := ctx.GenerateSeeds()
-				for _, seed := range newSeeds {
-					seeds.Add(seed)
-				}
+				seeds = append(seeds, generateSeeds(ctx, distillConf)...)
 			}
 		}
 
 	}
 	if distill {
-		fmt.Fprintf(os.Stderr, "Total number of seeds: %d\n", seeds.Len())
-		distler := distiller.NewDistiller(config.NewDistillConfig(*flagDistill))
-		distler.Add(seeds)
-		distilledProgs := distler.Distill(GetProgs(ret))
-		log.Logf(2, "Distilled Progs: ", len(distilledProgs))
+		distler, distilledProgs := distillSeeds(ret, seeds, distillConf, target)
 		for i, prog_ := range distilledProgs {
-			if progIsTooLarge(prog_) {
-				fmt.Fprintln(os.Stderr, "Prog is too large")
-				continue
-			}
-			if err := prog_.Validate(); err != nil {
-				panic(fmt.Sprintf("Error validating program: %s\n", err.Error()))
-			}
 			s_name := "deserialized/" + "distill" + strconv.Itoa(i)
 			if err := ioutil.WriteFile(s_name, prog_.Serialize(), 0640); err != nil {
 				Failf("failed to output file: %v", err)
 			}
+			if distillConf.Explain != "" {
+				writeExplanation(distillConf.Explain, "distill" + strconv.Itoa(i), distler.Explain(prog_))
+			}
+			if *flagGraph != "" {
+				writeGraph(*flagGraph, "distill" + strconv.Itoa(i), distler.Graph(prog_))
+			}
+		}
+		if *flagReport != "" {
+			writeReport(*flagReport, distler.TraceCover(), distler.DistilledCover(distilledProgs))
+		}
+		if *flagGraph != "" {
+			writeTraceGraphs(*flagGraph, distler, ret)
 		}
 	}
 	return ret
 }
 
+/*
+WriteGraphs distills the traces given with -file or -dir like ParseTraces, but only dumps
+the dependency graphs of the traces and the distilled programs to dir. Neither
+deserialized/ nor the corpus are touched.
+ */
+func WriteGraphs(target *prog.Target, dir string) {
+	names := make([]string, 0)
+	if *flagFile != "" {
+		names = append(names, *flagFile)
+	} else if *flagDir != "" {
+		names = getFileNames(*flagDir)
+	} else {
+		panic("Flag or FlagDir required")
+	}
+	distillConf := loadDistillConfig()
+	ctxs := make([]*Context, 0)
+	seeds := make(distiller.Seeds, 0)
+	cache := openParseCache(target)
+	for i, file := range names {
+		fmt.Printf("Parsing File %d/%d: %s\n", i+1, len(names), path.Base(file))
+		for _, ctx := range parseFile(file, target, cache) {
+			ctxs = append(ctxs, ctx)
+			seeds = append(seeds, generateSeeds(ctx, distillConf)...)
+		}
+	}
+	distler, distilledProgs := distillSeeds(ctxs, seeds, distillConf, target)
+	for i, prog_ := range distilledProgs {
+		writeGraph(dir, "distill" + strconv.Itoa(i), distler.Graph(prog_))
+	}
+	writeTraceGraphs(dir, distler, ctxs)
+	fmt.Printf("Wrote the graphs of %d traced and %d distilled programs to %s\n",
+		len(ctxs), len(distilledProgs), dir)
+}
+
+// writeTraceGraphs dumps the dependency graph of every traced program
+func writeTraceGraphs(dir string, distler distiller.Distiller, ctxs []*Context) {
+	for _, ctx := range ctxs {
+		name := fmt.Sprintf("trace-%s-%d", ctx.Filename, ctx.Pid)
+		writeGraph(dir, name, distler.Graph(ctx.Prog))
+	}
+}
+
+// loadDistillConfig reads the config given with -distill, nil if traces aren't distilled
+func loadDistillConfig() *config.DistillConfig {
+	if *flagDistill == "" {
+		return nil
+	}
+	distillConf := config.NewDistillConfig(*flagDistill)
+	if distillConf.Target != nil && distillConf.Target.Vmlinux == "" {
+		distillConf.Target.Vmlinux = *flagVmlinux
+	}
+	return distillConf
+}
+
+// generateSeeds collapses the loops of a parsed program, if configured, and returns its seeds
+func generateSeeds(ctx *Context, distillConf *config.DistillConfig) distiller.Seeds {
+	if distillConf.MaxRepeats > 0 {
+		if removed := ctx.CompressLoops(distillConf.MaxRepeats); removed > 0 {
+			log.Logf(1, "Collapsed %d repeated calls", removed)
+		}
+	}
+	return ctx.GenerateSeeds()
+}
+
+/*
+distillSeeds distills the programs of ctxs, whose seeds are given, and returns the
+distiller along with the distilled programs syzkaller can run.
+ */
+func distillSeeds(ctxs []*Context, seeds distiller.Seeds, distillConf *config.DistillConfig,
+	target *prog.Target) (distiller.Distiller, []*prog.Prog) {
+	fmt.Fprintf(os.Stderr, "Total number of seeds: %d\n", seeds.Len())
+	distler := distiller.NewDistiller(distillConf, target)
+	distler.Add(seeds)
+	distilledProgs := distler.Distill(GetProgs(ctxs))
+	log.Logf(2, "Distilled Progs: %v", len(distilledProgs))
+	kept := make([]*prog.Prog, 0, len(distilledProgs))
+	for _, prog_ := range distilledProgs {
+		if progIsTooLarge(prog_) {
+			fmt.Fprintln(os.Stderr, "Prog is too large")
+			continue
+		}
+		if err := prog_.Validate(); err != nil {
+			panic(fmt.Sprintf("Error validating program: %s\n", err.Error()))
+		}
+		kept = append(kept, prog_)
+	}
+	return distler, kept
+}
+
+/*
+MineDependencies parses the traces and writes the implicit dependencies their coverage
+suggests, in a format the implicit distiller reads.
+ */
+func MineDependencies(target *prog.Target, out string) {
+	names := make([]string, 0)
+	if *flagFile != "" {
+		names = append(names, *flagFile)
+	} else if *flagDir != "" {
+		names = getFileNames(*flagDir)
+	} else {
+		panic("Flag or FlagDir required")
+	}
+	procs := make([][]*implicit_dependencies.TracedCall, 0)
+	cache := openParseCache(target)
+	for i, file := range names {
+		fmt.Printf("Parsing File %d/%d: %s\n", i+1, len(names), path.Base(file))
+		for _, ctx := range parseFile(file, target, cache) {
+			calls := make([]*implicit_dependencies.TracedCall, len(ctx.Prog.Calls))
+			deps := explicitDependencies(ctx)
+			for j, call := range ctx.Prog.Calls {
+				calls[j] = &implicit_dependencies.TracedCall{
+					Name: strings.Split(call.Meta.Name, "$")[0],
+					Cover: ctx.CallToCover[call],
+					DependsOn: deps[j],
+				}
+			}
+			procs = append(procs, calls)
+		}
+	}
+	file := implicit_dependencies.Mine(procs, implicit_dependencies.MineConfig{
+		MinSupport: *flagMineSupport,
+		MinConfidence: *flagMineConfidence,
+		MaxSamples: *flagMineSamples,
+	})
+	data, err := json.MarshalIndent(file, "", "\t")
+	if err != nil {
+		Failf("failed to marshal implicit dependencies: %v", err)
+	}
+	if err := ioutil.WriteFile(out, data, 0640); err != nil {
+		Failf("failed to output implicit dependencies: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Mined %d implicit dependencies from %d processes\n", len(file.Dependencies), len(procs))
+}
+
+/*
+writeReport symbolizes the coverage of the traces and the distilled programs and writes
+how much of each subsystem's coverage distillation kept.
+ */
+/*
+explicitDependencies returns the indices of the earlier calls each call of the trace
+explicitly depends on: the calls producing the resources it uses, e.g. the open of the fd
+it reads from, and those it depends on through the values they returned.
+ */
+func explicitDependencies(ctx *Context) [][]int {
+	idxs := make(map[*prog.Call]int, len(ctx.Prog.Calls))
+	producers := make(map[*prog.ResultArg]int, 0)
+	deps := make([][]int, len(ctx.Prog.Calls))
+	for i, call := range ctx.Prog.Calls {
+		idxs[call] = i
+		seen := make(map[int]bool, 0)
+		add := func(idx int) {
+			if idx < i && !seen[idx] {
+				seen[idx] = true
+				deps[i] = append(deps[i], idx)
+			}
+		}
+		prog.ForeachArg(call, func(arg prog.Arg, _ *prog.ArgCtx) {
+			if a, ok := arg.(*prog.ResultArg); ok {
+				if idx, ok := producers[a.Res]; ok {
+					add(idx)
+				}
+				producers[a] = i
+			}
+		})
+		for dep := range ctx.DependsOn[call] {
+			if idx, ok := idxs[dep]; ok {
+				add(idx)
+			}
+		}
+		sort.Ints(deps[i])
+	}
+	return deps
+}
+
+func writeReport(file string, traces []uint64, distilled []uint64) {
+	if *flagVmlinux == "" {
+		Failf("-report needs the vmlinux of the traced kernel")
+	}
+	s, err := symbolizer.Open(*flagVmlinux)
+	if err != nil {
+		Failf("failed to open vmlinux: %v", err)
+	}
+	defer s.Close()
+	report := symbolizer.NewReport(s, traces, distilled, *flagReportDepth)
+	f, err := os.Create(file)
+	if err != nil {
+		Failf("failed to create report: %v", err)
+	}
+	defer f.Close()
+	if strings.HasSuffix(file, ".html") {
+		err = report.WriteHTML(f)
+	} else {
+		err = report.WriteText(f)
+	}
+	if err != nil {
+		Failf("failed to write report: %v", err)
+	}
+}
+
+/*
+The explanation of a program is kept outside of deserialized/ as
+everything in there is packed into the corpus.
+ */
+func writeExplanation(dir string, name string, lines []string) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		Failf("failed to create explanation dir: %v", err)
+	}
+	data := strings.Join(lines, "\n") + "\n"
+	if err := ioutil.WriteFile(path.Join(dir, name), []byte(data), 0640); err != nil {
+		Failf("failed to output explanation: %v", err)
+	}
+}
 
+// writeGraph dumps a dependency graph as name.dot and name.json
+func writeGraph(dir string, name string, graph *distiller.Graph) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		Failf("failed to create graph dir: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name + ".dot"), graph.DOT(name), 0640); err != nil {
+		Failf("failed to output graph: %v", err)
+	}
+	data, err := json.MarshalIndent(graph, "", "\t")
+	if err != nil {
+		Failf("failed to marshal graph: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, name + ".json"), data, 0640); err != nil {
+		Failf("failed to output graph: %v", err)
+	}
+}
 
 func getFileNames(dir string) []string {
 	names := make([]string, 0)
@@ -148,51 +409,60 @@ func getFileNames(dir string) []string {
 	return names
 }
 
-func ParseTree(tree *strace_types.TraceTree, pid int64, target *prog.Target) []*Context {
-	ctxs := make([]*Context, 0)
-	ctx, err := ParseProg(tree.TraceMap[pid], target)
-	parsedProg := ctx.Prog
-	if err != nil {
-		panic("Failed to parse program")
+/*
+openParseCache opens the cache of parsed traces given with -cache, if any. What the parser
+config changes about parsing, like the blocking calls kept, invalidates it like new
+syscall descriptions or a new parser.
+ */
+func openParseCache(target *prog.Target) *ParseCache {
+	if *flagCache == "" {
+		return nil
 	}
-
-	if len(parsedProg.Calls) == 0 {
-		parsedProg = nil
+	options := ""
+	if *flagParse != "" {
+		data, err := ioutil.ReadFile(*flagParse)
+		if err != nil {
+			Failf("failed to read parser config: %v", err)
+		}
+		options = hash.String(data)
 	}
-
-	if parsedProg != nil {
-		ctx.Prog = parsedProg
-		ctxs = append(ctxs, ctx)
+	cache, err := OpenParseCache(*flagCache, target, options)
+	if err != nil {
+		Failf("failed to open parse cache: %v", err)
 	}
-	for _, pid_ := range(tree.Ptree[pid]) {
-		if tree.TraceMap[pid_] != nil{
-			ctxs = append(ctxs, ParseTree(tree, pid_, target)...)
-		}
+	return cache
+}
+
+// parseFile converts the programs of all processes of a trace, failing if it can't
+func parseFile(file string, target *prog.Target, cache *ParseCache) []*Context {
+	ctxs, err := convertFile(file, target, cache)
+	if err != nil {
+		Failf("failed to parse %v", err)
 	}
 	return ctxs
 }
 
-func FillOutMemory(prog_ *prog.Prog, tracker *tracker.MemoryTracker) error {
-	if err := tracker.FillOutMemory(prog_); err != nil {
-		return err
-	} else {
-		totalMemory := tracker.GetTotalMemoryAllocations(prog_)
-		if totalMemory == 0 {
-			fmt.Printf("length of zero mem prog: %d\n", totalMemory)
-		} else {
-			mmapCall := prog_.Target.MakeMmap(0, uint64(totalMemory))
-			calls := make([]*prog.Call, 0)
-			calls = append(append(calls, mmapCall), prog_.Calls...)
-			prog_.Calls = calls
-		}
-		if err := prog_.Validate(); err != nil {
-			panic(fmt.Sprintf("Error validating program: %s\n", err.Error()))
-		}
+// convertFile converts the programs of all processes of a trace, unless they are cached
+func convertFile(file string, target *prog.Target, cache *ParseCache) ([]*Context, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	results, err := Convert(f, target, ConvertOptions{Filename: file, Cache: cache})
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	if len(results) == 0 {
+		fmt.Fprintf(os.Stderr, "File: %s is empty\n", path.Base(file))
+	}
+	ctxs := make([]*Context, 0, len(results))
+	for _, res := range results {
+		ctxs = append(ctxs, res.Context)
+	}
+	return ctxs, nil
 }
 
-
 func pack(dir, file string) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
@@ -0,0 +1,190 @@
+package parser
+
+import (
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/strace_types"
+)
+
+const (
+	maxBlockingTimeout = 10 * 1000 * 1000 // 10ms in nanoseconds
+	nsecPerSec = 1000 * 1000 * 1000
+	futexCmdMask = 0x7f // strips FUTEX_PRIVATE_FLAG and FUTEX_CLOCK_REALTIME
+	futexWait = 0
+	futexLockPi = 6
+	futexWaitBitset = 9
+	futexWaitRequeuePi = 11
+)
+
+/*
+Postprocess hooks run after all arguments of a call have been parsed. They are
+used to bound calls which would otherwise block the executor, e.g. a
+futex wait without a timeout or a wait4 on a child that never exits.
+A hook returns false to leave the call to hooks of lower priority.
+ */
+type PostprocessHook func(ctx *Context) bool
+
+func Postprocess(ctx *Context) {
+	call := ctx.CurrentSyzCall.Meta.CallName
+	for _, ext := range postprocessHooks[call] {
+		if ext.fn.(PostprocessHook)(ctx) {
+			return
+		}
+	}
+}
+
+func init() {
+	RegisterPostprocessHook("futex", BuiltinPriority, Postprocess_Futex)
+	RegisterPostprocessHook("nanosleep", BuiltinPriority, Postprocess_Nanosleep)
+	RegisterPostprocessHook("rt_sigtimedwait", BuiltinPriority, Postprocess_RtSigtimedwait)
+	RegisterPostprocessHook("wait4", BuiltinPriority, Postprocess_Wait4)
+}
+
+// Postprocess_Futex bounds the futex ops which wait, and leaves the others
+func Postprocess_Futex(ctx *Context) bool {
+	call := ctx.CurrentSyzCall
+	op, ok := call.Args[1].(*prog.ConstArg)
+	if !ok {
+		return false
+	}
+	switch op.Val & futexCmdMask {
+	case futexWait, futexLockPi, futexWaitBitset, futexWaitRequeuePi:
+		call.Args[3] = boundTimeout(call.Args[3], 3, ctx)
+		return true
+	}
+	return false
+}
+
+func Postprocess_Nanosleep(ctx *Context) bool {
+	call := ctx.CurrentSyzCall
+	call.Args[0] = boundTimeout(call.Args[0], 0, ctx)
+	return true
+}
+
+func Postprocess_RtSigtimedwait(ctx *Context) bool {
+	call := ctx.CurrentSyzCall
+	call.Args[2] = boundTimeout(call.Args[2], 2, ctx)
+	return true
+}
+
+func Postprocess_Wait4(ctx *Context) bool {
+	/*
+	The child we are waiting for is usually not part of the program
+	so we never want to wait on it.
+	 */
+	options, ok := ctx.CurrentSyzCall.Args[2].(*prog.ConstArg)
+	if !ok {
+		return false
+	}
+	options.Val |= ctx.Target.ConstMap["WNOHANG"]
+	return true
+}
+
+/*
+boundTimeout makes sure the timespec pointed to by arg is no longer than maxBlockingTimeout.
+A NULL timeout in the trace means the call blocks indefinitely so we allocate a fresh timespec for it.
+ */
+func boundTimeout(arg prog.Arg, straceIdx int, ctx *Context) prog.Arg {
+	ptrType, ok := arg.Type().(*prog.PtrType)
+	if !ok {
+		return arg
+	}
+	if isNullStraceArg(straceIdx, ctx) {
+		def, err := GenDefaultArg(ptrType, ctx)
+		if err != nil {
+			log.Logf(1, "Keeping the NULL timeout of %s: %v", ctx.CurrentSyzCall.Meta.Name, err)
+			return arg
+		}
+		ptr := def.(*prog.PointerArg)
+		setTimespec(ptr.Res, 0, maxBlockingTimeout)
+		return ptr
+	}
+	ptr := arg.(*prog.PointerArg)
+	if ptr.Res == nil {
+		return arg
+	}
+	if sec, nsec, ok := getTimespec(ptr.Res); ok {
+		if sec > 0 || nsec > maxBlockingTimeout {
+			log.Logf(3, "Bounding timeout of %s: %d.%09d", ctx.CurrentSyzCall.Meta.Name, sec, nsec)
+			setTimespec(ptr.Res, 0, maxBlockingTimeout)
+		}
+	}
+	return arg
+}
+
+func isNullStraceArg(idx int, ctx *Context) bool {
+	if idx >= len(ctx.CurrentStraceCall.Args) {
+		return true
+	}
+	switch a := ctx.CurrentStraceCall.Args[idx].(type) {
+	case *strace_types.PointerType:
+		return a.IsNull()
+	}
+	return false
+}
+
+func getTimespec(arg prog.Arg) (uint64, uint64, bool) {
+	group, ok := arg.(*prog.GroupArg)
+	if !ok || len(group.Inner) < 2 {
+		return 0, 0, false
+	}
+	sec, ok1 := group.Inner[0].(*prog.ResultArg)
+	nsec, ok2 := group.Inner[1].(*prog.ResultArg)
+	if !ok1 || !ok2 || sec.Res != nil || nsec.Res != nil {
+		return 0, 0, false
+	}
+	return sec.Val + nsec.Val/nsecPerSec, nsec.Val%nsecPerSec, true
+}
+
+func setTimespec(arg prog.Arg, sec uint64, nsec uint64) {
+	group, ok := arg.(*prog.GroupArg)
+	if !ok || len(group.Inner) < 2 {
+		return
+	}
+	if a, ok := group.Inner[0].(*prog.ResultArg); ok && a.Res == nil {
+		a.Val = sec
+	}
+	if a, ok := group.Inner[1].(*prog.ResultArg); ok && a.Res == nil {
+		a.Val = nsec
+	}
+}
+
+/*
+remapPid converts a pid from the trace into a pid resource. Pids belonging to
+the traced task are tied to a gettid call so the program refers to its own pid
+when it is executed. Pids of other tasks can't be reproduced so we fall back
+to the resource default.
+ */
+func remapPid(syzType *prog.ResourceType, val uint64, ctx *Context) prog.Arg {
+	pid := int32(val)
+	switch {
+	case pid == -1:
+		//Any child or every process we are allowed to signal
+		return strace_types.ResultArg(syzType, nil, val)
+	case pid <= 0:
+		//Process groups. The only group we can reproduce is our own
+		return strace_types.ResultArg(syzType, nil, 0)
+	case int64(pid) == ctx.CurrentStraceCall.Pid:
+		return strace_types.ResultArg(syzType, ownPid(ctx), syzType.Default())
+	default:
+		log.Logf(3, "Unable to remap pid: %d of call: %s", pid, ctx.CurrentStraceCall.CallName)
+		return strace_types.ResultArg(syzType, nil, syzType.Default())
+	}
+}
+
+func ownPid(ctx *Context) *prog.ResultArg {
+	meta := ctx.Target.SyscallMap["gettid"]
+	straceRet := strace_types.NewExpression(strace_types.NewIntType(ctx.CurrentStraceCall.Pid))
+	if arg := ctx.Cache.Get(meta.Ret, straceRet); arg != nil {
+		return arg.(*prog.ResultArg)
+	}
+	//The call currently being parsed hasn't been added yet so gettid goes right before it
+	call := &prog.Call{
+		Meta: meta,
+		Ret: strace_types.ReturnArg(meta.Ret),
+	}
+	ctx.Prog.Calls = append(ctx.Prog.Calls, call)
+	ctx.State.Analyze(call)
+	ctx.Cache.Cache(meta.Ret, straceRet, call.Ret)
+	return call.Ret
+}
@@ -0,0 +1,66 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/strace_types"
+)
+
+func timespec(sec int64, nsec int64) *strace_types.StructType {
+	return strace_types.NewStructType([]strace_types.Type{field("tv_sec", expr(sec)), field("tv_nsec", expr(nsec))})
+}
+
+// timeout returns the timespec the pointer arg points to
+func timeout(t *testing.T, arg prog.Arg) (uint64, uint64) {
+	ptr, ok := arg.(*prog.PointerArg)
+	if !ok || ptr.Res == nil {
+		t.Fatalf("timeout %v doesn't point to a timespec", arg)
+	}
+	sec, nsec, ok := getTimespec(ptr.Res)
+	if !ok {
+		t.Fatalf("timeout %v isn't a timespec", ptr.Res)
+	}
+	return sec, nsec
+}
+
+func TestBlockingCallsAreBounded(t *testing.T) {
+	ctx := parse(t,
+		syscall("futex", 0, strace_types.NewPointerType(0x1000, expr(0)), flag("FUTEX_WAIT"), expr(0),
+			strace_types.NullPointer(), strace_types.NullPointer(), expr(0)),
+		syscall("futex", 0, strace_types.NewPointerType(0x1000, expr(0)), flag("FUTEX_WAKE"), expr(1),
+			strace_types.NullPointer(), strace_types.NullPointer(), expr(0)),
+		syscall("nanosleep", 0, timespec(5, 0), strace_types.NullPointer()),
+		syscall("nanosleep", 0, timespec(0, 1000), strace_types.NullPointer()),
+	)
+	calls := ctx.Prog.Calls
+	if len(calls) != 4 {
+		t.Fatalf("got %d calls, want 4", len(calls))
+	}
+	if sec, nsec := timeout(t, calls[0].Args[3]); sec != 0 || nsec != maxBlockingTimeout {
+		t.Errorf("futex wait without a timeout waits for %d.%09d", sec, nsec)
+	}
+	if ptr, ok := calls[1].Args[3].(*prog.PointerArg); !ok || ptr.Res != nil {
+		t.Errorf("futex wake was given a timeout")
+	}
+	if sec, nsec := timeout(t, calls[2].Args[0]); sec != 0 || nsec != maxBlockingTimeout {
+		t.Errorf("nanosleep of 5s sleeps for %d.%09d", sec, nsec)
+	}
+	if sec, nsec := timeout(t, calls[3].Args[0]); sec != 0 || nsec != 1000 {
+		t.Errorf("nanosleep of 1us sleeps for %d.%09d", sec, nsec)
+	}
+}
+
+func TestDisabledBlockingCallsAreSkipped(t *testing.T) {
+	defer func(keep bool) {
+		strace_types.BlockingCalls["nanosleep"] = keep
+	}(strace_types.BlockingCalls["nanosleep"])
+	strace_types.BlockingCalls["nanosleep"] = false
+	ctx := parse(t,
+		syscall("socket", 3, expr(2), expr(1), expr(0)),
+		syscall("nanosleep", 0, timespec(0, 1000), strace_types.NullPointer()),
+	)
+	if len(ctx.Prog.Calls) != 1 || ctx.Prog.Calls[0].Meta.Name != "socket" {
+		t.Errorf("disabled nanosleep is kept")
+	}
+}
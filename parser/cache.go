@@ -0,0 +1,240 @@
+package parser
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"github.com/google/syzkaller/pkg/hash"
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/tracker"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+/*
+parserVersion has to be bumped by every change to the parser which changes the programs
+or contexts it makes of a trace, so traces cached by an older parser are parsed again.
+ */
+const parserVersion = 1
+
+/*
+A ParseCache keeps the contexts parsed from each trace on disk, keyed by the hash of the
+trace's content, so reruns over a growing directory of traces only parse the new or
+changed ones. Entries are only used if they were written by the same parser, see
+Revision, and with the same parse options, e.g. the blocking calls kept.
+ */
+type ParseCache struct {
+	dir string
+	revision string
+	options string
+}
+
+type cacheEntry struct {
+	Revision string
+	Options string
+	Contexts []*cachedContext
+}
+
+type cachedContext struct {
+	Prog []byte
+	Pid int64
+	Calls []*cachedCall
+	Tracker *tracker.Snapshot
+}
+
+type cachedCall struct {
+	Cover []uint64
+	Signal []uint64
+	DependsOn map[int]int /* index of each call depended on -> the index it was recorded with */
+	Notes []string
+}
+
+func OpenParseCache(dir string, target *prog.Target, options string) (*ParseCache, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &ParseCache{
+		dir: dir,
+		revision: Revision(target),
+		options: options,
+	}, nil
+}
+
+/*
+Revision identifies what traces are parsed into: the version of the parser, the syscall
+descriptions of the target the programs are made of, and the extensions registered with
+the parser.
+ */
+func Revision(target *prog.Target) string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "parser %d\n", parserVersion)
+	for _, call := range target.Syscalls {
+		fmt.Fprintf(buf, "%s %d", call.Name, call.NR)
+		for _, arg := range call.Args {
+			fmt.Fprintf(buf, " %s:%s", arg.FieldName(), arg.String())
+		}
+		buf.WriteString("\n")
+	}
+	for _, ext := range registeredExtensions() {
+		fmt.Fprintf(buf, "%s\n", ext)
+	}
+	return hash.String(buf.Bytes())
+}
+
+func (c *ParseCache) path(key string) string {
+	return filepath.Join(c.dir, key+".gob.gz")
+}
+
+/*
+Load returns the contexts cached for the trace with the given key, or false if there are
+none which can be used.
+ */
+func (c *ParseCache) Load(key string, target *prog.Target) ([]*Context, bool) {
+	f, err := os.Open(c.path(key))
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		log.Logf(0, "Ignoring corrupt parse cache entry %s: %v", key, err)
+		return nil, false
+	}
+	entry := new(cacheEntry)
+	if err := gob.NewDecoder(r).Decode(entry); err != nil {
+		log.Logf(0, "Ignoring corrupt parse cache entry %s: %v", key, err)
+		return nil, false
+	}
+	if entry.Revision != c.revision || entry.Options != c.options {
+		log.Logf(1, "Parse cache entry %s is stale", key)
+		return nil, false
+	}
+	ctxs := make([]*Context, 0, len(entry.Contexts))
+	for _, cached := range entry.Contexts {
+		ctx, err := cached.restore(target)
+		if err != nil {
+			log.Logf(0, "Ignoring parse cache entry %s: %v", key, err)
+			return nil, false
+		}
+		ctxs = append(ctxs, ctx)
+	}
+	return ctxs, true
+}
+
+/*
+Store caches the contexts parsed from the trace with the given key. They have to be
+stored as parsed, before being compressed or distilled. A trace is left uncached if any
+of its programs doesn't survive being serialized, so it's parsed again next time.
+ */
+func (c *ParseCache) Store(key string, ctxs []*Context) error {
+	entry := &cacheEntry{
+		Revision: c.revision,
+		Options: c.options,
+		Contexts: make([]*cachedContext, 0, len(ctxs)),
+	}
+	for _, ctx := range ctxs {
+		cached, err := cacheContext(ctx)
+		if err != nil {
+			return err
+		}
+		if _, err := cached.restore(ctx.Target); err != nil {
+			return fmt.Errorf("program of pid %d doesn't deserialize: %v", ctx.Pid, err)
+		}
+		entry.Contexts = append(entry.Contexts, cached)
+	}
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	if err := gob.NewEncoder(w).Encode(entry); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	//Written to the side first so a crash never leaves a truncated entry
+	tmp := c.path(key) + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path(key))
+}
+
+func cacheContext(ctx *Context) (*cachedContext, error) {
+	if ctx.Prog.Target == nil {
+		ctx.Prog.Target = ctx.Target
+	}
+	snapshot, err := ctx.State.Tracker.Snapshot(ctx.Prog)
+	if err != nil {
+		return nil, err
+	}
+	idxs := make(map[*prog.Call]int, len(ctx.Prog.Calls))
+	for i, call := range ctx.Prog.Calls {
+		idxs[call] = i
+	}
+	cached := &cachedContext{
+		Prog: ctx.Prog.Serialize(),
+		Pid: ctx.Pid,
+		Calls: make([]*cachedCall, len(ctx.Prog.Calls)),
+		Tracker: snapshot,
+	}
+	for i, call := range ctx.Prog.Calls {
+		cc := &cachedCall{
+			Cover: ctx.CallToCover[call],
+			Signal: ctx.CallToSignal[call],
+			Notes: ctx.Notes[call],
+		}
+		if deps, ok := ctx.DependsOn[call]; ok {
+			cc.DependsOn = make(map[int]int, len(deps))
+			for dep, idx := range deps {
+				depIdx, ok := idxs[dep]
+				if !ok {
+					return nil, fmt.Errorf("call %d depends on a call outside of the program", i)
+				}
+				cc.DependsOn[depIdx] = idx
+			}
+		}
+		cached.Calls[i] = cc
+	}
+	return cached, nil
+}
+
+func (cached *cachedContext) restore(target *prog.Target) (*Context, error) {
+	p, err := target.Deserialize(cached.Prog)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p.Serialize(), cached.Prog) {
+		return nil, fmt.Errorf("program changes when deserialized")
+	}
+	if len(p.Calls) != len(cached.Calls) {
+		return nil, fmt.Errorf("program has %d calls, %d were cached", len(p.Calls), len(cached.Calls))
+	}
+	ctx := NewContext(target)
+	ctx.Prog = p
+	ctx.Pid = cached.Pid
+	ctx.State.Tracker, err = cached.Tracker.Restore(p)
+	if err != nil {
+		return nil, err
+	}
+	for i, call := range p.Calls {
+		cc := cached.Calls[i]
+		ctx.CallToCover[call] = cc.Cover
+		ctx.CallToSignal[call] = cc.Signal
+		if cc.Notes != nil {
+			ctx.Notes[call] = cc.Notes
+		}
+		if cc.DependsOn != nil {
+			ctx.DependsOn[call] = make(map[*prog.Call]int, len(cc.DependsOn))
+			for depIdx, idx := range cc.DependsOn {
+				if depIdx < 0 || depIdx >= len(p.Calls) {
+					return nil, fmt.Errorf("call %d depends on missing call %d", i, depIdx)
+				}
+				ctx.DependsOn[call][p.Calls[depIdx]] = idx
+			}
+		}
+		ctx.State.Analyze(call)
+	}
+	return ctx, nil
+}
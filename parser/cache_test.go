@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/strace_types"
+)
+
+func TestParseCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moonshine-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	target := testTarget(t)
+	calls := []*strace_types.Syscall{
+		syscall("socket", 3, expr(2), expr(1), expr(0)),
+		syscall("getsockname", 0, expr(3), sockaddrIn(34567),
+			strace_types.NewArrayType([]strace_types.Type{expr(16)})),
+		syscall("bind", 0, expr(3), sockaddrIn(34567), expr(16)),
+	}
+	for i, call := range calls {
+		call.Cover = []uint64{uint64(i)}
+	}
+	ctx := parse(t, calls...)
+	cache, err := OpenParseCache(dir, target, "options")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Store("trace", []*Context{ctx}); err != nil {
+		t.Fatal(err)
+	}
+	loaded, ok := cache.Load("trace", target)
+	if !ok || len(loaded) != 1 {
+		t.Fatalf("stored trace isn't loaded")
+	}
+	restored := loaded[0]
+	if !bytes.Equal(restored.Prog.Serialize(), ctx.Prog.Serialize()) || restored.Pid != ctx.Pid {
+		t.Fatalf("got program of pid %d:\n%s\nwant pid %d:\n%s",
+			restored.Pid, restored.Prog.Serialize(), ctx.Pid, ctx.Prog.Serialize())
+	}
+	bind, getsockname := restored.Prog.Calls[2], restored.Prog.Calls[1]
+	if idx, ok := restored.DependsOn[bind][getsockname]; !ok || idx != 1 {
+		t.Errorf("bind doesn't depend on getsockname any more: %v", restored.DependsOn[bind])
+	}
+	if cover := restored.CallToCover[bind]; len(cover) != 1 || cover[0] != 2 {
+		t.Errorf("bind covers %v, want [2]", cover)
+	}
+	if err := restored.FillOutMemory(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.FillOutMemory(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored.Prog.Serialize(), ctx.Prog.Serialize()) {
+		t.Errorf("memory of the restored program is laid out differently")
+	}
+
+	stale := []*ParseCache{
+		{dir: dir, revision: cache.revision, options: "other options"},
+		{dir: dir, revision: "other revision", options: cache.options},
+	}
+	for _, c := range stale {
+		if _, ok := c.Load("trace", target); ok {
+			t.Errorf("loaded trace with revision %q and options %q", c.revision, c.options)
+		}
+	}
+	changed := &prog.Target{Syscalls: target.Syscalls[:len(target.Syscalls)-1]}
+	if Revision(changed) == cache.revision {
+		t.Errorf("revision doesn't change with the syscall descriptions")
+	}
+}
@@ -0,0 +1,266 @@
+package parser
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
+	"strings"
+)
+
+const (
+	maxLoopPeriod = 8 // longest call sequence we try to detect as a loop body
+)
+
+/*
+CompressLoops collapses runs of a repeated call sequence, e.g. the thousands of
+read/write iterations of a copy loop, down to maxRepeats repetitions. Two iterations
+are equivalent if they make the same calls with the same constants and refer to the
+same resources, or to resources produced at the same position of their own iteration.
+Coverage of the dropped iterations is merged into the first iteration which also
+records a note of what was collapsed. Returns the number of removed calls.
+ */
+func (ctx *Context) CompressLoops(maxRepeats int) int {
+	if maxRepeats < 1 {
+		return 0
+	}
+	calls := ctx.Prog.Calls
+	owners := resultOwners(calls)
+	pinned := ctx.mappingCalls()
+	dependents := ctx.dependents()
+	removed := make(map[*prog.Call]bool, 0)
+	for i := 0; i < len(calls); {
+		period, reps := longestRepetition(calls, i, owners)
+		if reps <= maxRepeats {
+			i++
+			continue
+		}
+		keep := i + period*maxRepeats
+		end := i + period*reps
+		if !canRemove(calls, keep, end, owners, pinned, dependents) {
+			i++
+			continue
+		}
+		names := make([]string, 0)
+		for j := i; j < i+period; j++ {
+			names = append(names, calls[j].Meta.Name)
+		}
+		note := fmt.Sprintf("collapsed %d repetitions of [%s] (calls %d-%d of the uncompressed program)",
+			reps-maxRepeats, strings.Join(names, " "), keep, end-1)
+		for j := keep; j < end; j++ {
+			kept := calls[i+(j-i)%period]
+			ctx.CallToCover[kept] = mergeCover(ctx.CallToCover[kept], ctx.CallToCover[calls[j]])
+			ctx.CallToSignal[kept] = mergeCover(ctx.CallToSignal[kept], ctx.CallToSignal[calls[j]])
+			removed[calls[j]] = true
+		}
+		for j := i; j < i+period; j++ {
+			ctx.Notes[calls[j]] = append(ctx.Notes[calls[j]], note)
+		}
+		log.Logf(2, "Compressing loop: %s", note)
+		i = end
+	}
+	if len(removed) > 0 {
+		ctx.removeCalls(removed)
+	}
+	return len(removed)
+}
+
+/*
+longestRepetition finds the loop body starting at start which covers the most calls
+when repeated back to back. Returns the length of the body and the number of repetitions.
+ */
+func longestRepetition(calls []*prog.Call, start int, owners map[*prog.ResultArg]int) (int, int) {
+	bestPeriod, bestReps := 1, 1
+	for period := 1; period <= maxLoopPeriod && start+2*period <= len(calls); period++ {
+		body := windowKey(calls, start, period, owners)
+		reps := 1
+		for next := start+period; next+period <= len(calls); next += period {
+			if windowKey(calls, next, period, owners) != body {
+				break
+			}
+			reps++
+		}
+		if reps > 1 && period*reps > bestPeriod*bestReps {
+			bestPeriod, bestReps = period, reps
+		}
+	}
+	return bestPeriod, bestReps
+}
+
+func windowKey(calls []*prog.Call, start int, period int, owners map[*prog.ResultArg]int) string {
+	var buf bytes.Buffer
+	for _, call := range calls[start:start+period] {
+		buf.WriteString(call.Meta.Name)
+		for _, arg := range call.Args {
+			writeArgKey(&buf, arg, start, owners)
+		}
+		buf.WriteString(";")
+	}
+	return buf.String()
+}
+
+func writeArgKey(buf *bytes.Buffer, arg prog.Arg, start int, owners map[*prog.ResultArg]int) {
+	switch a := arg.(type) {
+	case *prog.ConstArg:
+		fmt.Fprintf(buf, " c%x", a.Val)
+	case *prog.ResultArg:
+		if a.Res == nil {
+			fmt.Fprintf(buf, " v%x", a.Val)
+		} else if idx, ok := owners[a.Res]; ok && idx >= start {
+			//Resource produced inside the loop body
+			fmt.Fprintf(buf, " r%d", idx-start)
+		} else {
+			fmt.Fprintf(buf, " a%p", a.Res)
+		}
+	case *prog.PointerArg:
+		if a.Res == nil {
+			fmt.Fprintf(buf, " p%x", a.VmaSize)
+		} else {
+			buf.WriteString(" &")
+			writeArgKey(buf, a.Res, start, owners)
+		}
+	case *prog.DataArg:
+		typ := a.Type().(*prog.BufferType)
+		if typ.Dir() == prog.DirOut {
+			fmt.Fprintf(buf, " o%d", a.Size())
+		} else if typ.Kind == prog.BufferFilename || typ.Kind == prog.BufferString {
+			fmt.Fprintf(buf, " s%q", a.Data())
+		} else {
+			//Loops usually read or write different data each iteration so only the size matters
+			fmt.Fprintf(buf, " d%d", len(a.Data()))
+		}
+	case *prog.GroupArg:
+		buf.WriteString(" [")
+		for _, inner := range a.Inner {
+			writeArgKey(buf, inner, start, owners)
+		}
+		buf.WriteString(" ]")
+	case *prog.UnionArg:
+		fmt.Fprintf(buf, " u%s", a.Option.Type().FieldName())
+		writeArgKey(buf, a.Option, start, owners)
+	}
+}
+
+/*
+canRemove checks that calls[from:to] can be dropped without breaking the program:
+none of them create a memory mapping, and the resources they produce and the memory
+they write are only used by calls which are dropped as well. Calls of the window may
+depend on calls before it, e.g. the reads of a loop on the mmap before the loop.
+ */
+func canRemove(calls []*prog.Call, from int, to int, owners map[*prog.ResultArg]int,
+	pinned map[*prog.Call]bool, dependents map[*prog.Call][]int) bool {
+	for _, call := range calls[from:to] {
+		if pinned[call] {
+			return false
+		}
+		for _, idx := range dependents[call] {
+			if idx < from || idx >= to {
+				return false
+			}
+		}
+		removable := true
+		prog.ForeachArg(call, func(arg prog.Arg, _ *prog.ArgCtx) {
+			if a, ok := arg.(*prog.ResultArg); ok {
+				for use := range a.Uses() {
+					if idx := owners[use]; idx < from || idx >= to {
+						removable = false
+					}
+				}
+			}
+		})
+		if !removable {
+			return false
+		}
+	}
+	return true
+}
+
+// mappingCalls returns the calls which create a mapping, the tracker keeps referring to them
+func (ctx *Context) mappingCalls() map[*prog.Call]bool {
+	pinned := make(map[*prog.Call]bool, 0)
+	for _, call := range ctx.Prog.Calls {
+		if ctx.State.Tracker.CreatesMapping(call) {
+			pinned[call] = true
+		}
+	}
+	return pinned
+}
+
+// dependents returns, for every call, the indices of the calls which depend on it
+func (ctx *Context) dependents() map[*prog.Call][]int {
+	idxs := make(map[*prog.Call]int, len(ctx.Prog.Calls))
+	for i, call := range ctx.Prog.Calls {
+		idxs[call] = i
+	}
+	dependents := make(map[*prog.Call][]int, 0)
+	for call, dependsOn := range ctx.DependsOn {
+		idx, ok := idxs[call]
+		if !ok {
+			continue
+		}
+		for dep := range dependsOn {
+			dependents[dep] = append(dependents[dep], idx)
+		}
+	}
+	return dependents
+}
+
+func resultOwners(calls []*prog.Call) map[*prog.ResultArg]int {
+	owners := make(map[*prog.ResultArg]int, 0)
+	for i, call := range calls {
+		prog.ForeachArg(call, func(arg prog.Arg, _ *prog.ArgCtx) {
+			if a, ok := arg.(*prog.ResultArg); ok {
+				owners[a] = i
+			}
+		})
+	}
+	return owners
+}
+
+func (ctx *Context) removeCalls(removed map[*prog.Call]bool) {
+	newIdx := make(map[int]int, 0)
+	calls := make([]*prog.Call, 0)
+	for i, call := range ctx.Prog.Calls {
+		if !removed[call] {
+			newIdx[i] = len(calls)
+			calls = append(calls, call)
+			continue
+		}
+		prog.ForeachArg(call, func(arg prog.Arg, _ *prog.ArgCtx) {
+			if a, ok := arg.(*prog.ResultArg); ok && a.Res != nil {
+				delete(a.Res.Uses(), a)
+			}
+		})
+		delete(ctx.CallToCover, call)
+		delete(ctx.CallToSignal, call)
+		delete(ctx.Notes, call)
+		delete(ctx.DependsOn, call)
+	}
+	ctx.Prog.Calls = calls
+	for _, dependsOn := range ctx.DependsOn {
+		for call, idx := range dependsOn {
+			if removed[call] {
+				delete(dependsOn, call)
+				continue
+			}
+			dependsOn[call] = newIdx[idx]
+		}
+	}
+	ctx.State.Tracker.RemoveCalls(removed)
+	ctx.State.Tracker.Reindex(newIdx)
+	ctx.State.RemoveCalls(removed)
+}
+
+func mergeCover(cover []uint64, other []uint64) []uint64 {
+	merged := make([]uint64, 0, len(cover)+len(other))
+	seen := make(map[uint64]bool, len(cover))
+	for _, ips := range [][]uint64{cover, other} {
+		for _, ip := range ips {
+			if !seen[ip] {
+				seen[ip] = true
+				merged = append(merged, ip)
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,47 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/strace_types"
+)
+
+func TestCompressLoops(t *testing.T) {
+	calls := []*strace_types.Syscall{syscall("socket", 3, expr(2), expr(1), expr(0))}
+	for i := 0; i < 10; i++ {
+		read := syscall("read", 4, expr(3), strace_types.NewBufferType("abcd"), expr(4))
+		read.Cover = []uint64{0x10, 0x20 + uint64(i)}
+		calls = append(calls, read)
+	}
+	ctx := parse(t, calls...)
+	if removed := ctx.CompressLoops(2); removed != 8 {
+		t.Fatalf("removed %d calls, want 8", removed)
+	}
+	if len(ctx.Prog.Calls) != 3 {
+		t.Fatalf("got %d calls, want the socket and 2 reads", len(ctx.Prog.Calls))
+	}
+	first := ctx.Prog.Calls[1]
+	if len(ctx.CallToCover[first]) != 10 {
+		t.Errorf("first read covers %d PCs, want the 10 of all its iterations", len(ctx.CallToCover[first]))
+	}
+	if len(ctx.Notes[first]) != 1 {
+		t.Errorf("first read has notes %v, want one about the collapsed loop", ctx.Notes[first])
+	}
+	for _, call := range ctx.Prog.Calls[1:] {
+		if ctx.Prog.Calls[0].Ret != call.Args[0].(*prog.ResultArg).Res {
+			t.Errorf("read doesn't use the socket any more")
+		}
+	}
+
+	//The socket of the last iteration is bound after the loop, so none can be dropped
+	calls = calls[:0]
+	for i := 0; i < 5; i++ {
+		calls = append(calls, syscall("socket", int64(3+i), expr(2), expr(1), expr(0)))
+	}
+	calls = append(calls, syscall("bind", 0, expr(7), sockaddrIn(8888), expr(16)))
+	ctx = parse(t, calls...)
+	if removed := ctx.CompressLoops(2); removed != 0 {
+		t.Errorf("removed %d calls of a loop whose last resource is used after it", removed)
+	}
+}
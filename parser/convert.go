@@ -0,0 +1,118 @@
+package parser
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/google/syzkaller/pkg/hash"
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/scanner"
+	"github.com/shankarapailoor/moonshine/strace_types"
+	"io"
+	"io/ioutil"
+	"path"
+)
+
+type ConvertOptions struct {
+	Filename string /* of the trace, named in errors and recorded in the contexts */
+	Cache *ParseCache /* looked up before converting, and filled after, if set */
+}
+
+/*
+A Result is the program of one process of a trace. Its context holds what distillation
+and compression need, like the coverage of each call and the memory the program uses.
+ */
+type Result struct {
+	Pid int64
+	Prog *prog.Prog
+	Context *Context
+}
+
+/*
+Convert turns the trace read from r into a program for each process with calls, the
+first process first. It is safe to embed: it neither panics nor exits, a trace it can't
+convert fails with a *TraceError saying where. A trace without calls has no results.
+ */
+func Convert(r io.Reader, target *prog.Target, opts ConvertOptions) (results []*Result, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			results = nil
+			err = &TraceError{File: opts.Filename, Err: fmt.Errorf("%v", r)}
+		}
+	}()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &TraceError{File: opts.Filename, Err: err}
+	}
+	var key string
+	if opts.Cache != nil {
+		key = hash.String(data)
+		if ctxs, ok := opts.Cache.Load(key, target); ok {
+			log.Logf(1, "Took %s from the parse cache", path.Base(opts.Filename))
+			return makeResults(ctxs, opts), nil
+		}
+	}
+	tree, err := scanner.Scan(bytes.NewReader(data))
+	if err != nil {
+		if serr, ok := err.(*scanner.SyntaxError); ok {
+			return nil, &TraceError{File: opts.Filename, Line: serr.Line, Err: errors.New(serr.Detail())}
+		}
+		return nil, &TraceError{File: opts.Filename, Err: err}
+	}
+	if tree == nil {
+		return nil, nil
+	}
+	ctxs, err := convertTree(tree, tree.RootPid, target)
+	if err != nil {
+		if terr, ok := err.(*TraceError); ok {
+			terr.File = opts.Filename
+		}
+		return nil, err
+	}
+	if opts.Cache != nil {
+		if err := opts.Cache.Store(key, ctxs); err != nil {
+			log.Logf(0, "Not caching %s: %v", path.Base(opts.Filename), err)
+		}
+	}
+	return makeResults(ctxs, opts), nil
+}
+
+// convertTree converts the programs of pid and its children
+func convertTree(tree *strace_types.TraceTree, pid int64, target *prog.Target) ([]*Context, error) {
+	ctxs := make([]*Context, 0)
+	ctx, err := ParseProg(tree.TraceMap[pid], target)
+	if err != nil {
+		return nil, err
+	}
+	if len(ctx.Prog.Calls) > 0 {
+		ctx.Pid = pid
+		ctxs = append(ctxs, ctx)
+	}
+	for _, child := range tree.Ptree[pid] {
+		if tree.TraceMap[child] != nil {
+			childCtxs, err := convertTree(tree, child, target)
+			if err != nil {
+				return nil, err
+			}
+			ctxs = append(ctxs, childCtxs...)
+		}
+	}
+	return ctxs, nil
+}
+
+func makeResults(ctxs []*Context, opts ConvertOptions) []*Result {
+	results := make([]*Result, 0, len(ctxs))
+	for _, ctx := range ctxs {
+		ctx.Prog.Target = ctx.Target
+		if opts.Filename != "" {
+			ctx.Filename = path.Base(opts.Filename)
+		}
+		results = append(results, &Result{
+			Pid: ctx.Pid,
+			Prog: ctx.Prog,
+			Context: ctx,
+		})
+	}
+	return results
+}
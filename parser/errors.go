@@ -0,0 +1,59 @@
+package parser
+
+import (
+	"fmt"
+)
+
+/*
+A TraceError is a trace Convert couldn't turn into programs, along with where in the
+trace it failed. Scanning errors have no pid or call, and errors of a trace which wasn't
+read from a file have no file.
+ */
+type TraceError struct {
+	File string
+	Line int /* counts from 1, 0 if unknown */
+	Pid int64
+	Call string /* the traced call being converted */
+	Err error
+}
+
+func (e *TraceError) Error() string {
+	loc := e.File
+	if e.Line > 0 {
+		if loc != "" {
+			loc += ":"
+		}
+		loc += fmt.Sprintf("%d", e.Line)
+	}
+	if e.Call != "" {
+		if loc != "" {
+			loc += ": "
+		}
+		loc += fmt.Sprintf("pid %d: %s", e.Pid, e.Call)
+	}
+	if loc == "" {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %v", loc, e.Err)
+}
+
+func (e *TraceError) Unwrap() error {
+	return e.Err
+}
+
+// callError locates err at the traced call being converted
+func (ctx *Context) callError(err error) error {
+	if _, ok := err.(*TraceError); ok {
+		return err
+	}
+	call := ctx.CurrentStraceCall
+	if call == nil {
+		return &TraceError{Err: err}
+	}
+	return &TraceError{
+		Line: call.Line,
+		Pid: call.Pid,
+		Call: call.CallName,
+		Err: err,
+	}
+}
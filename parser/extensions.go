@@ -0,0 +1,163 @@
+package parser
+
+import (
+	"fmt"
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/strace_types"
+	"reflect"
+	"runtime"
+	"sort"
+)
+
+/*
+Priority of the extensions moonshine comes with. Extensions registered for the same name
+run from the highest priority down until one handles the call, so a package can take
+over from a built-in one, e.g. for a single ioctl, with a higher priority, or only fill
+in what the built-in one leaves with a lower one. The built-in hooks leave the calls
+they don't recognise, like an ioctl with a command they have no variant for, while the
+other built-ins handle all they are given. Extensions of the same priority run in the
+order they were registered.
+ */
+const BuiltinPriority = 0
+
+/*
+A PreprocessHook runs on a traced call before its arguments are converted, usually to
+pick the syscall variant of multiplexed syscalls like ioctl by setting
+ctx.CurrentSyzCall.Meta. It returns false to leave the call to hooks of lower priority,
+and an error if the traced call can't be converted at all.
+ */
+type PreprocessHook func(ctx *Context) (bool, error)
+
+/*
+A StructHandler rewrites the traced value of a struct into the shape syzkaller describes
+it with, e.g. the list of signals strace prints for a sigset. It returns false to leave
+the value to handlers of lower priority.
+ */
+type StructHandler func(syzType *prog.StructType, straceType strace_types.Type, ctx *Context) (strace_types.Type, bool)
+
+/*
+An InnerCallDecoder converts a call strace prints inside of an argument, like
+htons(8888) or makedev(1, 3), into the argument. A nil argument without an error leaves
+the call to decoders of lower priority.
+ */
+type InnerCallDecoder func(syzType prog.Type, call *strace_types.Call, ctx *Context) (prog.Arg, error)
+
+/*
+A MacroEvaluator evaluates a macro strace prints in an argument, like
+KERNEL_VERSION(4, 14, 0), from its arguments. It returns false to leave the macro to
+evaluators of lower priority.
+ */
+type MacroEvaluator func(args []strace_types.Type, target *prog.Target) (uint64, bool)
+
+/*
+A ConstEvaluator gives the value of a named constant strace prints which the target
+doesn't describe, or describes differently, e.g. IORING_OFF_SQ_RING. It returns false
+to leave the constant to evaluators of lower priority and then to the target.
+ */
+type ConstEvaluator func(target *prog.Target) (uint64, bool)
+
+type extension struct {
+	priority int
+	fn interface{}
+}
+
+type extensions map[string][]extension
+
+var (
+	preprocessHooks = make(extensions)
+	postprocessHooks = make(extensions)
+	structHandlers = make(extensions)
+	innerCallDecoders = make(extensions)
+	macroEvaluators = make(extensions)
+	constEvaluators = make(extensions)
+)
+
+func (exts extensions) add(kind string, name string, priority int, fn interface{}) {
+	if name == "" {
+		panic(kind + " registered without a name")
+	}
+	list := append(exts[name], extension{priority, fn})
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].priority > list[j].priority
+	})
+	exts[name] = list
+}
+
+// describe lists the extensions by kind, name, priority and the function registered
+func (exts extensions) describe(kind string) []string {
+	ret := make([]string, 0)
+	for name, list := range exts {
+		for _, ext := range list {
+			fn := runtime.FuncForPC(reflect.ValueOf(ext.fn).Pointer())
+			ret = append(ret, fmt.Sprintf("%s %s %d %s", kind, name, ext.priority, fn.Name()))
+		}
+	}
+	return ret
+}
+
+/*
+registeredExtensions describes all registered extensions, sorted, so the parse cache can
+tell traces parsed with other extensions apart.
+ */
+func registeredExtensions() []string {
+	ret := preprocessHooks.describe("preprocess hook")
+	ret = append(ret, postprocessHooks.describe("postprocess hook")...)
+	ret = append(ret, structHandlers.describe("struct handler")...)
+	ret = append(ret, innerCallDecoders.describe("inner call decoder")...)
+	ret = append(ret, macroEvaluators.describe("macro evaluator")...)
+	ret = append(ret, constEvaluators.describe("const evaluator")...)
+	sort.Strings(ret)
+	return ret
+}
+
+/*
+RegisterPreprocessHook adds a hook for calls to the syscall named as in the trace, e.g.
+"ioctl". Like the other Register functions it is meant to be called from init, before
+any trace is converted.
+ */
+func RegisterPreprocessHook(syscall string, priority int, hook PreprocessHook) {
+	if hook == nil {
+		panic(fmt.Sprintf("preprocess hook for %s is nil", syscall))
+	}
+	preprocessHooks.add("preprocess hook", syscall, priority, hook)
+}
+
+// RegisterPostprocessHook adds a hook for calls to the syscall, without its variant
+func RegisterPostprocessHook(syscall string, priority int, hook PostprocessHook) {
+	if hook == nil {
+		panic(fmt.Sprintf("postprocess hook for %s is nil", syscall))
+	}
+	postprocessHooks.add("postprocess hook", syscall, priority, hook)
+}
+
+// RegisterStructHandler adds a handler for the syzkaller struct with the given name
+func RegisterStructHandler(structName string, priority int, handler StructHandler) {
+	if handler == nil {
+		panic(fmt.Sprintf("struct handler for %s is nil", structName))
+	}
+	structHandlers.add("struct handler", structName, priority, handler)
+}
+
+// RegisterInnerCall adds a decoder for the inner call with the given name, e.g. "htons"
+func RegisterInnerCall(name string, priority int, decoder InnerCallDecoder) {
+	if decoder == nil {
+		panic(fmt.Sprintf("inner call decoder for %s is nil", name))
+	}
+	innerCallDecoders.add("inner call decoder", name, priority, decoder)
+}
+
+// RegisterMacro adds an evaluator for the macro with the given name, e.g. "KERNEL_VERSION"
+func RegisterMacro(name string, priority int, evaluator MacroEvaluator) {
+	if evaluator == nil {
+		panic(fmt.Sprintf("macro evaluator for %s is nil", name))
+	}
+	macroEvaluators.add("macro evaluator", name, priority, evaluator)
+}
+
+// RegisterConst adds an evaluator for the named constant, e.g. "IORING_OFF_SQ_RING"
+func RegisterConst(name string, priority int, evaluator ConstEvaluator) {
+	if evaluator == nil {
+		panic(fmt.Sprintf("const evaluator for %s is nil", name))
+	}
+	constEvaluators.add("const evaluator", name, priority, evaluator)
+}
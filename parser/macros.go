@@ -0,0 +1,104 @@
+package parser
+
+import (
+	"fmt"
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/strace_types"
+)
+
+func init() {
+	strace_types.EvalMacro = evalMacro
+	strace_types.EvalConst = evalConst
+	RegisterMacro("KERNEL_VERSION", BuiltinPriority, eval_KernelVersion)
+}
+
+func evalMacro(m *strace_types.Macro, target *prog.Target) (uint64, bool) {
+	for _, ext := range macroEvaluators[m.MacroName] {
+		if val, ok := ext.fn.(MacroEvaluator)(m.Args, target); ok {
+			return val, true
+		}
+	}
+	return 0, false
+}
+
+func evalConst(name string, target *prog.Target) (uint64, bool) {
+	for _, ext := range constEvaluators[name] {
+		if val, ok := ext.fn.(ConstEvaluator)(target); ok {
+			return val, true
+		}
+	}
+	return 0, false
+}
+
+/*
+checkMacros makes sure the macros in a traced argument can be evaluated, so converting
+the call fails with an error rather than a panic deep in the conversion if an extension
+for one is missing or doesn't recognise its arguments.
+ */
+func checkMacros(straceType strace_types.Type, ctx *Context) error {
+	switch a := straceType.(type) {
+	case *strace_types.Expression:
+		if a == nil {
+			return nil
+		}
+		if a.MacroType != nil {
+			for _, arg := range a.MacroType.Args {
+				if err := checkMacros(arg, ctx); err != nil {
+					return err
+				}
+			}
+			if _, ok := evalMacro(a.MacroType, ctx.Target); !ok {
+				return fmt.Errorf("cannot evaluate macro %s with %d args", a.MacroType.MacroName, len(a.MacroType.Args))
+			}
+		}
+		if a.BinOp != nil {
+			if err := checkMacros(a.BinOp.Operand1, ctx); err != nil {
+				return err
+			}
+			return checkMacros(a.BinOp.Operand2, ctx)
+		}
+		if a.Unop != nil {
+			return checkMacros(a.Unop.Operand, ctx)
+		}
+	case *strace_types.Field:
+		return checkMacros(a.Val, ctx)
+	case *strace_types.PointerType:
+		return checkMacros(a.Res, ctx)
+	case *strace_types.DynamicType:
+		if err := checkMacros(a.BeforeCall, ctx); err != nil {
+			return err
+		}
+		return checkMacros(a.AfterCall, ctx)
+	case *strace_types.StructType:
+		return checkAllMacros(a.Fields, ctx)
+	case *strace_types.ArrayType:
+		return checkAllMacros(a.Elems, ctx)
+	case *strace_types.Call:
+		return checkAllMacros(a.Args, ctx)
+	}
+	return nil
+}
+
+func checkAllMacros(types []strace_types.Type, ctx *Context) error {
+	for _, typ := range types {
+		if err := checkMacros(typ, ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func eval_KernelVersion(args []strace_types.Type, target *prog.Target) (uint64, bool) {
+	if len(args) != 3 {
+		return 0, false
+	}
+	parts := make([]uint64, 0, len(args))
+	for _, arg := range args {
+		a, ok := arg.(*strace_types.Expression)
+		if !ok || a.IntType == nil {
+			return 0, false
+		}
+		parts = append(parts, a.Eval(target))
+	}
+	return (parts[0] << 16) + (parts[1] << 8) + parts[2], true
+}
@@ -0,0 +1,52 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/strace_types"
+)
+
+func macro(name string, args ...strace_types.Type) *strace_types.Expression {
+	return strace_types.NewExpression(strace_types.NewMacroType(name, args))
+}
+
+func TestMacros(t *testing.T) {
+	RegisterMacro("TEST_VERSION", BuiltinPriority+1, func(args []strace_types.Type, target *prog.Target) (uint64, bool) {
+		if len(args) != 1 {
+			return 0, false
+		}
+		return 42, true
+	})
+	RegisterMacro("TEST_VERSION", BuiltinPriority, eval_KernelVersion)
+	RegisterConst("TEST_CONST", BuiltinPriority, func(target *prog.Target) (uint64, bool) {
+		return 7, true
+	})
+	tests := []struct {
+		arg strace_types.Type
+		want uint64
+	}{
+		{macro("KERNEL_VERSION", expr(4), expr(14), expr(1)), 4<<16 | 14<<8 | 1},
+		{macro("TEST_VERSION", expr(1)), 42},
+		{macro("TEST_VERSION", expr(4), expr(14), expr(1)), 4<<16 | 14<<8 | 1},
+		{flag("TEST_CONST"), 7},
+	}
+	for _, test := range tests {
+		ctx := parse(t, syscall("socket", 3, expr(2), expr(1), test.arg))
+		if val := ctx.Prog.Calls[0].Args[2].(*prog.ConstArg).Val; val != test.want {
+			t.Errorf("got %d, want %d", val, test.want)
+		}
+	}
+	for _, arg := range []strace_types.Type{
+		macro("KERNEL_VERSION", expr(4), expr(14)),
+		macro("KERNEL_VERSION", expr(4), expr(14), flag("TEST_CONST")),
+		macro("UNKNOWN_MACRO"),
+	} {
+		trace := strace_types.NewTrace()
+		trace.Add(syscall("socket", 3, expr(2), expr(1), arg))
+		_, err := ParseProg(trace, testTarget(t))
+		if _, ok := err.(*TraceError); !ok {
+			t.Errorf("got %v for a macro which can't be evaluated, want a TraceError", err)
+		}
+	}
+}
@@ -1,46 +1,52 @@
 package parser
 
 import (
+	"fmt"
 	"github.com/shankarapailoor/moonshine/strace_types"
 	"github.com/google/syzkaller/prog"
-	. "github.com/shankarapailoor/moonshine/logging"
 )
 
-func ParseInnerCall(syzType prog.Type, straceType *strace_types.Call, ctx *Context) prog.Arg {
-	switch straceType.CallName {
-	case "htons":
-		return parse_HtonsHtonl(syzType, straceType, ctx)
-	case "htonl":
-		return parse_HtonsHtonl(syzType, straceType, ctx)
-	case "inet_addr":
-		return parse_InetAddr(syzType, straceType, ctx)
-	case "inet_pton":
-		return parse_InetPton(syzType, straceType, ctx)
-	case "makedev":
-		return parse_Makedev(syzType, straceType, ctx)
-	default:
-		Failf("Inner Call: %s Unsupported", straceType.CallName)
+func init() {
+	RegisterInnerCall("htons", BuiltinPriority, parse_HtonsHtonl)
+	RegisterInnerCall("htonl", BuiltinPriority, parse_HtonsHtonl)
+	RegisterInnerCall("inet_addr", BuiltinPriority, parse_InetAddr)
+	RegisterInnerCall("inet_pton", BuiltinPriority, parse_InetPton)
+	RegisterInnerCall("makedev", BuiltinPriority, parse_Makedev)
+}
+
+func ParseInnerCall(syzType prog.Type, straceType *strace_types.Call, ctx *Context) (prog.Arg, error) {
+	for _, ext := range innerCallDecoders[straceType.CallName] {
+		arg, err := ext.fn.(InnerCallDecoder)(syzType, straceType, ctx)
+		if err != nil || arg != nil {
+			return arg, err
+		}
 	}
-	return nil
+	return nil, fmt.Errorf("unsupported inner call %s", straceType.CallName)
 }
 
-func parse_Makedev(syzType prog.Type, straceType *strace_types.Call, ctx *Context) prog.Arg {
+func parse_Makedev(syzType prog.Type, straceType *strace_types.Call, ctx *Context) (prog.Arg, error) {
 	var major, minor, id int64
 
-	arg1 := straceType.Args[0].(*strace_types.Expression)
-	arg2 := straceType.Args[1].(*strace_types.Expression)
+	if len(straceType.Args) != 2 {
+		return nil, fmt.Errorf("makedev expects 2 args: %v", straceType.Args)
+	}
+	arg1, ok1 := straceType.Args[0].(*strace_types.Expression)
+	arg2, ok2 := straceType.Args[1].(*strace_types.Expression)
+	if !ok1 || !ok2 {
+		return nil, fmt.Errorf("args of makedev are not expressions")
+	}
 	major = int64(arg1.Eval(ctx.Target))
 	minor = int64(arg2.Eval(ctx.Target))
 
 	id = ((minor & 0xff) | ((major & 0xfff) << 8) |  ((minor & ^0xff) << 12) | ((major & ^0xfff) << 32))
 
-	return strace_types.ConstArg(syzType, uint64(id))
+	return strace_types.ConstArg(syzType, uint64(id)), nil
 
 }
 
-func parse_HtonsHtonl(syzType prog.Type, straceType *strace_types.Call, ctx *Context) prog.Arg {
-	if len(straceType.Args) > 1 {
-		panic("Parsing Htons/Htonl...it has more than one arg.")
+func parse_HtonsHtonl(syzType prog.Type, straceType *strace_types.Call, ctx *Context) (prog.Arg, error) {
+	if len(straceType.Args) != 1 {
+		return nil, fmt.Errorf("%s expects 1 arg: %v", straceType.CallName, straceType.Args)
 	}
 	switch typ := syzType.(type) {
 	case *prog.ProcType:
@@ -48,35 +54,36 @@ func parse_HtonsHtonl(syzType prog.Type, straceType *strace_types.Call, ctx *Con
 		case *strace_types.Expression:
 			val := a.Eval(ctx.Target)
 			if val >= typ.ValuesPerProc {
-				return strace_types.ConstArg(syzType, typ.ValuesPerProc-1)
+				return strace_types.ConstArg(syzType, typ.ValuesPerProc-1), nil
 			} else {
-				return strace_types.ConstArg(syzType, val)
+				return strace_types.ConstArg(syzType, val), nil
 			}
-			return prog.MakeConstArg(syzType, val)
 		default:
-			panic("First arg of Htons/Htonl is not expression")
+			return nil, fmt.Errorf("first arg of %s is not an expression", straceType.CallName)
 		}
 	case *prog.ConstType, *prog.IntType, *prog.FlagsType:
 		switch a := straceType.Args[0].(type) {
 		case *strace_types.Expression:
 			val := a.Eval(ctx.Target)
-			return prog.MakeConstArg(syzType, val)
+			return prog.MakeConstArg(syzType, val), nil
 		default:
-			panic("First arg of Htons/Htonl is not expression")
+			return nil, fmt.Errorf("first arg of %s is not an expression", straceType.CallName)
 		}
 	default:
-		Failf("First arg of Htons/Htonl is not const Type: %s\n", syzType.Name())
+		return nil, fmt.Errorf("cannot convert %s to %s", straceType.CallName, syzType.Name())
 	}
-	return nil
 }
 
 
-func parse_InetAddr(syzType prog.Type, straceType *strace_types.Call, ctx *Context) prog.Arg {
-	unionType := syzType.(*prog.UnionType)
+func parse_InetAddr(syzType prog.Type, straceType *strace_types.Call, ctx *Context) (prog.Arg, error) {
+	unionType, ok := syzType.(*prog.UnionType)
+	if !ok {
+		return nil, fmt.Errorf("cannot convert inet_addr to %s", syzType.Name())
+	}
 	var optType prog.Type
 	var inner_arg prog.Arg
-	if len(straceType.Args) > 1 {
-		panic("Parsing InetAddr...it has more than one arg.")
+	if len(straceType.Args) != 1 {
+		return nil, fmt.Errorf("inet_addr expects 1 arg: %v", straceType.Args)
 	}
 	switch a := straceType.Args[0].(type) {
 	case *strace_types.IpType:
@@ -92,17 +99,20 @@ func parse_InetAddr(syzType prog.Type, straceType *strace_types.Call, ctx *Conte
 		}
 		inner_arg = ctx.Target.DefaultArg(optType)
 	default:
-		panic("Parsing inet_addr and inner arg has non ipv4 type")
+		return nil, fmt.Errorf("arg of inet_addr is not an ip address")
 	}
-	return strace_types.UnionArg(syzType, inner_arg)
+	return strace_types.UnionArg(syzType, inner_arg), nil
 }
 
-func parse_InetPton(syzType prog.Type, straceType *strace_types.Call, ctx *Context) prog.Arg {
-	unionType := syzType.(*prog.UnionType)
+func parse_InetPton(syzType prog.Type, straceType *strace_types.Call, ctx *Context) (prog.Arg, error) {
+	unionType, ok := syzType.(*prog.UnionType)
+	if !ok {
+		return nil, fmt.Errorf("cannot convert inet_pton to %s", syzType.Name())
+	}
 	var optType prog.Type
 	var inner_arg prog.Arg
 	if len(straceType.Args) != 3 {
-		Failf("InetPton expects 3 args: %v.", straceType.Args)
+		return nil, fmt.Errorf("inet_pton expects 3 args: %v", straceType.Args)
 	}
 	switch a := straceType.Args[1].(type) {
 	case *strace_types.IpType:
@@ -116,7 +126,7 @@ func parse_InetPton(syzType prog.Type, straceType *strace_types.Call, ctx *Conte
 		}
 		inner_arg = ctx.Target.DefaultArg(optType)
 	default:
-		panic("Parsing inet_addr and inner arg has non ipv4 type")
+		return nil, fmt.Errorf("second arg of inet_pton is not an ip address")
 	}
-	return strace_types.UnionArg(syzType, inner_arg)
+	return strace_types.UnionArg(syzType, inner_arg), nil
 }
\ No newline at end of file
@@ -3,53 +3,71 @@ package parser
 import (
 	"github.com/shankarapailoor/moonshine/strace_types"
 	"github.com/google/syzkaller/prog"
-	. "github.com/shankarapailoor/moonshine/logging"
+	"fmt"
 )
 
-type PreprocessHook func(ctx *Context)
-
-func Preprocess(ctx *Context) {
+func Preprocess(ctx *Context) error {
 	call := ctx.CurrentStraceCall.CallName
-	if procFunc, ok := PreprocessMap[call]; ok {
-		procFunc(ctx)
+	for _, ext := range preprocessHooks[call] {
+		if handled, err := ext.fn.(PreprocessHook)(ctx); handled || err != nil {
+			return err
+		}
 	}
-	return
+	return nil
 }
 
-var PreprocessMap = map[string]PreprocessHook {
-	"bpf": Preprocess_Bpf,
-	"accept": Preprocess_Accept,
-	"accept4": Preprocess_Accept,
-	"bind": Preprocess_Bind,
-	"connect": Preprocess_Connect,
-	"fcntl": Preprocess_Fcntl,
-	"getsockname": Preprocess_Getsockname,
-	"getsockopt": Preprocess_Getsockopt,
-	"ioctl": Preprocess_Ioctl,
-	"open": Preprocess_Open,
-	"prctl": Preprocess_Prctl,
-	"recvfrom": Preprocess_Recvfrom,
-	"mknod": Preprocess_Mknod,
-	"modify_ldt": Preprocess_ModifyLdt,
-	"openat": Preprocess_Openat,
-	"sendto": Preprocess_Sendto,
-	"setsockopt": Preprocess_Setsockopt,
-	"shmctl": Preprocess_Shmctl,
-	"socket": Preprocess_Socket,
+/*
+The built-in hooks pick the variant of a call from the tables in strace_types and the
+variants the target describes, and leave calls they don't recognise, e.g. an ioctl with
+an unknown command, to hooks registered with a lower priority.
+ */
+func init() {
+	for call, hook := range map[string]func(ctx *Context) bool {
+		"bpf": Preprocess_Bpf,
+		"accept": Preprocess_Accept,
+		"accept4": Preprocess_Accept,
+		"bind": Preprocess_Bind,
+		"connect": Preprocess_Connect,
+		"fcntl": Preprocess_Fcntl,
+		"getsockname": Preprocess_Getsockname,
+		"getsockopt": Preprocess_Getsockopt,
+		"ioctl": Preprocess_Ioctl,
+		"keyctl": Preprocess_Keyctl,
+		"open": Preprocess_Open,
+		"prctl": Preprocess_Prctl,
+		"recvfrom": Preprocess_Recvfrom,
+		"mknod": Preprocess_Mknod,
+		"msgctl": Preprocess_Msgctl,
+		"openat": Preprocess_Openat,
+		"semctl": Preprocess_Semctl,
+		"sendto": Preprocess_Sendto,
+		"setsockopt": Preprocess_Setsockopt,
+		"shmctl": Preprocess_Shmctl,
+		"socket": Preprocess_Socket,
+	} {
+		hook := hook
+		RegisterPreprocessHook(call, BuiltinPriority, func(ctx *Context) (bool, error) {
+			return hook(ctx), nil
+		})
+	}
+	RegisterPreprocessHook("modify_ldt", BuiltinPriority, Preprocess_ModifyLdt)
 }
 
 
-func Preprocess_Bpf(ctx *Context) {
+func Preprocess_Bpf(ctx *Context) bool {
 	bpfCmd := ctx.CurrentStraceCall.Args[0].String()
 	if suffix, ok := strace_types.Bpf_labels[bpfCmd]; ok {
 		ctx.CurrentStraceCall.CallName += suffix
 	} else if _, ok := ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName + "$" + bpfCmd]; ok {
 		ctx.CurrentStraceCall.CallName += "$"+bpfCmd
+	} else {
+		return false
 	}
 	ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+	return true
 }
 
-func Preprocess_Accept(ctx *Context) {
+func Preprocess_Accept(ctx *Context) bool {
 	/*
 	Accept can take on many subforms such as
 	accept$inet
@@ -67,12 +85,14 @@ func Preprocess_Accept(ctx *Context) {
 			if suffix = strace_types.Accept_labels[a.TypeName]; suffix != "" {
 				ctx.CurrentStraceCall.CallName += suffix
 				ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+				return true
 			}
 		}
 	}
+	return false
 }
 
-func Preprocess_Bind(ctx *Context) {
+func Preprocess_Bind(ctx *Context) bool {
 	suffix := ""
 	straceFd := ctx.CurrentStraceCall.Args[0]
 	syzFd := ctx.CurrentSyzCall.Meta.Args[0]
@@ -82,12 +102,14 @@ func Preprocess_Bind(ctx *Context) {
 			if suffix = strace_types.Bind_labels[a.TypeName]; suffix != "" {
 				ctx.CurrentStraceCall.CallName += suffix
 				ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+				return true
 			}
 		}
 	}
+	return false
 }
 
-func Preprocess_Connect(ctx *Context) {
+func Preprocess_Connect(ctx *Context) bool {
 	suffix := ""
 	straceFd := ctx.CurrentStraceCall.Args[0]
 	syzFd := ctx.CurrentSyzCall.Meta.Args[0]
@@ -97,12 +119,14 @@ func Preprocess_Connect(ctx *Context) {
 			if suffix = strace_types.Connect_labels[a.TypeName]; suffix != "" {
 				ctx.CurrentStraceCall.CallName += suffix
 				ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+				return true
 			}
 		}
 	}
+	return false
 }
 
-func Preprocess_Getsockname(ctx *Context) {
+func Preprocess_Getsockname(ctx *Context) bool {
 	suffix := ""
 	straceFd := ctx.CurrentStraceCall.Args[0]
 	syzFd := ctx.CurrentSyzCall.Meta.Args[0]
@@ -112,21 +136,25 @@ func Preprocess_Getsockname(ctx *Context) {
 			if suffix = strace_types.Getsockname_labels[a.TypeName]; suffix != "" {
 				ctx.CurrentStraceCall.CallName += suffix
 				ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+				return true
 			}
 		}
 	}
+	return false
 }
 
-func Preprocess_Socket(ctx *Context) {
+func Preprocess_Socket(ctx *Context) bool {
 	straceFd := ctx.CurrentStraceCall.Args[0]
 
 	if suffix, ok := strace_types.Socket_labels[straceFd.String()]; ok {
 		ctx.CurrentStraceCall.CallName += suffix
 		ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+		return true
 	}
+	return false
 }
 
-func Preprocess_Setsockopt(ctx *Context) {
+func Preprocess_Setsockopt(ctx *Context) bool {
 	sockLevel := ctx.CurrentStraceCall.Args[1]
 	optName := ctx.CurrentStraceCall.Args[2]
 	pair := strace_types.Pair {
@@ -136,11 +164,12 @@ func Preprocess_Setsockopt(ctx *Context) {
 	if suffix, ok := strace_types.Setsockopt_labels[pair]; ok {
 		ctx.CurrentStraceCall.CallName += suffix
 		ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+		return true
 	}
-
+	return false
 }
 
-func Preprocess_Getsockopt(ctx *Context) {
+func Preprocess_Getsockopt(ctx *Context) bool {
 	sockLevel := ctx.CurrentStraceCall.Args[1]
 	optName := ctx.CurrentStraceCall.Args[2]
 	pair := strace_types.Pair {
@@ -150,13 +179,14 @@ func Preprocess_Getsockopt(ctx *Context) {
 	if suffix, ok := strace_types.Getsockopt_labels[pair]; ok {
 		ctx.CurrentStraceCall.CallName += suffix
 		ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+		return true
 	}
-
+	return false
 }
 
 
 
-func Preprocess_Recvfrom(ctx *Context) {
+func Preprocess_Recvfrom(ctx *Context) bool {
 	suffix := ""
 	straceFd := ctx.CurrentStraceCall.Args[0]
 	syzFd := ctx.CurrentSyzCall.Meta.Args[0]
@@ -166,71 +196,117 @@ func Preprocess_Recvfrom(ctx *Context) {
 			if suffix = strace_types.Recvfrom_labels[a.TypeName]; suffix != "" {
 				ctx.CurrentStraceCall.CallName += suffix
 				ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+				return true
 			}
 		}
 	}
+	return false
 }
 
 
 
-func Preprocess_Open(ctx *Context) {
+func Preprocess_Open(ctx *Context) bool {
 	if len(ctx.CurrentStraceCall.Args) < 3 {
 		ctx.CurrentStraceCall.Args = append(ctx.CurrentStraceCall.Args,
 			strace_types.NewExpression(strace_types.NewIntType(int64(0))))
 	}
+	return true
 }
 
-func Preprocess_Mknod(ctx *Context) {
+func Preprocess_Mknod(ctx *Context) bool {
 	if len(ctx.CurrentStraceCall.Args) < 3 {
 		ctx.CurrentStraceCall.Args = append(ctx.CurrentStraceCall.Args,
 			strace_types.NewExpression(strace_types.NewIntType(int64(0))))
 	}
+	return true
 }
 
-func Preprocess_Openat(ctx *Context) {
+func Preprocess_Openat(ctx *Context) bool {
 	if len(ctx.CurrentSyzCall.Args) < 4 {
 		ctx.CurrentStraceCall.Args = append(ctx.CurrentStraceCall.Args,
 			strace_types.NewExpression(strace_types.NewIntType(int64(0))))
 	}
+	return true
 }
 
-func Preprocess_Ioctl(ctx *Context) {
+func Preprocess_Ioctl(ctx *Context) bool {
 	ioctlCmd := ctx.CurrentStraceCall.Args[1].String()
 	if suffix, ok := strace_types.Ioctl_map[ioctlCmd]; ok {
 		ctx.CurrentStraceCall.CallName += suffix
 	} else if _, ok := ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName + "$" + ioctlCmd]; ok {
 		ctx.CurrentStraceCall.CallName += "$"+ioctlCmd
+	} else {
+		return false
 	}
 	ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+	return true
 }
 
-func Preprocess_Fcntl(ctx *Context) {
+func Preprocess_Fcntl(ctx *Context) bool {
 	fcntlCmd := ctx.CurrentStraceCall.Args[1].String()
 	if suffix, ok := strace_types.Fcntl_labels[fcntlCmd]; ok {
 		ctx.CurrentStraceCall.CallName += suffix
 	} else if _, ok := ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName + "$" + fcntlCmd]; ok {
 		ctx.CurrentStraceCall.CallName += "$"+fcntlCmd
+	} else {
+		return false
 	}
 	ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+	return true
 }
 
-func Preprocess_Prctl(ctx *Context) {
+func Preprocess_Prctl(ctx *Context) bool {
 	prctlCmd := ctx.CurrentStraceCall.Args[0].String()
-	if _, ok := ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName + "$" + prctlCmd]; ok {
-		ctx.CurrentStraceCall.CallName += "$"+prctlCmd
+	if _, ok := ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName + "$" + prctlCmd]; !ok {
+		return false
 	}
+	ctx.CurrentStraceCall.CallName += "$"+prctlCmd
 	ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+	return true
 }
 
-func Preprocess_Shmctl(ctx *Context) {
+func Preprocess_Shmctl(ctx *Context) bool {
 	shmctlCmd := ctx.CurrentStraceCall.Args[1].String()
-	if _, ok := ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName + "$" + shmctlCmd]; ok {
-		ctx.CurrentStraceCall.CallName += "$"+shmctlCmd
+	if _, ok := ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName + "$" + shmctlCmd]; !ok {
+		return false
+	}
+	ctx.CurrentStraceCall.CallName += "$"+shmctlCmd
+	ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+	return true
+}
+
+func Preprocess_Msgctl(ctx *Context) bool {
+	msgctlCmd := ctx.CurrentStraceCall.Args[1].String()
+	if _, ok := ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName + "$" + msgctlCmd]; !ok {
+		return false
 	}
+	ctx.CurrentStraceCall.CallName += "$"+msgctlCmd
 	ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+	return true
 }
 
-func Preprocess_Sendto(ctx *Context) {
+func Preprocess_Semctl(ctx *Context) bool {
+	semctlCmd := ctx.CurrentStraceCall.Args[2].String()
+	if _, ok := ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName + "$" + semctlCmd]; !ok {
+		return false
+	}
+	ctx.CurrentStraceCall.CallName += "$"+semctlCmd
+	ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+	return true
+}
+
+func Preprocess_Keyctl(ctx *Context) bool {
+	keyctlCmd := ctx.CurrentStraceCall.Args[0].String()
+	suffix, ok := strace_types.Keyctl_labels[keyctlCmd]
+	if !ok {
+		return false
+	}
+	ctx.CurrentStraceCall.CallName += suffix
+	ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+	return true
+}
+
+func Preprocess_Sendto(ctx *Context) bool {
 	suffix := ""
 	straceFd := ctx.CurrentStraceCall.Args[0] //File descriptor of Accept
 	syzFd := ctx.CurrentSyzCall.Meta.Args[0]
@@ -240,13 +316,18 @@ func Preprocess_Sendto(ctx *Context) {
 			if suffix = strace_types.Sendto_labels[a.TypeName]; suffix != "" {
 				ctx.CurrentStraceCall.CallName += suffix
 				ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+				return true
 			}
 		}
 	}
+	return false
 }
 
-func Preprocess_ModifyLdt(ctx *Context) {
+func Preprocess_ModifyLdt(ctx *Context) (bool, error) {
 	suffix := ""
+	if len(ctx.CurrentStraceCall.Args) == 0 {
+		return false, fmt.Errorf("modify_ldt without arguments")
+	}
 	switch a := ctx.CurrentStraceCall.Args[0].(type) {
 	case *strace_types.Expression:
 		switch a.Eval(ctx.Target) {
@@ -258,10 +339,13 @@ func Preprocess_ModifyLdt(ctx *Context) {
 			suffix = "$read_default"
 		case 17:
 			suffix = "$write2"
+		default:
+			return false, nil
 		}
 	default:
-		Failf("Preprocess modifyldt received unexpected strace type: %s\n", a.Name())
+		return false, fmt.Errorf("expected the func of modify_ldt to be an expression, got %s", a.Name())
 	}
 	ctx.CurrentStraceCall.CallName = ctx.CurrentStraceCall.CallName + suffix
 	ctx.CurrentSyzCall.Meta = ctx.Target.SyscallMap[ctx.CurrentStraceCall.CallName]
+	return true, nil
 }
\ No newline at end of file
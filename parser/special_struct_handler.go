@@ -3,31 +3,103 @@ package parser
 import (
 	"github.com/shankarapailoor/moonshine/strace_types"
 	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/pkg/log"
+	"strconv"
+	"strings"
 )
 
-type structHandler func(syzType *prog.StructType, straceType strace_types.Type, ctx *Context) strace_types.Type
+const (
+	kernelSigRtmin = 32
+)
 
-var SpecialStruct_Map = map[string]structHandler {
-	"bpf_framed_program": bpfFramedProgramHandler,
+func init() {
+	RegisterStructHandler("bpf_framed_program", BuiltinPriority, bpfFramedProgramHandler)
+	RegisterStructHandler("sigset", BuiltinPriority, sigsetHandler)
 }
 
 func PreprocessStruct(syzType *prog.StructType, straceType strace_types.Type, ctx *Context) strace_types.Type {
-	if structFunc, ok := SpecialStruct_Map[syzType.Name()]; ok {
-		return structFunc(syzType, straceType, ctx)
+	for _, ext := range structHandlers[syzType.Name()] {
+		if res, ok := ext.fn.(StructHandler)(syzType, straceType, ctx); ok {
+			return res
+		}
 	}
 	return straceType
 }
 
-func bpfFramedProgramHandler(syzType *prog.StructType, straceType strace_types.Type, ctx *Context) strace_types.Type {
+func bpfFramedProgramHandler(syzType *prog.StructType, straceType strace_types.Type, ctx *Context) (strace_types.Type, bool) {
 	switch a := straceType.(type) {
 	case *strace_types.ArrayType:
 		straceStructArgs := make([]strace_types.Type, len(syzType.Fields))
 		arrType := a
 		straceStructArgs[1] = arrType
-		straceArg0 := GenDefaultStraceType(syzType.Fields[0])
+		straceArg0, err := GenDefaultStraceType(syzType.Fields[0])
+		if err != nil {
+			log.Logf(1, "Not framing bpf program: %v", err)
+			return straceType, false
+		}
 		straceStructArgs[0] = straceArg0
-		straceStructArgs = append(straceStructArgs, GenDefaultStraceType(syzType.Fields[1]))
-		return strace_types.NewStructType(straceStructArgs)
+		straceArg1, err := GenDefaultStraceType(syzType.Fields[1])
+		if err != nil {
+			log.Logf(1, "Not framing bpf program: %v", err)
+			return straceType, false
+		}
+		straceStructArgs = append(straceStructArgs, straceArg1)
+		return strace_types.NewStructType(straceStructArgs), true
 	}
-	return straceType
+	return straceType, false
+}
+
+func sigsetHandler(syzType *prog.StructType, straceType strace_types.Type, ctx *Context) (strace_types.Type, bool) {
+	/*
+	strace prints signal sets as the list of blocked signals without the SIG prefix,
+	e.g. rt_sigprocmask(SIG_BLOCK, [INT TERM RTMIN RT_1], [], 8), whereas Syzkaller
+	describes sigset as a struct holding the mask.
+	 */
+	switch a := straceType.(type) {
+	case *strace_types.ArrayType:
+		mask := uint64(0)
+		for _, elem := range a.Elems {
+			mask |= signalMask(elem, ctx)
+		}
+		maskType := strace_types.NewExpression(strace_types.NewIntType(int64(mask)))
+		return strace_types.NewStructType([]strace_types.Type{maskType}), true
+	}
+	return straceType, false
+}
+
+func signalMask(straceType strace_types.Type, ctx *Context) uint64 {
+	mask := uint64(0)
+	switch a := straceType.(type) {
+	case *strace_types.Expression:
+		for _, flag := range a.FlagsType {
+			if sig, ok := signalNumber(flag.Val, ctx); ok {
+				mask |= 1 << (sig-1)
+			} else {
+				log.Logf(2, "Unknown signal in signal set: %s", flag.Val)
+			}
+		}
+		for _, i := range a.IntsType {
+			if i.Val > 0 && i.Val <= 64 {
+				mask |= 1 << uint64(i.Val-1)
+			}
+		}
+	}
+	return mask
+}
+
+func signalNumber(name string, ctx *Context) (uint64, bool) {
+	if name == "RTMIN" {
+		return kernelSigRtmin, true
+	}
+	if strings.HasPrefix(name, "RT_") {
+		if n, err := strconv.ParseUint(name[3:], 10, 64); err == nil {
+			return kernelSigRtmin + n, true
+		}
+	}
+	if val, ok := ctx.Target.ConstMap["SIG" + name]; ok {
+		return val, true
+	} else if val, ok := strace_types.Special_Consts["SIG" + name]; ok {
+		return val, true
+	}
+	return 0, false
 }
@@ -5,7 +5,7 @@ import (
 	"github.com/google/syzkaller/prog"
 	"github.com/shankarapailoor/moonshine/strace_types"
 	"github.com/shankarapailoor/moonshine/tracker"
-	. "github.com/shankarapailoor/moonshine/logging"
+	"github.com/shankarapailoor/moonshine/cover"
 	"github.com/shankarapailoor/moonshine/distiller"
 	"fmt"
 	"encoding/binary"
@@ -59,7 +59,12 @@ type Context struct {
 	State *tracker.State
 	Target *prog.Target
 	CallToCover map[*prog.Call][]uint64
+	CallToSignal map[*prog.Call][]uint64 /* edges of the PCs each call hit, see cover.Signal */
 	DependsOn map[*prog.Call]map[*prog.Call]int
+	Notes map[*prog.Call][]string
+	OutputValues map[uint64]*prog.Call /* latest call handed back each value, see value_flow.go */
+	Filename string /* trace the program was parsed from */
+	Pid int64
 }
 
 func NewContext(target *prog.Target) (ctx *Context) {
@@ -70,7 +75,10 @@ func NewContext(target *prog.Target) (ctx *Context) {
 	ctx.CurrentStraceArg = nil
 	ctx.Target = target
 	ctx.CallToCover = make(map[*prog.Call][]uint64)
+	ctx.CallToSignal = make(map[*prog.Call][]uint64)
 	ctx.DependsOn = make(map[*prog.Call]map[*prog.Call]int, 0)
+	ctx.Notes = make(map[*prog.Call][]string, 0)
+	ctx.OutputValues = make(map[uint64]*prog.Call, 0)
 	return
 }
 
@@ -81,12 +89,17 @@ func (ctx *Context) GenerateSeeds() distiller.Seeds {
 		if _, ok := ctx.DependsOn[call]; ok {
 			dependsOn = ctx.DependsOn[call]
 		}
-		seeds.Add(distiller.NewSeed(call,
+		seed := distiller.NewSeed(call,
 			ctx.State,
 			dependsOn,
 			ctx.Prog,
 			i,
-			ctx.CallToCover[call]))
+			ctx.CallToCover[call])
+		seed.Signal = ctx.CallToSignal[call]
+		seed.Notes = ctx.Notes[call]
+		seed.ProgName = ctx.Filename
+		seed.Pid = ctx.Pid
+		seeds.Add(seed)
 	}
 	return seeds
 }
@@ -99,38 +112,52 @@ func GetProgs(ctxs []*Context) []*prog.Prog {
 	return progs
 }
 
-func (ctx *Context) FillOutMemory() bool {
+/*
+FillOutMemory lays out the memory of the program and prepends the mmap call backing it.
+It fails with a TraceError if the program doesn't fit into memory or isn't valid.
+ */
+func (ctx *Context) FillOutMemory() error {
 	if err := ctx.State.Tracker.FillOutMemory(ctx.Prog); err != nil {
-		return false
-	} else {
-		totalMemory := ctx.State.Tracker.GetTotalMemoryAllocations(ctx.Prog)
-		if totalMemory == 0 {
-			fmt.Printf("length of zero mem prog: %d\n", totalMemory)
-		} else {
-			mmapCall := ctx.Target.MakeMmap(0, uint64(totalMemory))
-			calls := make([]*prog.Call, 0)
-			calls = append(append(calls, mmapCall), ctx.Prog.Calls...)
-			ctx.Prog.Calls = calls
-		}
-		if err := ctx.Prog.Validate(); err != nil {
-			panic(fmt.Sprintf("Error validating program: %s\n", err.Error()))
-		}
+		return &TraceError{File: ctx.Filename, Pid: ctx.Pid, Err: err}
 	}
-	return true
+	if totalMemory := ctx.State.Tracker.GetTotalMemoryAllocations(ctx.Prog); totalMemory > 0 {
+		mmapCall := ctx.Target.MakeMmap(0, uint64(totalMemory))
+		calls := make([]*prog.Call, 0)
+		calls = append(append(calls, mmapCall), ctx.Prog.Calls...)
+		ctx.Prog.Calls = calls
+	}
+	if err := ctx.Prog.Validate(); err != nil {
+		return &TraceError{File: ctx.Filename, Pid: ctx.Pid, Err: fmt.Errorf("invalid program: %v", err)}
+	}
+	return nil
 }
 
 
-func ParseProg(trace *strace_types.Trace, target *prog.Target) (*Context, error) {
+/*
+ParseProg converts the calls of one process into a program. It fails with a TraceError
+locating the call it couldn't convert, including when that call hits a panic deeper in
+the parser or in syzkaller.
+ */
+func ParseProg(trace *strace_types.Trace, target *prog.Target) (ctx *Context, err error) {
 	syzProg := new(prog.Prog)
 	syzProg.Target = target
-	ctx := NewContext(target)
+	ctx = NewContext(target)
 	ctx.Prog = syzProg
+	defer func() {
+		if r := recover(); r != nil {
+			err = ctx.callError(fmt.Errorf("%v", r))
+		}
+	}()
 	for _, s_call := range trace.Calls {
 		ctx.CurrentStraceCall = s_call
 		if _, ok := strace_types.Unsupported[s_call.CallName]; ok {
 			log.Logf(2, "Skipping unsupported: %s", s_call.CallName)
 			continue
 		}
+		if keep, ok := strace_types.BlockingCalls[s_call.CallName]; ok && !keep {
+			log.Logf(2, "Skipping disabled blocking call: %s", s_call.CallName)
+			continue
+		}
 		if s_call.Paused {
 			/*Probably a case where the call was killed by a signal like the following
 			2179  wait4(2180,  <unfinished ...>
@@ -150,11 +177,12 @@ func ParseProg(trace *strace_types.Trace, target *prog.Target) (*Context, error)
 				continue
 			}
 			ctx.CallToCover[call] = s_call.Cover
+			ctx.CallToSignal[call] = cover.Signal(s_call.Trace)
 			ctx.State.Analyze(call)
 			ctx.Target.AssignSizesCall(call)
 			syzProg.Calls = append(syzProg.Calls, call)
 		} else {
-			Failf("Failed to parse call: %s\n", s_call.CallName)
+			return ctx, ctx.callError(err)
 		}
 	}
 	return ctx, nil
@@ -167,16 +195,21 @@ func parseCall(ctx *Context) (*prog.Call, error) {
 	retCall.Meta = syzCallDef
 	ctx.CurrentSyzCall = retCall
 
-	Preprocess(ctx)
+	if err := Preprocess(ctx); err != nil {
+		return nil, err
+	}
 	if ctx.CurrentSyzCall.Meta == nil {
 		//A call like fcntl may have variants like fcntl$get_flag
 		//but no generic fcntl system call in Syzkaller
 		return nil, nil
 	}
 	retCall.Ret = strace_types.ReturnArg(ctx.CurrentSyzCall.Meta.Ret)
+	if err := checkAllMacros(straceCall.Args, ctx); err != nil {
+		return nil, err
+	}
 
-	if call := ParseMemoryCall(ctx); call != nil {
-		return call, nil
+	if call, err := ParseMemoryCall(ctx); call != nil || err != nil {
+		return call, err
 	}
 	for i := range(retCall.Meta.Args) {
 		var strArg strace_types.Type = nil
@@ -184,19 +217,20 @@ func parseCall(ctx *Context) (*prog.Call, error) {
 			strArg = straceCall.Args[i]
 		}
 		if arg, err := parseArgs(retCall.Meta.Args[i], strArg, ctx); err != nil {
-			Failf("Failed to parse arg: %s\n", err.Error())
+			return nil, fmt.Errorf("arg %s: %v", retCall.Meta.Args[i].FieldName(), err)
 		} else {
 			retCall.Args = append(retCall.Args, arg)
 		}
 		//arg := syzCall.Args[i]
 	}
 	parseResult(retCall.Meta.Ret, straceCall.Ret, ctx)
+	Postprocess(ctx)
 
 	return retCall, nil
 }
 
 func parseResult(syzType prog.Type, straceRet int64, ctx *Context) {
-	if straceRet > 0 {
+	if straceRet > 0 || straceRet == 0 && isKernelObjectId(syzType) {
 		//TODO: This is a hack NEED to refacto lexer to parser return values into strace types
 		straceExpr := strace_types.NewExpression(strace_types.NewIntsType([]int64{straceRet}))
 		switch syzType.(type) {
@@ -208,7 +242,7 @@ func parseResult(syzType prog.Type, straceRet int64, ctx *Context) {
 
 func parseArgs(syzType prog.Type, straceArg strace_types.Type, ctx *Context) (prog.Arg, error) {
 	if straceArg == nil {
-		return GenDefaultArg(syzType, ctx), nil
+		return GenDefaultArg(syzType, ctx)
 	} else {
 		ctx.CurrentStraceArg = straceArg
 	}
@@ -216,7 +250,7 @@ func parseArgs(syzType prog.Type, straceArg strace_types.Type, ctx *Context) (pr
 	case *prog.IntType, *prog.ConstType, *prog.FlagsType,  *prog.CsumType:
 		return Parse_ConstType(a, straceArg, ctx)
 	case *prog.LenType:
-		return GenDefaultArg(syzType, ctx), nil
+		return GenDefaultArg(syzType, ctx)
 	case *prog.ProcType:
 		return Parse_ProcType(a, straceArg, ctx)
 	case *prog.ResourceType:
@@ -234,7 +268,7 @@ func parseArgs(syzType prog.Type, straceArg strace_types.Type, ctx *Context) (pr
 	case *prog.VmaType:
 		return Parse_VmaType(a, straceArg, ctx)
 	default:
-		panic(fmt.Sprintf("Unsupported  Type: %v\n", syzType))
+		return nil, fmt.Errorf("unsupported type: %v", syzType)
 	}
 }
 
@@ -245,7 +279,9 @@ func Parse_VmaType(syzType *prog.VmaType, straceType strace_types.Type, ctx *Con
 		npages = uint64(int(syzType.RangeEnd)) // + r.Intn(int(a.RangeEnd-a.RangeBegin+1)))
 	}
 	arg := strace_types.PointerArg(syzType, 0, npages, nil)
-	ctx.State.Tracker.AddAllocation(ctx.CurrentSyzCall, pageSize, arg)
+	if err := ctx.State.Tracker.AddAllocation(ctx.CurrentSyzCall, pageSize, arg); err != nil {
+		return nil, err
+	}
 	return arg, nil
 }
 
@@ -255,21 +291,22 @@ func Parse_ArrayType(syzType *prog.ArrayType, straceType strace_types.Type, ctx
 	switch a := straceType.(type) {
 	case *strace_types.ArrayType:
 		if syzType.Dir() == prog.DirOut {
-			return GenDefaultArg(syzType, ctx), nil
+			ctx.recordOutputs(a)
+			return GenDefaultArg(syzType, ctx)
 		}
 		for i := 0; i < a.Len; i++ {
 			if arg, err := parseArgs(syzType.Type, a.Elems[i], ctx); err == nil {
 				args = append(args, arg)
 			} else {
-				Failf("Error parsing array elem: %s\n", err.Error())
+				return nil, err
 			}
 		}
 	case *strace_types.Field:
 		return Parse_ArrayType(syzType, a.Val, ctx)
 	case *strace_types.PointerType, *strace_types.Expression, *strace_types.BufferType:
-		return GenDefaultArg(syzType, ctx), nil
+		return GenDefaultArg(syzType, ctx)
 	default:
-		Failf("Error parsing Array: %s with Wrong Type: %s\n", syzType.FldName, straceType.Name())
+		return nil, fmt.Errorf("cannot convert %s to array %s", straceType.Name(), syzType.FldName)
 	}
 	return strace_types.GroupArg(syzType, args), nil
 }
@@ -280,34 +317,42 @@ func Parse_StructType(syzType *prog.StructType, straceType strace_types.Type, ct
 	switch a := straceType.(type) {
 	case *strace_types.StructType:
 		reorderStructFields(syzType, a, ctx)
-		args = append(args, evalFields(syzType.Fields, a.Fields, ctx)...)
+		fields, err := evalFields(syzType.Fields, a.Fields, ctx)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, fields...)
 	case *strace_types.ArrayType:
 		//Syzkaller's pipe definition expects a pipefd struct
 		//But strace returns an array type
-		args = append(args, evalFields(syzType.Fields, a.Elems, ctx)...)
-	case *strace_types.Field:
-		if arg, err := parseArgs(syzType, a.Val, ctx); err == nil {
-			return arg, nil
-		} else {
-			Failf("Error parsing struct field: %#v", ctx)
+		fields, err := evalFields(syzType.Fields, a.Elems, ctx)
+		if err != nil {
+			return nil, err
 		}
+		args = append(args, fields...)
+	case *strace_types.Field:
+		return parseArgs(syzType, a.Val, ctx)
 	case *strace_types.Call:
-		args = append(args, ParseInnerCall(syzType, a, ctx))
+		arg, err := ParseInnerCall(syzType, a, ctx)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
 	case *strace_types.Expression:
 		/*
 		 May get here through select. E.g. select(2, [6, 7], ..) since Expression can
 		 be Ints. However, creating fd set is hard and we let default arg through
 		 */
-		return GenDefaultArg(syzType, ctx), nil
+		return GenDefaultArg(syzType, ctx)
 	case *strace_types.BufferType:
 		return serialize(syzType, []byte(a.Val), ctx)
 	default:
-		Failf("Unsupported Strace Type: %#v to Struct Type", a)
+		return nil, fmt.Errorf("cannot convert %s to struct %s", straceType.Name(), syzType.Name())
 	}
 	return strace_types.GroupArg(syzType, args), nil
 }
 
-func evalFields(syzFields []prog.Type, straceFields []strace_types.Type, ctx *Context) []prog.Arg {
+func evalFields(syzFields []prog.Type, straceFields []strace_types.Type, ctx *Context) ([]prog.Arg, error) {
 	args := make([]prog.Arg, 0)
 	j := 0
 	for i, _ := range(syzFields) {
@@ -315,16 +360,20 @@ func evalFields(syzFields []prog.Type, straceFields []strace_types.Type, ctx *Co
 			args = append(args, ctx.Target.DefaultArg(syzFields[i]))
 		} else {
 			if j >= len(straceFields) {
-				args = append(args, GenDefaultArg(syzFields[i], ctx))
+				arg, err := GenDefaultArg(syzFields[i], ctx)
+				if err != nil {
+					return nil, fmt.Errorf("field %s: %v", syzFields[i].FieldName(), err)
+				}
+				args = append(args, arg)
 			} else if arg, err := parseArgs(syzFields[i], straceFields[j], ctx); err == nil {
 				args = append(args, arg)
 			} else {
-				Failf("Error parsing struct field: %#v", ctx)
+				return nil, fmt.Errorf("field %s: %v", syzFields[i].FieldName(), err)
 			}
 			j += 1
 		}
 	}
-	return args
+	return args, nil
 }
 
 func Parse_UnionType(syzType *prog.UnionType, straceType strace_types.Type, ctx *Context) (prog.Arg, error) {
@@ -332,73 +381,80 @@ func Parse_UnionType(syzType *prog.UnionType, straceType strace_types.Type, ctx
 	case *strace_types.Field:
 		switch strValType := strType.Val.(type) {
 		case *strace_types.Call:
-			return ParseInnerCall(syzType, strValType, ctx), nil
+			return ParseInnerCall(syzType, strValType, ctx)
 		default:
 			return Parse_UnionType(syzType, strType.Val, ctx)
 		}
 	case *strace_types.Call:
-		return ParseInnerCall(syzType, strType, ctx), nil
+		return ParseInnerCall(syzType, strType, ctx)
 	default:
-		idx := IdentifyUnionType(ctx, syzType.TypeName)
+		idx, err := IdentifyUnionType(ctx, syzType.TypeName)
+		if err != nil {
+			return nil, err
+		}
+		if idx < 0 || idx >= len(syzType.Fields) {
+			return nil, fmt.Errorf("cannot identify the option of union %s", syzType.TypeName)
+		}
 		innerType := syzType.Fields[idx]
 		if innerArg, err := parseArgs(innerType, straceType, ctx); err == nil {
 			return strace_types.UnionArg(syzType, innerArg), nil
 		} else {
-			Failf("Error parsing union type: %#v", ctx)
+			return nil, err
 		}
 	}
-
-	return nil, nil
 }
 
-func IdentifyUnionType(ctx *Context, typeName string) int {
+func IdentifyUnionType(ctx *Context, typeName string) (int, error) {
 	switch typeName {
 	case "sockaddr_storage":
 		return IdentifySockaddrStorageUnion(ctx)
 	case "sockaddr_nl":
 		return IdentifySockaddrNetlinkUnion(ctx)
 	case "ifr_ifru":
-		return IdentifyIfrIfruUnion(ctx)
+		return IdentifyIfrIfruUnion(ctx), nil
 	case "ifconf":
-		return IdentifyIfconfUnion(ctx)
+		return IdentifyIfconfUnion(ctx), nil
 	case "bpf_instructions":
-		return 0
+		return 0, nil
 	case "bpf_insn":
-		return IdentifyBpfInsn(ctx)
+		return IdentifyBpfInsn(ctx), nil
 	}
-	return 0
+	return 0, nil
 }
 
-func IdentifySockaddrStorageUnion(ctx *Context) int {
+func IdentifySockaddrStorageUnion(ctx *Context) (int, error) {
 	call := ctx.CurrentStraceCall
 	var straceArg strace_types.Type
 	switch call.CallName {
 	case "bind", "connect", "recvmsg", "sendmsg", "getsockname", "accept4", "accept":
+		if len(call.Args) < 2 {
+			return -1, fmt.Errorf("%s has no address to identify sockaddr_storage by", call.CallName)
+		}
 		straceArg = call.Args[1]
 	default:
-		Failf("Trying to identify union for sockaddr_storage for call: %s\n", call.CallName)
+		return -1, fmt.Errorf("cannot identify the sockaddr_storage of %s", call.CallName)
 	}
 	switch strType := straceArg.(type) {
 	case *strace_types.StructType:
 		for i := range strType.Fields {
 			fieldStr := strType.Fields[i].String()
 			if strings.Contains(fieldStr, "AF_INET") {
-				return 1
+				return 1, nil
 			} else if strings.Contains(fieldStr, "AF_INET6") {
-				return 4
+				return 4, nil
 			} else if strings.Contains(fieldStr, "AF_UNIX") {
-				return 0
+				return 0, nil
 			} else if strings.Contains(fieldStr, "AF_NETLINK") {
-				return 5
+				return 5, nil
 			}
 		}
 	default:
-		Failf("Failed to parse Sockaddr Stroage Union Type. Strace Type: %#v\n", strType)
+		return -1, fmt.Errorf("cannot identify sockaddr_storage from %#v", straceArg)
 	}
-	return -1
+	return -1, nil
 }
 
-func IdentifySockaddrNetlinkUnion(ctx *Context) int {
+func IdentifySockaddrNetlinkUnion(ctx *Context) (int, error) {
 	switch a := ctx.CurrentStraceArg.(type) {
 	case *strace_types.StructType:
 		if len(a.Fields) > 2 {
@@ -407,26 +463,26 @@ func IdentifySockaddrNetlinkUnion(ctx *Context) int {
 				pid := b.Eval(ctx.Target)
 				if pid > 0 {
 					//User
-					return 0
+					return 0, nil
 				} else if pid == 0 {
 					//Kernel
-					return 1
+					return 1, nil
 				} else {
 					//Unspec
-					return 2
+					return 2, nil
 				}
 			case *strace_types.Field:
 				curArg := ctx.CurrentStraceArg
 				ctx.CurrentStraceArg = b.Val
-				idx := IdentifySockaddrNetlinkUnion(ctx)
+				idx, err := IdentifySockaddrNetlinkUnion(ctx)
 				ctx.CurrentStraceArg = curArg
-				return idx
+				return idx, err
 			default:
-				Failf("Parsing netlink addr struct and expect expression for first arg: %s\n", a.Name())
+				return -1, fmt.Errorf("expected the pid of netlink address %s to be an expression", a.Name())
 			}
 		}
 	}
-	return 2
+	return 2, nil
 }
 
 func IdentifyIfrIfruUnion(ctx *Context) int {
@@ -474,7 +530,7 @@ func Parse_BufferType(syzType *prog.BufferType, straceType strace_types.Type, ct
 				size := max + int(syzType.RangeBegin)
 				return prog.MakeOutDataArg(syzType, uint64(size)), nil
 			default:
-				panic(fmt.Sprintf("unexpected buffer type kind: %v. call %v arg %v", syzType.Kind, ctx.CurrentSyzCall, straceType))
+				return nil, fmt.Errorf("unexpected buffer type kind %v for %s", syzType.Kind, straceType.Name())
 			}
 		}
 	}
@@ -493,11 +549,11 @@ func Parse_BufferType(syzType *prog.BufferType, straceType strace_types.Type, ct
 		binary.LittleEndian.PutUint64(bArr, val)
 		bufVal = bArr
 	case *strace_types.StructType:
-		return GenDefaultArg(syzType, ctx), nil
+		return GenDefaultArg(syzType, ctx)
 	case *strace_types.Field:
 		return parseArgs(syzType, a.Val, ctx)
 	default:
-		Failf("Cannot parse type %#v for Buffer Type\n", straceType)
+		return nil, fmt.Errorf("cannot convert %s to buffer %s", straceType.Name(), syzType.Name())
 	}
 	if !syzType.Varlen() {
 		bufVal = strace_types.GenBuff(bufVal, syzType.Size())
@@ -522,22 +578,28 @@ func Parse_PtrType(syzType *prog.PtrType, straceType strace_types.Type, ctx *Con
 			return ctx.Target.DefaultArg(syzType), nil
 		} else {
 			if a.Res == nil {
-				res := GenDefaultArg(syzType.Type, ctx)
-				return addr(ctx, syzType, res.Size(), res)
+				res, err := GenDefaultArg(syzType.Type, ctx)
+				if err != nil {
+					return nil, err
+				}
+				return addrAt(ctx, syzType, a.Address, res)
 			}
 			if res, err := parseArgs(syzType.Type, a.Res, ctx); err != nil {
-				panic(fmt.Sprintf("Error parsing Ptr: %s", err.Error()))
+				return nil, err
 			} else {
-				return addr(ctx, syzType, res.Size(), res)
+				return addrAt(ctx, syzType, a.Address, res)
 			}
 		}
 	case *strace_types.Expression:
 		//Likely have a type of the form bind(3, 0xfffffffff, [3]);
-		res := GenDefaultArg(syzType.Type, ctx)
-		return addr(ctx, syzType, res.Size(), res)
+		res, err := GenDefaultArg(syzType.Type, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return addrAt(ctx, syzType, a.Eval(ctx.Target), res)
 	default:
 		if res, err := parseArgs(syzType.Type, a, ctx); err != nil {
-			panic(fmt.Sprintf("Error parsing Ptr: %s", err.Error()))
+			return nil, err
 		} else {
 			return addr(ctx, syzType, res.Size(), res)
 		}
@@ -546,8 +608,10 @@ func Parse_PtrType(syzType *prog.PtrType, straceType strace_types.Type, ctx *Con
 
 func Parse_ConstType(syzType prog.Type, straceType strace_types.Type, ctx *Context) (prog.Arg, error) {
 	if syzType.Dir() == prog.DirOut {
+		ctx.recordOutputs(straceType)
 		return ctx.Target.DefaultArg(syzType), nil
 	}
+	_, isInt := syzType.(*prog.IntType)
 	switch a := straceType.(type) {
 	case *strace_types.Expression:
 		if a.IntsType != nil && len(a.IntsType) >= 2 {
@@ -555,10 +619,16 @@ func Parse_ConstType(syzType prog.Type, straceType strace_types.Type, ctx *Conte
 		 	May get here through select. E.g. select(2, [6, 7], ..) since Expression can
 			 be Ints. However, creating fd set is hard and we let default arg through
 		 	*/
-			return GenDefaultArg(syzType, ctx), nil
+			return GenDefaultArg(syzType, ctx)
+		}
+		if isInt {
+			ctx.linkInputs(a)
 		}
 		return strace_types.ConstArg(syzType, a.Eval(ctx.Target)), nil
 	case *strace_types.DynamicType:
+		if syzType.Dir() == prog.DirInOut {
+			ctx.recordOutputs(a.AfterCall)
+		}
 		return strace_types.ConstArg(syzType, a.BeforeCall.Eval(ctx.Target)), nil
 	case *strace_types.ArrayType:
 		/*
@@ -566,7 +636,7 @@ func Parse_ConstType(syzType prog.Type, straceType strace_types.Type, ctx *Conte
 		as Array([0], len=1). A good example is ioctl(3, FIONBIO, [1]).
 		 */
 		if a.Len == 0 {
-			panic(fmt.Sprintf("Parsing const type. Got array type with len 0: %#v", ctx))
+			return nil, fmt.Errorf("cannot convert an empty array to %s", syzType.Name())
 		}
 		return Parse_ConstType(syzType, a.Elems[0], ctx)
 	case *strace_types.StructType:
@@ -582,10 +652,13 @@ func Parse_ConstType(syzType prog.Type, straceType strace_types.Type, ctx *Conte
 		return parseArgs(syzType, a.Val, ctx)
 	case *strace_types.Call:
 		//We have likely hit a call like inet_pton, htonl, etc
-		return ParseInnerCall(syzType, a, ctx), nil
+		if isInt {
+			ctx.linkInputs(a)
+		}
+		return ParseInnerCall(syzType, a, ctx)
 	case *strace_types.BufferType:
 		//The call almost certainly an error or missing fields
-		return GenDefaultArg(syzType, ctx), nil
+		return GenDefaultArg(syzType, ctx)
 	        //E.g. ltp_bind01 two arguments are empty and
 	case *strace_types.PointerType:
 		/*
@@ -593,15 +666,15 @@ func Parse_ConstType(syzType prog.Type, straceType strace_types.Type, ctx *Conte
 		2435  connect(3, {sa_family=0x2f ,..., 16)*/
 		return strace_types.ConstArg(syzType, a.Address), nil
 	default:
-		Failf("Cannot convert Strace Type: %s to Const Type", straceType.Name())
+		return nil, fmt.Errorf("cannot convert %s to %s", straceType.Name(), syzType.Name())
 	}
-	return nil, nil
 }
 
 func Parse_ResourceType(syzType *prog.ResourceType, straceType strace_types.Type, ctx *Context) (prog.Arg, error) {
 	if syzType.Dir() == prog.DirOut {
 		res := strace_types.ResultArg(syzType, nil, syzType.Default())
-		ctx.Cache.Cache(syzType, straceType, res)
+		ctx.Cache.Cache(syzType, resourceValue(straceType), res)
+		ctx.recordOutputs(straceType)
 		return res, nil
 	}
 	switch a := straceType.(type) {
@@ -611,21 +684,52 @@ func Parse_ResourceType(syzType *prog.ResourceType, straceType strace_types.Type
 			res := strace_types.ResultArg(arg.Type(), arg.(*prog.ResultArg), arg.Type().Default())
 			return res, nil
 		}
+		ctx.linkInputs(a)
+		if syzType.Desc.Name == "pid" {
+			return remapPid(syzType, val, ctx), nil
+		}
 		res := strace_types.ResultArg(syzType, nil, val)
 		return res, nil
 	case *strace_types.Field:
 		return Parse_ResourceType(syzType, a.Val, ctx)
 	default:
-		panic("Resource Type only supports Expression")
+		return nil, fmt.Errorf("cannot convert %s to resource %s", straceType.Name(), syzType.Name())
 	}
 }
 
+/*
+resourceValue strips the decoration strace puts around ids written by the kernel, e.g.
+timer_create(..., [3]), so they match the plain value consumers pass in.
+ */
+func resourceValue(straceType strace_types.Type) strace_types.Type {
+	switch a := straceType.(type) {
+	case *strace_types.Field:
+		return resourceValue(a.Val)
+	case *strace_types.ArrayType:
+		if a.Len == 1 {
+			return resourceValue(a.Elems[0])
+		}
+	}
+	return straceType
+}
+
+func isKernelObjectId(syzType prog.Type) bool {
+	if res, ok := syzType.(*prog.ResourceType); ok {
+		_, ok = strace_types.KernelObjectIds[res.Desc.Kind[0]]
+		return ok
+	}
+	return false
+}
+
 func Parse_ProcType(syzType *prog.ProcType, straceType strace_types.Type, ctx *Context) (prog.Arg, error) {
 	if syzType.Dir() == prog.DirOut {
-		return GenDefaultArg(syzType, ctx), nil
+		//E.g. the port getsockname hands back, which a later bind or connect reuses
+		ctx.recordOutputs(straceType)
+		return GenDefaultArg(syzType, ctx)
 	}
 	switch a := straceType.(type) {
 	case *strace_types.Expression:
+		ctx.linkInputs(a)
 		val := a.Eval(ctx.Target)
 		if val >= syzType.ValuesPerProc {
 			return strace_types.ConstArg(syzType, syzType.ValuesPerProc-1), nil
@@ -635,103 +739,138 @@ func Parse_ProcType(syzType *prog.ProcType, straceType strace_types.Type, ctx *C
 	case *strace_types.Field:
 		return parseArgs(syzType, a.Val, ctx)
 	case *strace_types.Call:
-		return ParseInnerCall(syzType, a, ctx), nil
+		ctx.linkInputs(a)
+		return ParseInnerCall(syzType, a, ctx)
 	case *strace_types.BufferType:
 	/* Again probably an error case
 	   Something like the following will trigger this
 	    bind(3, {sa_family=AF_INET, sa_data="\xac"}, 3) = -1 EINVAL(Invalid argument)
 	*/
-		return GenDefaultArg(syzType, ctx), nil
+		return GenDefaultArg(syzType, ctx)
 	default:
-		Failf("Unsupported Type for Proc: %#v\n", straceType)
+		return nil, fmt.Errorf("cannot convert %s to proc %s", straceType.Name(), syzType.Name())
 	}
-	return nil, nil
 }
 
 
-func GenDefaultArg(syzType prog.Type, ctx *Context) prog.Arg {
+// GenDefaultArg makes the argument for a value strace didn't print, pointers included
+func GenDefaultArg(syzType prog.Type, ctx *Context) (prog.Arg, error) {
 	switch a := syzType.(type) {
 	case *prog.PtrType:
 		res := ctx.Target.DefaultArg(a.Type)
-		ptr, _ := addr(ctx, syzType, res.Size(), res)
-		return ptr
+		return addr(ctx, syzType, res.Size(), res)
 	case *prog.IntType, *prog.ConstType, *prog.FlagsType, *prog.LenType, *prog.ProcType, *prog.CsumType:
-		return ctx.Target.DefaultArg(a)
+		return ctx.Target.DefaultArg(a), nil
 	case *prog.BufferType:
-		return ctx.Target.DefaultArg(a)
+		return ctx.Target.DefaultArg(a), nil
 	case *prog.StructType:
 		var inner []prog.Arg
 		for _, field := range a.Fields {
-			inner = append(inner, GenDefaultArg(field, ctx))
+			arg, err := GenDefaultArg(field, ctx)
+			if err != nil {
+				return nil, err
+			}
+			inner = append(inner, arg)
 		}
-		return strace_types.GroupArg(a, inner)
+		return strace_types.GroupArg(a, inner), nil
 	case *prog.UnionType:
-		optType := a.Fields[0]
-		return strace_types.UnionArg(a, GenDefaultArg(optType, ctx))
+		opt, err := GenDefaultArg(a.Fields[0], ctx)
+		if err != nil {
+			return nil, err
+		}
+		return strace_types.UnionArg(a, opt), nil
 	case *prog.ArrayType:
-		return ctx.Target.DefaultArg(syzType)
+		return ctx.Target.DefaultArg(syzType), nil
 	case *prog.ResourceType:
-		return prog.MakeResultArg(syzType, nil, a.Desc.Type.Default())
+		return prog.MakeResultArg(syzType, nil, a.Desc.Type.Default()), nil
 	case *prog.VmaType:
-		return ctx.Target.DefaultArg(syzType)
+		return ctx.Target.DefaultArg(syzType), nil
 	default:
-		panic(fmt.Sprintf("Unsupported Type: %#v", syzType))
+		return nil, fmt.Errorf("no default for unsupported type %s", syzType.Name())
 	}
 }
 
 func serialize(syzType prog.Type, buf []byte, ctx *Context) (prog.Arg, error) {
-	fmt.Printf("Serializing object of size: %d: %s: %d\n", syzType.Size(), syzType.Name(), len(buf))
 	switch a := syzType.(type) {
 	case *prog.IntType, *prog.ConstType, *prog.FlagsType, *prog.LenType, *prog.CsumType:
-		return strace_types.ConstArg(a, bufToUint(buf[:syzType.Size()])), nil
+		if uint64(len(buf)) < syzType.Size() {
+			return nil, fmt.Errorf("cannot serialize %d bytes into %s of size %d", len(buf), syzType.Name(), syzType.Size())
+		}
+		val, err := bufToUint(buf[:syzType.Size()])
+		if err != nil {
+			return nil, err
+		}
+		return strace_types.ConstArg(a, val), nil
 	case *prog.ProcType:
-		return GenDefaultArg(syzType, ctx), nil
+		return GenDefaultArg(syzType, ctx)
 	case *prog.PtrType:
-		if res, err := serialize(a.Type, buf, ctx); err == nil {
-			return addr(ctx, a, res.Size(), res)
+		res, err := serialize(a.Type, buf, ctx)
+		if err != nil {
+			return nil, err
 		}
-		panic("Failed to serialize pointer type")
+		return addr(ctx, a, res.Size(), res)
 	case *prog.StructType:
 		pos := uint64(0)
 		bufLen := uint64(len(buf))
 		args := make([]prog.Arg, 0)
 		for _, field := range a.Fields {
 			if pos + field.Size() >= bufLen {
-				args = append(args, GenDefaultArg(field, ctx))
+				arg, err := GenDefaultArg(field, ctx)
+				if err != nil {
+					return nil, err
+				}
+				args = append(args, arg)
 				continue
 			} else {
 				if res, err := serialize(field, buf[pos:pos+field.Size()], ctx); err == nil {
 					args = append(args, res)
 				} else {
-					panic("Failed to serialize struct field")
+					return nil, err
 				}
 			}
 			pos += field.Size()
 		}
 		return strace_types.GroupArg(syzType, args), nil
 	default:
-		panic("Unsupported Type\n")
+		return nil, fmt.Errorf("cannot serialize a buffer into %s", syzType.Name())
 	}
 }
 
-func bufToUint(buf []byte) uint64 {
+func bufToUint(buf []byte) (uint64, error) {
 	switch len(buf) {
 	case 1:
-		return uint64(buf[0])
+		return uint64(buf[0]), nil
 	case 2:
-		return uint64(binary.LittleEndian.Uint16(buf))
+		return uint64(binary.LittleEndian.Uint16(buf)), nil
 	case 4:
-		return uint64(binary.LittleEndian.Uint32(buf))
+		return uint64(binary.LittleEndian.Uint32(buf)), nil
 	case 8:
-		return binary.LittleEndian.Uint64(buf)
+		return binary.LittleEndian.Uint64(buf), nil
 	default:
-		panic("Failed to convert byte to int")
+		return 0, fmt.Errorf("cannot convert %d bytes to an int", len(buf))
 	}
 }
 
+/*
+addrAt places the data of a traced pointer. If the traced address lies inside a mapping
+the pointer points into the reconstructed mapping instead, so the call keeps its
+dependency on the call that created the mapping. Otherwise the data gets its own allocation.
+ */
+func addrAt(ctx *Context, syzType prog.Type, address uint64, data prog.Arg) (prog.Arg, error) {
+	size := data.Size()
+	if mapping := ctx.State.Tracker.FindMapping(address, address+size); address != 0 && mapping != nil {
+		arg := strace_types.PointerArg(syzType, 0, 0, data)
+		addMappingDependency(mapping, address, size, arg, ctx)
+		return arg, nil
+	}
+	return addr(ctx, syzType, size, data)
+}
+
 func addr(ctx *Context, syzType prog.Type, size uint64, data prog.Arg) (prog.Arg, error) {
 	arg := strace_types.PointerArg(syzType, uint64(0), 0, data)
-	ctx.State.Tracker.AddAllocation(ctx.CurrentSyzCall, size, arg)
+	if err := ctx.State.Tracker.AddAllocation(ctx.CurrentSyzCall, size, arg); err != nil {
+		return nil, err
+	}
 	return arg, nil
 }
 
@@ -751,7 +890,6 @@ func reorderStructFields(syzType *prog.StructType, straceType *strace_types.Stru
 		straceType.Fields[2] = straceType.Fields[3]
 		straceType.Fields[3] = field2
 	case "bpf_insn_generic", "bpf_insn_exit", "bpf_insn_alu", "bpf_insn_jmp", "bpf_insn_ldst":
-		fmt.Printf("bpf_insn_generic size: %d, typsize: %d\n", syzType.Size(), syzType.TypeSize)
 		reg := (straceType.Fields[1].Eval(ctx.Target)) | (straceType.Fields[2].Eval(ctx.Target) << 4)
 		newFields := make([]strace_types.Type, len(straceType.Fields)-1)
 		newFields[0] = straceType.Fields[0]
@@ -763,28 +901,37 @@ func reorderStructFields(syzType *prog.StructType, straceType *strace_types.Stru
 	return
 }
 
-func GenDefaultStraceType(syzType prog.Type) strace_types.Type {
+func GenDefaultStraceType(syzType prog.Type) (strace_types.Type, error) {
 	switch a := syzType.(type) {
 	case *prog.StructType:
 		straceFields := make([]strace_types.Type, len(a.Fields))
 		for i := 0; i < len(straceFields); i++ {
-			straceFields[i] = GenDefaultStraceType(a.Fields[i])
+			field, err := GenDefaultStraceType(a.Fields[i])
+			if err != nil {
+				return nil, err
+			}
+			straceFields[i] = field
 		}
-		return strace_types.NewStructType(straceFields)
+		return strace_types.NewStructType(straceFields), nil
 	case *prog.ArrayType:
-		straceFields := make([]strace_types.Type, 1)
-		straceFields[0] = GenDefaultStraceType(a.Type)
-		return strace_types.NewArrayType(straceFields)
+		elem, err := GenDefaultStraceType(a.Type)
+		if err != nil {
+			return nil, err
+		}
+		return strace_types.NewArrayType([]strace_types.Type{elem}), nil
 	case *prog.ConstType, *prog.ProcType, *prog.LenType, *prog.FlagsType, *prog.IntType:
-		return strace_types.NewExpression(strace_types.NewIntType(0))
+		return strace_types.NewExpression(strace_types.NewIntType(0)), nil
 	case *prog.PtrType:
-		return strace_types.NewPointerType(0, GenDefaultStraceType(a.Type))
+		res, err := GenDefaultStraceType(a.Type)
+		if err != nil {
+			return nil, err
+		}
+		return strace_types.NewPointerType(0, res), nil
 	case *prog.UnionType:
 		return GenDefaultStraceType(a.Fields[0])
 	default:
-		Failf("Unsupported syz type for generating default strace type: %s\n", syzType.Name())
+		return nil, fmt.Errorf("cannot generate a default strace type for %s", syzType.Name())
 	}
-	return nil
 }
 
 
@@ -0,0 +1,34 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/shankarapailoor/moonshine/strace_types"
+)
+
+func TestFillOutMemory(t *testing.T) {
+	ctx := parse(t,
+		syscall("pipe", 0, strace_types.NewArrayType([]strace_types.Type{expr(3), expr(4)})),
+		syscall("read", 0, expr(3), strace_types.NewBufferType("abcd"), expr(4)),
+	)
+	if err := ctx.FillOutMemory(); err != nil {
+		t.Fatal(err)
+	}
+	if len(ctx.Prog.Calls) != 3 || ctx.Prog.Calls[0].Meta.Name != "mmap" {
+		t.Fatalf("the memory of the program isn't mapped by its first call")
+	}
+
+	ctx = parse(t, syscall("read", 0, expr(3), strace_types.NewBufferType("abcd"), expr(4)))
+	ctx.Pid = 1
+	read := ctx.Prog.Calls[0]
+	if err := ctx.State.Tracker.AddAllocation(read, 32 << 20, read.Args[1]); err != nil {
+		t.Fatal(err)
+	}
+	err := ctx.FillOutMemory()
+	if terr, ok := err.(*TraceError); !ok || terr.Pid != 1 {
+		t.Fatalf("got %v for a program too large for syzkaller, want a TraceError of pid 1", err)
+	}
+	if err := ctx.State.Tracker.AddAllocation(read, 4, read.Args[0]); err == nil {
+		t.Errorf("allocated memory for an fd")
+	}
+}
@@ -0,0 +1,203 @@
+package parser
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/sys/targets"
+	"github.com/shankarapailoor/moonshine/strace_types"
+)
+
+const (
+	testOS = "moonshine"
+	testArch = "test"
+)
+
+var registerTestTarget sync.Once
+
+/*
+testTarget returns a small target describing the syscalls the parser tests trace, in the
+shape syzkaller describes them for linux, so the tests don't depend on a generated target.
+ */
+func testTarget(t *testing.T) *prog.Target {
+	registerTestTarget.Do(func() {
+		prog.RegisterTarget(newTestTarget(), func(target *prog.Target) {
+			target.MakeMmap = targets.MakePosixMmap(target)
+		})
+	})
+	target, err := prog.GetTarget(testOS, testArch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+func common(name string, field string, size uint64, dir prog.Dir) prog.TypeCommon {
+	return prog.TypeCommon{TypeName: name, FldName: field, TypeSize: size, ArgDir: dir}
+}
+
+func intType(name string, field string, size uint64, dir prog.Dir) *prog.IntType {
+	return &prog.IntType{IntTypeCommon: prog.IntTypeCommon{TypeCommon: common(name, field, size, dir)}}
+}
+
+func resType(name string, field string, dir prog.Dir) *prog.ResourceType {
+	return &prog.ResourceType{TypeCommon: common(name, field, 4, dir)}
+}
+
+func ptrType(field string, elem prog.Type, optional bool) *prog.PtrType {
+	typ := &prog.PtrType{TypeCommon: common("ptr", field, 8, prog.DirIn), Type: elem}
+	typ.IsOptional = optional
+	return typ
+}
+
+func lenType(field string, buf string) *prog.LenType {
+	return &prog.LenType{IntTypeCommon: prog.IntTypeCommon{TypeCommon: common("len", field, 8, prog.DirIn)}, Buf: buf}
+}
+
+func newTestTarget() *prog.Target {
+	structs := make([]*prog.KeyedStruct, 0)
+	structType := func(name string, field string, dir prog.Dir, fields ...prog.Type) *prog.StructType {
+		key := prog.StructKey{Name: name, Dir: dir}
+		exists := false
+		for _, s := range structs {
+			exists = exists || s.Key == key
+		}
+		if !exists {
+			size := uint64(0)
+			for _, f := range fields {
+				size += f.Size()
+			}
+			structs = append(structs, &prog.KeyedStruct{Key: key, Desc: &prog.StructDesc{
+				TypeCommon: common(name, "", size, dir),
+				Fields: fields,
+			}})
+		}
+		return &prog.StructType{Key: key, FldName: field}
+	}
+	sockaddrIn := func(field string, dir prog.Dir) *prog.StructType {
+		port := &prog.ProcType{
+			IntTypeCommon: prog.IntTypeCommon{TypeCommon: common("proc", "sin_port", 2, dir), BigEndian: true},
+			ValuesStart: 20000,
+			ValuesPerProc: 4,
+		}
+		return structType("sockaddr_in", field, dir,
+			intType("int16", "sa_family", 2, dir), port, intType("int32", "sin_addr", 4, dir))
+	}
+	timespec := func(field string, dir prog.Dir) *prog.StructType {
+		return structType("timespec", field, dir,
+			resType("time_sec", "sec", dir), resType("time_nsec", "nsec", dir))
+	}
+	pipefd := structType("pipefd", "pipefd", prog.DirOut,
+		resType("fd", "rfd", prog.DirOut), resType("fd", "wfd", prog.DirOut))
+	buffer := &prog.BufferType{TypeCommon: common("buffer", "buf", 0, prog.DirOut)}
+	buffer.IsVarlen = true
+	vma := &prog.VmaType{TypeCommon: common("vma", "addr", 8, prog.DirIn)}
+	mmapFd := resType("fd", "fd", prog.DirIn)
+	mmapFd.TypeSize = 4
+
+	syscalls := []*prog.Syscall{
+		{Name: "mmap", CallName: "mmap", NR: 9, Args: []prog.Type{
+			vma, lenType("len", "addr"), intType("int32", "prot", 4, prog.DirIn),
+			intType("int32", "flags", 4, prog.DirIn), mmapFd, intType("int64", "offset", 8, prog.DirIn),
+		}},
+		{Name: "socket", CallName: "socket", NR: 41, Args: []prog.Type{
+			intType("int32", "domain", 4, prog.DirIn), intType("int32", "type", 4, prog.DirIn),
+			intType("int32", "proto", 4, prog.DirIn),
+		}, Ret: resType("sock", "ret", prog.DirOut)},
+		{Name: "getsockname", CallName: "getsockname", NR: 51, Args: []prog.Type{
+			resType("sock", "fd", prog.DirIn), ptrType("addr", sockaddrIn("", prog.DirOut), false),
+			ptrType("addrlen", intType("int32", "", 4, prog.DirInOut), false),
+		}},
+		{Name: "bind", CallName: "bind", NR: 49, Args: []prog.Type{
+			resType("sock", "fd", prog.DirIn), ptrType("addr", sockaddrIn("", prog.DirIn), false),
+			lenType("addrlen", "addr"),
+		}},
+		{Name: "pipe", CallName: "pipe", NR: 22, Args: []prog.Type{
+			ptrType("pipefd", pipefd, false),
+		}},
+		{Name: "read", CallName: "read", NR: 0, Args: []prog.Type{
+			resType("fd", "fd", prog.DirIn), ptrType("buf", buffer, false), lenType("count", "buf"),
+		}},
+		{Name: "futex", CallName: "futex", NR: 202, Args: []prog.Type{
+			ptrType("addr", intType("int32", "", 4, prog.DirIn), false), intType("int32", "op", 4, prog.DirIn),
+			intType("int32", "val", 4, prog.DirIn), ptrType("timeout", timespec("", prog.DirIn), true),
+			ptrType("addr2", intType("int32", "", 4, prog.DirIn), true), intType("int32", "val3", 4, prog.DirIn),
+		}},
+		{Name: "nanosleep", CallName: "nanosleep", NR: 35, Args: []prog.Type{
+			ptrType("req", timespec("", prog.DirIn), false), ptrType("rem", timespec("", prog.DirOut), true),
+		}},
+	}
+	resource := func(name string, kind ...string) *prog.ResourceDesc {
+		return &prog.ResourceDesc{
+			Name: name,
+			Type: intType("int32", "", 4, prog.DirIn),
+			Kind: kind,
+			Values: []uint64{^uint64(0)},
+		}
+	}
+	return &prog.Target{
+		OS: testOS,
+		Arch: testArch,
+		PtrSize: 8,
+		PageSize: 4 << 10,
+		NumPages: 4 << 10,
+		DataOffset: 512 << 20,
+		Syscalls: syscalls,
+		Resources: []*prog.ResourceDesc{
+			resource("fd", "fd"),
+			resource("sock", "fd", "sock"),
+			resource("time_sec", "time_sec"),
+			resource("time_nsec", "time_nsec"),
+		},
+		Structs: structs,
+		Consts: []prog.ConstValue{
+			{Name: "AF_INET", Value: 2},
+			{Name: "FUTEX_WAIT", Value: 0},
+			{Name: "FUTEX_WAKE", Value: 1},
+			{Name: "MAP_ANONYMOUS", Value: 0x20},
+			{Name: "MAP_FIXED", Value: 0x10},
+			{Name: "MAP_PRIVATE", Value: 0x2},
+			{Name: "PROT_READ", Value: 0x1},
+			{Name: "PROT_WRITE", Value: 0x2},
+		},
+	}
+}
+
+func expr(val int64) *strace_types.Expression {
+	return strace_types.NewExpression(strace_types.NewIntType(val))
+}
+
+func flag(name string) *strace_types.Expression {
+	return strace_types.NewExpression(strace_types.NewFlagType(name))
+}
+
+func field(key string, val strace_types.Type) *strace_types.Field {
+	return strace_types.NewField(key, val)
+}
+
+func sockaddrIn(port int64) *strace_types.StructType {
+	return strace_types.NewStructType([]strace_types.Type{
+		field("sa_family", flag("AF_INET")),
+		field("sin_port", strace_types.NewCallType("htons", []strace_types.Type{expr(port)})),
+		field("sin_addr", expr(0)),
+	})
+}
+
+func syscall(name string, ret int64, args ...strace_types.Type) *strace_types.Syscall {
+	return strace_types.NewSyscall(1, name, args, ret, false, false)
+}
+
+// parse converts the calls of a single process traced with pid 1
+func parse(t *testing.T, calls ...*strace_types.Syscall) *Context {
+	trace := strace_types.NewTrace()
+	for i, call := range calls {
+		call.Line = i+1
+		trace.Add(call)
+	}
+	ctx, err := ParseProg(trace, testTarget(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ctx
+}
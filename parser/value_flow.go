@@ -0,0 +1,97 @@
+package parser
+
+import (
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/strace_types"
+)
+
+const (
+	minFlowValue = 256 // smaller values are too common to tell where they came from
+)
+
+/*
+Value flow links calls which pass on a value the kernel handed back to an earlier call
+through an output parameter, e.g. a port read with getsockname and later passed to bind.
+Output values are remembered per context, i.e. per pid, and the latest call writing a
+value is taken as its producer. Small values are ignored since they match too much.
+Resources, like the fds pipe writes into an array, don't rely on this as their users
+refer to the ResultArg of their producer.
+ */
+func (ctx *Context) recordOutputs(straceType strace_types.Type) {
+	for _, val := range flowValues(straceType) {
+		if isDistinctive(val) {
+			ctx.OutputValues[val] = ctx.CurrentSyzCall
+		}
+	}
+}
+
+func (ctx *Context) linkInputs(straceType strace_types.Type) {
+	for _, val := range flowValues(straceType) {
+		if !isDistinctive(val) {
+			continue
+		}
+		producer, ok := ctx.OutputValues[val]
+		if !ok || producer == ctx.CurrentSyzCall {
+			continue
+		}
+		idx := ctx.callIdx(producer)
+		if idx < 0 {
+			continue
+		}
+		dependsOn, ok := ctx.DependsOn[ctx.CurrentSyzCall]
+		if !ok {
+			dependsOn = make(map[*prog.Call]int, 0)
+			ctx.DependsOn[ctx.CurrentSyzCall] = dependsOn
+		}
+		log.Logf(3, "Value %d of %s flows from %s", val, ctx.CurrentStraceCall.CallName, producer.Meta.Name)
+		dependsOn[producer] = idx
+	}
+}
+
+func (ctx *Context) callIdx(call *prog.Call) int {
+	//Producers are usually close to their consumers
+	for i := len(ctx.Prog.Calls)-1; i >= 0; i-- {
+		if ctx.Prog.Calls[i] == call {
+			return i
+		}
+	}
+	return -1
+}
+
+/*
+flowValues collects the integer literals of a strace argument. Flags and
+other symbolic values are left out as they don't identify anything.
+ */
+func flowValues(straceType strace_types.Type) []uint64 {
+	vals := make([]uint64, 0)
+	switch a := straceType.(type) {
+	case *strace_types.Expression:
+		if a.IntType != nil {
+			vals = append(vals, uint64(a.IntType.Val))
+		}
+		for _, i := range a.IntsType {
+			vals = append(vals, uint64(i.Val))
+		}
+	case *strace_types.Field:
+		vals = append(vals, flowValues(a.Val)...)
+	case *strace_types.ArrayType:
+		for _, elem := range a.Elems {
+			vals = append(vals, flowValues(elem)...)
+		}
+	case *strace_types.StructType:
+		for _, field := range a.Fields {
+			vals = append(vals, flowValues(field)...)
+		}
+	case *strace_types.Call:
+		for _, arg := range a.Args {
+			vals = append(vals, flowValues(arg)...)
+		}
+	}
+	return vals
+}
+
+func isDistinctive(val uint64) bool {
+	v := int64(val)
+	return v >= minFlowValue || v <= -minFlowValue
+}
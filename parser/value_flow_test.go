@@ -0,0 +1,49 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/strace_types"
+)
+
+func TestPortFlowsFromGetsocknameToBind(t *testing.T) {
+	ctx := parse(t,
+		syscall("socket", 3, expr(2), expr(1), expr(0)),
+		syscall("getsockname", 0, expr(3), sockaddrIn(34567),
+			strace_types.NewArrayType([]strace_types.Type{expr(16)})),
+		syscall("socket", 4, expr(2), expr(1), expr(0)),
+		syscall("bind", 0, expr(4), sockaddrIn(34567), expr(16)),
+		syscall("bind", 0, expr(4), sockaddrIn(8888), expr(16)),
+	)
+	calls := ctx.Prog.Calls
+	if len(calls) != 5 {
+		t.Fatalf("got %d calls, want 5", len(calls))
+	}
+	getsockname, bind, otherBind := calls[1], calls[3], calls[4]
+	if idx, ok := ctx.DependsOn[bind][getsockname]; !ok || idx != 1 {
+		t.Errorf("bind of the port getsockname returned doesn't depend on it: %v", ctx.DependsOn[bind])
+	}
+	if _, ok := ctx.DependsOn[otherBind][getsockname]; ok {
+		t.Errorf("bind of another port depends on getsockname")
+	}
+	if _, ok := ctx.DependsOn[getsockname]; ok {
+		t.Errorf("getsockname depends on %v", ctx.DependsOn[getsockname])
+	}
+}
+
+func TestPipeFdsLinkThroughResources(t *testing.T) {
+	ctx := parse(t,
+		syscall("pipe", 0, strace_types.NewArrayType([]strace_types.Type{expr(3), expr(4)})),
+		syscall("read", 0, expr(4), strace_types.NewBufferType(""), expr(16)),
+	)
+	calls := ctx.Prog.Calls
+	if len(calls) != 2 {
+		t.Fatalf("got %d calls, want 2", len(calls))
+	}
+	fds := calls[0].Args[0].(*prog.PointerArg).Res.(*prog.GroupArg).Inner
+	fd := calls[1].Args[0].(*prog.ResultArg)
+	if fd.Res != fds[1] {
+		t.Errorf("read of the write end of the pipe doesn't use the fd pipe returned")
+	}
+}
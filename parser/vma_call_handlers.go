@@ -1,7 +1,7 @@
 package parser
 
 import (
-	//"fmt"
+	"fmt"
 	"github.com/google/syzkaller/prog"
 	"github.com/shankarapailoor/moonshine/strace_types"
 	"github.com/shankarapailoor/moonshine/tracker"
@@ -13,7 +13,11 @@ const (
 	RemapFixed = "MREMAP_FIXED"
 )
 
-func ParseMemoryCall(ctx *Context) *prog.Call {
+/*
+ParseMemoryCall converts the calls which create, change or use mappings, keeping track of
+the mappings. It returns nil for other calls.
+ */
+func ParseMemoryCall(ctx *Context) (*prog.Call, error) {
 	syzCall := ctx.CurrentSyzCall
 	straceCall := ctx.CurrentStraceCall
 	if straceCall.CallName == "mmap" {
@@ -36,26 +40,39 @@ func ParseMemoryCall(ctx *Context) *prog.Call {
 		return ParseShmat(syzCall.Meta, straceCall, ctx)
 	}
 
-	return nil
+	return nil, nil
 }
 
-func ParseMmap(mmap *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) *prog.Call {
+func ParseMmap(mmap *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) (*prog.Call, error) {
 	call := &prog.Call{
 		Meta: mmap,
 		Ret: strace_types.ReturnArg(mmap.Ret),
 	}
 	ctx.CurrentSyzCall = call
 
-	length := uint64(0)
-
-	length = ParseLength(syscall.Args[1], ctx)
+	length, err := ParseLength(straceArg(syscall, 1), ctx)
+	if err != nil {
+		return nil, err
+	}
 	length = (length/pageSize + 1)*pageSize
 
-	addrArg, start := ParseAddr(length, mmap.Args[0], syscall.Args[0], ctx)
+	addrArg, start, err := ParseAddr(length, mmap.Args[0], straceArg(syscall, 0), ctx)
+	if err != nil {
+		return nil, err
+	}
 	lengthArg := prog.MakeConstArg(mmap.Args[1], length)
-	protArg := ParseFlags(mmap.Args[2], syscall.Args[2], ctx, false)
-	flagArg := ParseFlags(mmap.Args[3], syscall.Args[3], ctx, true)
-	fdArg := ParseFd(mmap.Args[4], syscall.Args[4], ctx)
+	protArg, err := ParseFlags(mmap.Args[2], straceArg(syscall, 2), ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	flagArg, err := ParseFlags(mmap.Args[3], straceArg(syscall, 3), ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	fdArg, err := ParseFd(mmap.Args[4], straceArg(syscall, 4), ctx)
+	if err != nil {
+		return nil, err
+	}
 
 	call.Args = []prog.Arg {
 		addrArg,
@@ -66,10 +83,10 @@ func ParseMmap(mmap *prog.Syscall, syscall *strace_types.Syscall, ctx *Context)
 		prog.MakeConstArg(mmap.Args[5], 0),
 	}
 	ctx.State.Tracker.CreateMapping(call, len(ctx.Prog.Calls), call.Args[0], start, start+length) //All mmaps have fixed mappings in syzkaller
-	return call
+	return call, nil
 }
 
-func ParseMremap(mremap *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) *prog.Call {
+func ParseMremap(mremap *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) (*prog.Call, error) {
 	call := &prog.Call{
 		Meta: mremap,
 		Ret: strace_types.ReturnArg(mremap.Ret),
@@ -77,19 +94,34 @@ func ParseMremap(mremap *prog.Syscall, syscall *strace_types.Syscall, ctx *Conte
 	ctx.CurrentSyzCall = call
 
 
-	oldAddrArg, start := ParseAddr(pageSize, mremap.Args[0], syscall.Args[0], ctx)
-	oldSz := ParseLength(syscall.Args[1], ctx)
-	newSz := ParseLength(syscall.Args[2], ctx)
+	oldAddrArg, start, err := ParseAddr(pageSize, mremap.Args[0], straceArg(syscall, 0), ctx)
+	if err != nil {
+		return nil, err
+	}
+	oldSz, err := ParseLength(straceArg(syscall, 1), ctx)
+	if err != nil {
+		return nil, err
+	}
+	newSz, err := ParseLength(straceArg(syscall, 2), ctx)
+	if err != nil {
+		return nil, err
+	}
 	oldSzArg := prog.MakeConstArg(mremap.Args[1], oldSz)
 	newSzArg := prog.MakeConstArg(mremap.Args[2], newSz)
-	flagArg := ParseFlags(mremap.Args[3], syscall.Args[3], ctx, true)
+	flagArg, err := ParseFlags(mremap.Args[3], straceArg(syscall, 3), ctx, true)
+	if err != nil {
+		return nil, err
+	}
 	var destAddrArg prog.Arg
 	var destAddr uint64
 	if len(syscall.Args) > 4 {
-		destAddrArg, destAddr = ParseAddr(pageSize, mremap.Args[4], syscall.Args[4], ctx)
+		destAddrArg, destAddr, err = ParseAddr(pageSize, mremap.Args[4], syscall.Args[4], ctx)
 	} else {
 		straceAddrArg := strace_types.NewExpression(strace_types.NewIntType(syscall.Ret))
-		destAddrArg, destAddr = ParseAddr(pageSize, mremap.Args[4], straceAddrArg, ctx)
+		destAddrArg, destAddr, err = ParseAddr(pageSize, mremap.Args[4], straceAddrArg, ctx)
+	}
+	if err != nil {
+		return nil, err
 	}
 	AddDependency(start, oldSz, oldAddrArg, ctx)
 	call.Args = []prog.Arg {
@@ -100,86 +132,116 @@ func ParseMremap(mremap *prog.Syscall, syscall *strace_types.Syscall, ctx *Conte
 		destAddrArg,
 	}
 	ctx.State.Tracker.CreateMapping(call, len(ctx.Prog.Calls), call.Args[4], destAddr, destAddr+newSz) //All mmaps have fixed mappings in syzkaller
-	return call
+	return call, nil
 }
 
 
 
-func ParseMsync(msync *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) *prog.Call {
+func ParseMsync(msync *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) (*prog.Call, error) {
 	call := &prog.Call{
 		Meta: msync,
 		Ret: strace_types.ReturnArg(msync.Ret),
 	}
 	ctx.CurrentSyzCall = call
 
-	addrArg, address := ParseAddr(pageSize, msync.Args[0], syscall.Args[0], ctx)
-	length := uint64(0)
-	length = ParseLength(syscall.Args[1], ctx)
+	addrArg, address, err := ParseAddr(pageSize, msync.Args[0], straceArg(syscall, 0), ctx)
+	if err != nil {
+		return nil, err
+	}
+	length, err := ParseLength(straceArg(syscall, 1), ctx)
+	if err != nil {
+		return nil, err
+	}
 	lengthArg := prog.MakeConstArg(msync.Args[1], length)
-	protArg := ParseFlags(msync.Args[2], syscall.Args[2], ctx, false)
+	protArg, err := ParseFlags(msync.Args[2], straceArg(syscall, 2), ctx, false)
+	if err != nil {
+		return nil, err
+	}
 	AddDependency(address, length, addrArg, ctx)
 	call.Args = []prog.Arg {
 		addrArg,
 		lengthArg,
 		protArg,
 	}
-	return call
+	return call, nil
 }
 
-func ParseMprotect(mprotect *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) *prog.Call {
+func ParseMprotect(mprotect *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) (*prog.Call, error) {
 	call := &prog.Call {
 		Meta: mprotect,
 		Ret: strace_types.ReturnArg(mprotect.Ret),
 	}
 	ctx.CurrentSyzCall = call
 
-	addrArg, address := ParseAddr(pageSize, mprotect.Args[0], syscall.Args[0], ctx)
-	length := ParseLength(syscall.Args[1], ctx)
+	addrArg, address, err := ParseAddr(pageSize, mprotect.Args[0], straceArg(syscall, 0), ctx)
+	if err != nil {
+		return nil, err
+	}
+	length, err := ParseLength(straceArg(syscall, 1), ctx)
+	if err != nil {
+		return nil, err
+	}
 	lengthArg := prog.MakeConstArg(mprotect.Args[1], length)
-	protArg := ParseFlags(mprotect.Args[2], syscall.Args[2], ctx, false)
+	protArg, err := ParseFlags(mprotect.Args[2], straceArg(syscall, 2), ctx, false)
+	if err != nil {
+		return nil, err
+	}
 	AddDependency(address, length, addrArg, ctx)
 	call.Args = []prog.Arg {
 		addrArg,
 		lengthArg,
 		protArg,
 	}
-	return call
+	return call, nil
 }
 
-func ParseMunmap(munmap *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) *prog.Call {
+func ParseMunmap(munmap *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) (*prog.Call, error) {
 	call := &prog.Call {
 		Meta: munmap,
 		Ret: strace_types.ReturnArg(munmap.Ret),
 	}
 	ctx.CurrentSyzCall = call
 
-	addrArg, address := ParseAddr(pageSize, munmap.Args[0], syscall.Args[0], ctx)
-	length := ParseLength(syscall.Args[1], ctx)
+	addrArg, address, err := ParseAddr(pageSize, munmap.Args[0], straceArg(syscall, 0), ctx)
+	if err != nil {
+		return nil, err
+	}
+	length, err := ParseLength(straceArg(syscall, 1), ctx)
+	if err != nil {
+		return nil, err
+	}
 	lengthArg := prog.MakeConstArg(munmap.Args[1], length)
 	AddDependency(address, length, addrArg, ctx)
+	ctx.State.Tracker.Unmap(address, address+length)
 	call.Args = []prog.Arg{
 		addrArg,
 		lengthArg,
 	}
-	return call
+	return call, nil
 }
 
-func ParseMadvise(madvise *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) *prog.Call {
+func ParseMadvise(madvise *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) (*prog.Call, error) {
 	call := &prog.Call {
 		Meta: madvise,
 		Ret: strace_types.ReturnArg(madvise.Ret),
 	}
 	ctx.CurrentSyzCall = call
 
-	addrArg, address := ParseAddr(pageSize, madvise.Args[0], syscall.Args[0], ctx)
-	length := ParseLength(syscall.Args[1], ctx)
+	addrArg, address, err := ParseAddr(pageSize, madvise.Args[0], straceArg(syscall, 0), ctx)
+	if err != nil {
+		return nil, err
+	}
+	length, err := ParseLength(straceArg(syscall, 1), ctx)
+	if err != nil {
+		return nil, err
+	}
 	lengthArg := prog.MakeConstArg(madvise.Args[1], length)
 	var adviceArg prog.Arg
-	switch a := syscall.Args[2].(type) {
+	switch a := straceArg(syscall, 2).(type) {
 	case *strace_types.Expression:
 		adviceArg = strace_types.ConstArg(madvise.Args[2], a.Eval(ctx.Target))
 	default:
-		panic("Madvise advice arg is not expression")
+		return nil, fmt.Errorf("expected the advice to be an expression, got %s", describe(a))
 	}
 	AddDependency(address, length, addrArg, ctx)
 	call.Args = []prog.Arg {
@@ -187,45 +249,57 @@ func ParseMadvise(madvise *prog.Syscall, syscall *strace_types.Syscall, ctx *Con
 		lengthArg,
 		adviceArg,
 	}
-	return call
+	return call, nil
 }
 
-func ParseMlock(mlock *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) *prog.Call {
+func ParseMlock(mlock *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) (*prog.Call, error) {
 	call := &prog.Call {
 		Meta: mlock,
 		Ret : strace_types.ReturnArg(mlock.Ret),
 	}
 	ctx.CurrentSyzCall = call
 
-	addrArg, address := ParseAddr(pageSize, mlock.Args[0], syscall.Args[0], ctx)
-	length := ParseLength(syscall.Args[1], ctx)
+	addrArg, address, err := ParseAddr(pageSize, mlock.Args[0], straceArg(syscall, 0), ctx)
+	if err != nil {
+		return nil, err
+	}
+	length, err := ParseLength(straceArg(syscall, 1), ctx)
+	if err != nil {
+		return nil, err
+	}
 	flagArg := strace_types.ConstArg(mlock.Args[1], length)
 	AddDependency(address, length, addrArg, ctx)
 	call.Args = []prog.Arg {
 		addrArg,
 		flagArg,
 	}
-	return call
+	return call, nil
 }
 
-func ParseMunlock(munlock *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) *prog.Call {
+func ParseMunlock(munlock *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) (*prog.Call, error) {
 	call := &prog.Call {
 		Meta: munlock,
 		Ret : strace_types.ReturnArg(munlock.Ret),
 	}
 	ctx.CurrentSyzCall = call
-	addrArg, address := ParseAddr(pageSize, munlock.Args[0], syscall.Args[0], ctx)
-	length := ParseLength(syscall.Args[1], ctx)
+	addrArg, address, err := ParseAddr(pageSize, munlock.Args[0], straceArg(syscall, 0), ctx)
+	if err != nil {
+		return nil, err
+	}
+	length, err := ParseLength(straceArg(syscall, 1), ctx)
+	if err != nil {
+		return nil, err
+	}
 	flagArg := strace_types.ConstArg(munlock.Args[1], length)
 	AddDependency(address, length, addrArg, ctx)
 	call.Args = []prog.Arg {
 		addrArg,
 		flagArg,
 	}
-	return call
+	return call, nil
 }
 
-func ParseShmat(shmat *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) *prog.Call {
+func ParseShmat(shmat *prog.Syscall, syscall *strace_types.Syscall, ctx *Context) (*prog.Call, error) {
 	/*
  	* Shmat will create a shared memory map which we should track.
  	* If the second argument is NULL then shmat will create the memory map and
@@ -241,6 +315,9 @@ func ParseShmat(shmat *prog.Syscall, syscall *strace_types.Syscall, ctx *Context
 	}
 	ctx.CurrentSyzCall = call
 
+	if len(syscall.Args) < 3 {
+		return nil, fmt.Errorf("expected 3 arguments, got %d", len(syscall.Args))
+	}
 	if arg := ctx.Cache.Get(shmat.Args[0], syscall.Args[0]); arg != nil {
 		fd = strace_types.ResultArg(shmat.Args[0], arg.(*prog.ResultArg), arg.Type().Default())
 	} else {
@@ -253,8 +330,14 @@ func ParseShmat(shmat *prog.Syscall, syscall *strace_types.Syscall, ctx *Context
 		fd = strace_types.ResultArg(shmat.Args[0], nil, shmid)
 	}
 
-	addrArg, address := ParseAddr(pageSize, shmat.Args[1], syscall.Args[1], ctx)
-	flags := ParseFlags(shmat.Args[2], syscall.Args[2], ctx, false)
+	addrArg, address, err := ParseAddr(pageSize, shmat.Args[1], syscall.Args[1], ctx)
+	if err != nil {
+		return nil, err
+	}
+	flags, err := ParseFlags(shmat.Args[2], syscall.Args[2], ctx, false)
+	if err != nil {
+		return nil, err
+	}
 
 	call.Args = []prog.Arg{
 		fd,
@@ -271,11 +354,11 @@ func ParseShmat(shmat *prog.Syscall, syscall *strace_types.Syscall, ctx *Context
 		length = req.GetSize()
 	}
 	ctx.State.Tracker.CreateMapping(call, len(ctx.Prog.Calls), call.Args[1], address, address + length)
-	return call
+	return call, nil
 }
 
 
-func ParseAddr(length uint64, syzType prog.Type, straceType strace_types.Type,  ctx *Context) (prog.Arg, uint64){
+func ParseAddr(length uint64, syzType prog.Type, straceType strace_types.Type,  ctx *Context) (prog.Arg, uint64, error){
 	defAddrStart := (ctx.Target.NumPages-2)*ctx.Target.PageSize
 	switch a := straceType.(type) {
 	case *strace_types.PointerType:
@@ -283,66 +366,100 @@ func ParseAddr(length uint64, syzType prog.Type, straceType strace_types.Type,
 		if a.IsNull() {
 			//Anonymous MMAP
 			addrStart = uint64(ctx.CurrentStraceCall.Ret)
-			return prog.MakeVmaPointerArg(syzType, defAddrStart, length), addrStart
+			return prog.MakeVmaPointerArg(syzType, defAddrStart, length), addrStart, nil
 		} else {
-			return prog.MakeVmaPointerArg(syzType, defAddrStart, length), a.Address
+			return prog.MakeVmaPointerArg(syzType, defAddrStart, length), a.Address, nil
 		}
 	case *strace_types.Expression:
 		addrStart := a.Eval(ctx.Target)
-		return prog.MakeVmaPointerArg(syzType, defAddrStart, length), addrStart
+		return prog.MakeVmaPointerArg(syzType, defAddrStart, length), addrStart, nil
 	default:
-		panic("Failed to parse mmap")
+		return nil, 0, fmt.Errorf("expected the address to be a pointer or expression, got %s", describe(a))
 	}
 }
 
 func AddDependency(start, length uint64, addr prog.Arg, ctx *Context) {
 	if mapping := ctx.State.Tracker.FindLatestOverlappingVMA(start); mapping != nil {
-		dependsOn := make(map[*prog.Call]int, 0)
-		dependsOn[mapping.GetCall()] = mapping.GetCallIdx()
-		for _, dep := range mapping.GetUsedBy() {
+		addMappingDependency(mapping, start, length, addr, ctx)
+	}
+
+}
+
+/*
+addMappingDependency makes the current call depend on the call which created the mapping
+addr points into. If the call reads the memory it also depends on the latest earlier
+call which wrote to the same range, the one data dependency the argument directions prove.
+ */
+func addMappingDependency(mapping *tracker.VirtualMapping, start, length uint64, addr prog.Arg, ctx *Context) {
+	dependsOn, ok := ctx.DependsOn[ctx.CurrentSyzCall]
+	if !ok {
+		//A call may point into several mappings
+		dependsOn = make(map[*prog.Call]int, 0)
+	}
+	dependsOn[mapping.GetCall()] = mapping.GetCallIdx()
+	if tracker.ReadsMemory(addr) {
+		if dep := mapping.LatestWrite(start, start+length); dep != nil && dep.Callidx < len(ctx.Prog.Calls) {
 			dependsOn[ctx.Prog.Calls[dep.Callidx]] = dep.Callidx
 		}
-		ctx.DependsOn[ctx.CurrentSyzCall] = dependsOn
-		dep := tracker.NewMemDependency(len(ctx.Prog.Calls), addr, start, start+length)
-		mapping.AddDependency(dep)
 	}
-
+	ctx.DependsOn[ctx.CurrentSyzCall] = dependsOn
+	dep := tracker.NewMemDependency(len(ctx.Prog.Calls), addr, start, start+length)
+	mapping.AddDependency(dep)
 }
 
-func ParseLength(straceType strace_types.Type, ctx *Context) uint64 {
+func ParseLength(straceType strace_types.Type, ctx *Context) (uint64, error) {
 	switch a := straceType.(type) {
 	case *strace_types.Expression:
-		return a.Eval(ctx.Target)
+		return a.Eval(ctx.Target), nil
 	default:
-		panic("Parsing Mmap length but type is not expression")
+		return 0, fmt.Errorf("expected the length to be an expression, got %s", describe(a))
 	}
 }
 
-func ParseFlags(syzType prog.Type, straceType strace_types.Type, ctx *Context, mapFlag bool) prog.Arg {
+func ParseFlags(syzType prog.Type, straceType strace_types.Type, ctx *Context, mapFlag bool) (prog.Arg, error) {
 	switch a := straceType.(type) {
 	case *strace_types.Expression:
 		if mapFlag {
 			val := a.Eval(ctx.Target) | GetFixedFlag(ctx)
-			return prog.MakeConstArg(syzType, val)
+			return prog.MakeConstArg(syzType, val), nil
 		} else {
-			return prog.MakeConstArg(syzType, a.Eval(ctx.Target))
+			return prog.MakeConstArg(syzType, a.Eval(ctx.Target)), nil
 		}
 	default:
-		panic("Parsing Flags")
+		return nil, fmt.Errorf("expected the flags to be an expression, got %s", describe(a))
 	}
 }
 
 
-func ParseFd(syzType prog.Type, straceType strace_types.Type, ctx *Context) prog.Arg {
+func ParseFd(syzType prog.Type, straceType strace_types.Type, ctx *Context) (prog.Arg, error) {
+	if straceType == nil {
+		return nil, fmt.Errorf("expected an fd, got %s", describe(straceType))
+	}
 	if arg := ctx.Cache.Get(syzType, straceType); arg != nil {
-		return prog.MakeResultArg(arg.Type(), arg.(*prog.ResultArg), arg.Type().Default())
+		return prog.MakeResultArg(arg.Type(), arg.(*prog.ResultArg), arg.Type().Default()), nil
 	}
 	switch a := straceType.(type) {
 	case *strace_types.Expression:
-		return prog.MakeResultArg(syzType, nil, a.Eval(ctx.Target))
+		return prog.MakeResultArg(syzType, nil, a.Eval(ctx.Target)), nil
 	default:
-		panic("Failed to Parse Fd because type is not Expression")
+		return nil, fmt.Errorf("expected the fd to be an expression, got %s", describe(a))
+	}
+}
+
+// straceArg returns argument i of the traced call, nil if strace printed fewer
+func straceArg(syscall *strace_types.Syscall, i int) strace_types.Type {
+	if i < len(syscall.Args) {
+		return syscall.Args[i]
+	}
+	return nil
+}
+
+// describe names the kind of a traced argument for errors
+func describe(straceType strace_types.Type) string {
+	if straceType == nil {
+		return "nothing"
 	}
+	return straceType.Name()
 }
 
 func GetFixedFlag(ctx *Context) uint64 {
@@ -4,49 +4,97 @@ import (
 	"fmt"
 	"io/ioutil"
 	"bufio"
+	"bytes"
+	"io"
 	"strings"
 	"strconv"
+	"github.com/google/syzkaller/pkg/log"
 	"github.com/shankarapailoor/moonshine/strace_types"
-	. "github.com/shankarapailoor/moonshine/logging"
 )
 
 const(
-	maxBufferSize = 64*1024*1024
+	maxBufferSize = 64*1024*1024 /* longest line, e.g. a call with a huge coverage line */
+	initBufferSize = 64*1024 /* grown up to maxBufferSize as lines need it */
 	CoverDelim = ","
 	CoverID = "Cover:"
 	SYSRESTART = "ERESTART"
 	SignalPlus = "+++"
 	SignalMinus = "---"
+	maxErrorText = 80 /* of the line quoted in a SyntaxError */
 )
 
-func parseIps(line string) []uint64 {
-	line = line[1: len(line)-1] //Remove quotes
-	ips := strings.Split(strings.Split(line, CoverID)[1], CoverDelim)
+/*
+A SyntaxError is a line of a trace the scanner couldn't make sense of. Line counts from 1.
+ */
+type SyntaxError struct {
+	Line int
+	Text string
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Detail())
+}
+
+// Detail is the error without its line, quoting the start of the line
+func (e *SyntaxError) Detail() string {
+	text := e.Text
+	if len(text) > maxErrorText {
+		text = text[:maxErrorText] + "..."
+	}
+	if text == "" {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s: %s", e.Msg, text)
+}
+
+/*
+parseIps returns the PCs of a cover line in the order they were hit, along with each
+distinct PC once.
+ */
+func parseIps(line string) ([]uint64, []uint64, error) {
+	line = strings.Trim(line, "\"") //Remove quotes
+	ips := strings.Split(strings.SplitN(line, CoverID, 2)[1], CoverDelim)
 	cover_set := make(map[uint64]bool, 0)
 	cover := make([]uint64, 0)
+	trace := make([]uint64, 0, len(ips))
 	for _, ins := range ips {
 		if strings.TrimSpace(ins) == "" {
 			continue
 		} else {
 			ip, err := strconv.ParseUint(strings.TrimSpace(ins), 0, 64)
 			if err != nil {
-				panic(fmt.Sprintf("failed parsing ip: %s", ins))
+				return nil, nil, fmt.Errorf("failed parsing ip: %s", ins)
 			}
+			trace = append(trace, ip)
 			if _, ok := cover_set[ip]; !ok {
 				cover_set[ip] = true
 				cover = append(cover, ip)
 			}
 		}
 	}
-	return cover
+	return trace, cover, nil
 }
 
-func parseLoop(scanner *bufio.Scanner) (tree *strace_types.TraceTree) {
+/*
+parseLoop builds the process tree of a trace. Panics of the lexer and grammar, e.g. on a
+truncated trace, are returned as a SyntaxError of the line being scanned.
+ */
+func parseLoop(scanner *bufio.Scanner) (tree *strace_types.TraceTree, err error) {
 	tree = strace_types.NewTraceTree()
 	//Creating the process tree
 	var lastCall *strace_types.Syscall
+	lineNum := 0
+	line := ""
+	defer func() {
+		if r := recover(); r != nil {
+			tree = nil
+			err = &SyntaxError{Line: lineNum, Text: line, Msg: fmt.Sprint(r)}
+		}
+	}()
 	for scanner.Scan() {
-		line := scanner.Text()
+		lineNum += 1
+		line = scanner.Text()
 		restart := strings.Contains(line, SYSRESTART)
 		signalPlus := strings.Contains(line, SignalPlus)
 		signalMinus := strings.Contains(line, SignalMinus)
@@ -54,45 +102,68 @@ func parseLoop(scanner *bufio.Scanner) (tree *strace_types.TraceTree) {
 		if shouldSkip {
 			continue
 		} else if strings.Contains(line, CoverID) {
-			cover := parseIps(line)
+			if lastCall == nil {
+				return nil, &SyntaxError{Line: lineNum, Text: line, Msg: "coverage before any call"}
+			}
+			trace, cover, err := parseIps(line)
+			if err != nil {
+				return nil, &SyntaxError{Line: lineNum, Text: line, Msg: err.Error()}
+			}
 			//fmt.Printf("Cover: %d\n", len(cover))
 			lastCall.Cover = cover
+			lastCall.Trace = trace
 			continue
 
 		} else {
 			lex := newLexer(scanner.Bytes())
 			if ret := StraceParse(lex); ret != 0 {
-				fmt.Printf("Error parsing line: %s\n", line)
+				log.Logf(1, "Error parsing line %d: %s", lineNum, line)
 			}
 			call := lex.result
 			if call == nil {
-				Failf("Failed to parse line: %s\n", line)
+				return nil, &SyntaxError{Line: lineNum, Text: line, Msg: "failed to parse line"}
 			}
+			call.Line = lineNum
 			lastCall = tree.Add(call)
 			//trace.Calls = append(trace.Calls, call)
 			//fmt.Printf("result: %v\n", lex.result.CallName)
 		}
 	}
+	if err := scanner.Err(); err != nil {
+		return nil, &SyntaxError{Line: lineNum + 1, Msg: err.Error()}
+	}
 	if len(tree.Ptree) == 0 {
-		return nil
+		return nil, nil
 	}
 	return
 }
 
-func Parse(filename string) *strace_types.TraceTree {
-	var data []byte
-	var err error
-
-	if data, err = ioutil.ReadFile(filename); err != nil {
-		Failf("error reading file: %s\n", err.Error())
+/*
+Parse builds the process tree of the trace in filename. Errors are a *SyntaxError if the
+trace could be read but not scanned.
+ */
+func Parse(filename string) (*strace_types.TraceTree, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := Scan(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
 	}
-	buf := make([]byte, maxBufferSize)
-	scanner := bufio.NewScanner(strings.NewReader(string(data)))
-	scanner.Buffer(buf, maxBufferSize)
-
-	tree := parseLoop(scanner)
 	if tree != nil {
 		tree.Filename = filename
 	}
-	return tree
+	return tree, nil
+}
+
+/*
+Scan builds the process tree of the trace read from r, or returns a *SyntaxError. The
+tree is nil if the trace has no calls.
+ */
+func Scan(r io.Reader) (*strace_types.TraceTree, error) {
+	buf := make([]byte, 0, initBufferSize)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(buf, maxBufferSize)
+	return parseLoop(scanner)
 }
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
+	"github.com/shankarapailoor/moonshine/distiller"
+	. "github.com/shankarapailoor/moonshine/logging"
+	. "github.com/shankarapailoor/moonshine/parser"
+	"github.com/shankarapailoor/moonshine/splitter"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxRequestSize = 64 << 20
+
+/*
+The server converts and distills traces sent to it over HTTP, so tools can turn e.g. the
+strace of a bug report into a reproducer without going through files. Requests and
+responses are JSON:
+	POST /convert  {"trace": "..."} -> the programs of every process of the trace
+	POST /distill  {"traces": {"name": "..."}, "strategy": "...", "settings": {...}}
+	               -> the distilled programs
+	GET  /stats    -> what the server has done so far
+Distill requests only pick the strategy and its numeric and boolean settings, everything
+else, in particular the files distillation reads and writes, comes from -distill. The
+parser and distillers keep global state, so requests are handled one at a time.
+ */
+type server struct {
+	target *prog.Target
+	distillConf *config.DistillConfig /* what distill requests run with, nil for the defaults */
+	mu sync.Mutex
+	stats ServerStats
+	started time.Time
+}
+
+type ServerStats struct {
+	Requests map[string]int `json:"requests"`
+	Failures int `json:"failures"`
+	Traces int `json:"traces"`
+	Programs int `json:"programs"`
+	Uptime string `json:"uptime"`
+}
+
+type ConvertRequest struct {
+	Trace string `json:"trace"`
+}
+
+type ConvertResponse struct {
+	Programs []string `json:"programs"`
+	Processes []*ProcessResult `json:"processes"`
+	Diagnostics []string `json:"diagnostics"`
+	Error string `json:"error,omitempty"`
+}
+
+type ProcessResult struct {
+	Pid int64 `json:"pid"`
+	Calls int `json:"calls"`
+	CoveredCalls int `json:"covered_calls"` /* calls with coverage, which distillation needs */
+	Programs int `json:"programs"`
+}
+
+type DistillRequest struct {
+	Traces map[string]string `json:"traces"`
+	Strategy string `json:"strategy"` /* the -distill config's by default */
+	Settings map[string]json.RawMessage `json:"settings"` /* of the strategy, on top of the -distill config's */
+}
+
+type DistillResponse struct {
+	Programs []string `json:"programs"`
+	Seeds int `json:"seeds"`
+	Diagnostics []string `json:"diagnostics"`
+	Error string `json:"error,omitempty"`
+}
+
+func Serve(target *prog.Target, addr string) {
+	s := &server{
+		target: target,
+		distillConf: loadDistillConfig(),
+		stats: ServerStats{Requests: make(map[string]int)},
+		started: time.Now(),
+	}
+	log.Logf(0, "Serving on http://%s", addr)
+	if err := http.ListenAndServe(addr, s.handler()); err != nil {
+		Failf("failed to serve: %v", err)
+	}
+}
+
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/convert", s.post(s.convert))
+	mux.HandleFunc("/distill", s.post(s.distill))
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.stats.Requests["stats"] += 1
+		stats := s.stats
+		stats.Uptime = time.Since(s.started).Round(time.Second).String()
+		data, err := json.Marshal(stats)
+		s.mu.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+	return mux
+}
+
+/*
+post wraps a handler taking the request body and returning the response along with its
+status. Handlers run under the server lock, and a panic in them fails the request only.
+ */
+func (s *server) post(handle func(body *json.Decoder) (interface{}, int)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+			return
+		}
+		s.mu.Lock()
+		s.stats.Requests[r.URL.Path[1:]] += 1
+		resp, status := handle(json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)))
+		if status != http.StatusOK {
+			s.stats.Failures += 1
+		}
+		s.mu.Unlock()
+		data, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write(data)
+	}
+}
+
+func (s *server) convert(body *json.Decoder) (interface{}, int) {
+	req := new(ConvertRequest)
+	resp := &ConvertResponse{
+		Programs: make([]string, 0),
+		Processes: make([]*ProcessResult, 0),
+		Diagnostics: make([]string, 0),
+	}
+	if err := body.Decode(req); err != nil {
+		resp.Error = fmt.Sprintf("bad request: %v", err)
+		return resp, http.StatusBadRequest
+	}
+	ctxs, err := s.parse("", req.Trace)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp, http.StatusUnprocessableEntity
+	}
+	s.stats.Traces += 1
+	if len(ctxs) == 0 {
+		resp.Diagnostics = append(resp.Diagnostics, "the trace has no calls")
+	}
+	err = protect(func() {
+		for _, ctx := range ctxs {
+			proc := &ProcessResult{
+				Pid: ctx.Pid,
+				Calls: len(ctx.Prog.Calls),
+			}
+			for _, call := range ctx.Prog.Calls {
+				if len(ctx.CallToCover[call]) > 0 {
+					proc.CoveredCalls += 1
+				}
+			}
+			for _, p := range splitter.Split(ctx.Prog, ctx.State.Tracker) {
+				if progIsTooLarge(p) {
+					resp.Diagnostics = append(resp.Diagnostics,
+						fmt.Sprintf("pid %d: dropped a program too large for syzkaller", ctx.Pid))
+					continue
+				}
+				resp.Programs = append(resp.Programs, string(p.Serialize()))
+				proc.Programs += 1
+			}
+			resp.Processes = append(resp.Processes, proc)
+		}
+	})
+	if err != nil {
+		resp.Error = err.Error()
+		return resp, http.StatusUnprocessableEntity
+	}
+	s.stats.Programs += len(resp.Programs)
+	return resp, http.StatusOK
+}
+
+func (s *server) distill(body *json.Decoder) (interface{}, int) {
+	req := new(DistillRequest)
+	resp := &DistillResponse{
+		Programs: make([]string, 0),
+		Diagnostics: make([]string, 0),
+	}
+	if err := body.Decode(req); err != nil {
+		resp.Error = fmt.Sprintf("bad request: %v", err)
+		return resp, http.StatusBadRequest
+	}
+	conf, err := s.requestConfig(req)
+	if err != nil {
+		resp.Error = fmt.Sprintf("bad request: %v", err)
+		return resp, http.StatusBadRequest
+	}
+	names := make([]string, 0, len(req.Traces))
+	for name := range req.Traces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ctxs := make([]*Context, 0)
+	for _, name := range names {
+		parsed, err := s.parse(name, req.Traces[name])
+		if err != nil {
+			resp.Diagnostics = append(resp.Diagnostics, fmt.Sprintf("skipped %v", err))
+			continue
+		}
+		s.stats.Traces += 1
+		ctxs = append(ctxs, parsed...)
+	}
+	err = protect(func() {
+		seeds := make(distiller.Seeds, 0)
+		for _, ctx := range ctxs {
+			seeds = append(seeds, generateSeeds(ctx, conf)...)
+		}
+		resp.Seeds = len(seeds)
+		_, progs := distillSeeds(ctxs, seeds, conf, s.target)
+		for _, p := range progs {
+			resp.Programs = append(resp.Programs, string(p.Serialize()))
+		}
+	})
+	if err != nil {
+		resp.Error = err.Error()
+		return resp, http.StatusUnprocessableEntity
+	}
+	s.stats.Programs += len(resp.Programs)
+	return resp, http.StatusOK
+}
+
+/*
+requestConfig is the -distill config with the strategy and settings of req. Settings can
+only be numbers and booleans so that a request can't point distillation at any file.
+ */
+func (s *server) requestConfig(req *DistillRequest) (*config.DistillConfig, error) {
+	conf := new(config.DistillConfig)
+	if s.distillConf != nil {
+		*conf = *s.distillConf
+	}
+	if req.Strategy != "" {
+		conf.Type = req.Strategy
+	}
+	if conf.Type == "" {
+		conf.Type = distiller.DefaultStrategy
+	}
+	known := false
+	for _, name := range distiller.Strategies() {
+		known = known || name == conf.Type
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown strategy %q, registered strategies are: %s",
+			conf.Type, strings.Join(distiller.Strategies(), ", "))
+	}
+	if len(req.Settings) == 0 {
+		return conf, nil
+	}
+	settings := make(map[string]json.RawMessage)
+	if raw, ok := conf.Strategies[conf.Type]; ok {
+		if err := json.Unmarshal(raw, &settings); err != nil {
+			return nil, fmt.Errorf("bad -distill settings of %s: %v", conf.Type, err)
+		}
+	}
+	for key, raw := range req.Settings {
+		var val interface{}
+		if err := json.Unmarshal(raw, &val); err != nil {
+			return nil, fmt.Errorf("setting %s: %v", key, err)
+		}
+		switch val.(type) {
+		case float64, bool:
+			settings[key] = raw
+		default:
+			return nil, fmt.Errorf("setting %s: only numbers and booleans can be set", key)
+		}
+	}
+	raw, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	strategies := make(map[string]json.RawMessage, len(conf.Strategies)+1)
+	for name, section := range conf.Strategies {
+		strategies[name] = section
+	}
+	strategies[conf.Type] = raw
+	conf.Strategies = strategies
+	return conf, nil
+}
+
+// parse parses the programs of all processes of a trace
+func (s *server) parse(name string, trace string) ([]*Context, error) {
+	results, err := Convert(strings.NewReader(trace), s.target, ConvertOptions{Filename: name})
+	if err != nil {
+		return nil, err
+	}
+	ctxs := make([]*Context, 0, len(results))
+	for _, res := range results {
+		ctxs = append(ctxs, res.Context)
+	}
+	return ctxs, nil
+}
+
+// protect turns a panic of fn, which is how the parser and distillers fail, into an error
+func protect(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	fn()
+	return nil
+}
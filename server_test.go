@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTrace = `1 open("/dev/null", O_RDONLY) = 3
+Cover: 0xffffffff81000000,0xffffffff81000010
+1 read(3, "", 16) = 0
+Cover: 0xffffffff81000020
+1 close(3) = 0
+Cover: 0xffffffff81000030
+`
+
+func newTestServer(target *prog.Target, conf *config.DistillConfig) (*server, *httptest.Server) {
+	s := &server{
+		target: target,
+		distillConf: conf,
+		stats: ServerStats{Requests: make(map[string]int)},
+		started: time.Now(),
+	}
+	return s, httptest.NewServer(s.handler())
+}
+
+// testTarget returns the target traces are converted for, skipping tests which need it if it isn't built in
+func testTarget(t *testing.T) *prog.Target {
+	target, err := prog.GetTarget(OS, Arch)
+	if err != nil {
+		t.Skipf("no %s/%s target: %v", OS, Arch, err)
+	}
+	return target
+}
+
+// post sends req to path and decodes the response into resp, returning its status
+func post(t *testing.T, ts *httptest.Server, path string, req interface{}, resp interface{}) int {
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(resp); err != nil {
+		t.Fatalf("bad response of %s: %v", path, err)
+	}
+	return r.StatusCode
+}
+
+func TestServerConvert(t *testing.T) {
+	_, ts := newTestServer(testTarget(t), nil)
+	defer ts.Close()
+	resp := new(ConvertResponse)
+	if status := post(t, ts, "/convert", &ConvertRequest{Trace: testTrace}, resp); status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, resp.Error)
+	}
+	if len(resp.Programs) == 0 || len(resp.Processes) != 1 {
+		t.Fatalf("got %d programs of %d processes, want programs of 1", len(resp.Programs), len(resp.Processes))
+	}
+	if proc := resp.Processes[0]; proc.Pid != 1 || proc.Calls != 3 || proc.CoveredCalls != 3 {
+		t.Errorf("got process %+v", proc)
+	}
+}
+
+func TestServerConvertMalformed(t *testing.T) {
+	_, ts := newTestServer(nil, nil)
+	defer ts.Close()
+	resp := new(ConvertResponse)
+	status := post(t, ts, "/convert", &ConvertRequest{Trace: "Cover: 0xffffffff81000000\n"}, resp)
+	if status != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d, want %d", status, http.StatusUnprocessableEntity)
+	}
+	if !strings.Contains(resp.Error, "coverage before any call") || !strings.HasPrefix(resp.Error, "1:") {
+		t.Errorf("error %q doesn't locate the bad line", resp.Error)
+	}
+	if len(resp.Programs) != 0 {
+		t.Errorf("got programs of a malformed trace")
+	}
+	r, err := http.Post(ts.URL+"/convert", "application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusBadRequest {
+		t.Errorf("got status %d for bad json, want %d", r.StatusCode, http.StatusBadRequest)
+	}
+	r, err = http.Get(ts.URL + "/convert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("got status %d for GET, want %d", r.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestServerDistill(t *testing.T) {
+	_, ts := newTestServer(testTarget(t), &config.DistillConfig{Type: "explicit"})
+	defer ts.Close()
+	resp := new(DistillResponse)
+	req := &DistillRequest{
+		Traces: map[string]string{"test": testTrace},
+		Strategy: "budget",
+		Settings: map[string]json.RawMessage{"max_programs": json.RawMessage("1")},
+	}
+	if status := post(t, ts, "/distill", req, resp); status != http.StatusOK {
+		t.Fatalf("status %d: %s", status, resp.Error)
+	}
+	if resp.Seeds != 3 || len(resp.Programs) != 1 {
+		t.Errorf("got %d programs from %d seeds", len(resp.Programs), resp.Seeds)
+	}
+}
+
+func TestServerDistillConfig(t *testing.T) {
+	s, ts := newTestServer(nil, &config.DistillConfig{
+		Type: "implicit",
+		ImplicitDepsFile: "deps.json",
+		Stats: "stats.txt",
+	})
+	defer ts.Close()
+	tests := []struct {
+		name string
+		req *DistillRequest
+	}{
+		{"unknown strategy", &DistillRequest{Strategy: "none"}},
+		{"file setting", &DistillRequest{
+			Settings: map[string]json.RawMessage{"implicit_dependencies": json.RawMessage(`"/etc/passwd"`)},
+		}},
+		{"nested setting", &DistillRequest{
+			Settings: map[string]json.RawMessage{"max_depth": json.RawMessage(`{"path": "/etc/passwd"}`)},
+		}},
+	}
+	for _, test := range tests {
+		resp := new(DistillResponse)
+		if status := post(t, ts, "/distill", test.req, resp); status != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", test.name, status, http.StatusBadRequest)
+		}
+		if resp.Error == "" {
+			t.Errorf("%s: no error", test.name)
+		}
+	}
+	conf, err := s.requestConfig(&DistillRequest{
+		Settings: map[string]json.RawMessage{"max_depth": json.RawMessage("2")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Type != "implicit" || conf.ImplicitDepsFile != "deps.json" || conf.Stats != "stats.txt" {
+		t.Errorf("request config doesn't keep the server's: %+v", conf)
+	}
+	if string(conf.Strategies["implicit"]) != `{"max_depth":2}` {
+		t.Errorf("got settings %s", conf.Strategies["implicit"])
+	}
+	if s.distillConf.Strategies != nil {
+		t.Errorf("request settings leaked into the server's config")
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	_, ts := newTestServer(nil, nil)
+	defer ts.Close()
+	post(t, ts, "/convert", &ConvertRequest{Trace: "Cover: 0x1\n"}, new(ConvertResponse))
+	post(t, ts, "/distill", &DistillRequest{Strategy: "none"}, new(DistillResponse))
+	r, err := http.Get(ts.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	stats := new(ServerStats)
+	if err := json.NewDecoder(r.Body).Decode(stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Requests["convert"] != 1 || stats.Requests["distill"] != 1 || stats.Requests["stats"] != 1 {
+		t.Errorf("got requests %v", stats.Requests)
+	}
+	if stats.Failures != 2 || stats.Traces != 0 || stats.Programs != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+	if stats.Uptime == "" {
+		t.Errorf("no uptime")
+	}
+}
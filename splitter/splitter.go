@@ -0,0 +1,237 @@
+package splitter
+
+import (
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/tracker"
+)
+
+/*
+Split fills out the memory of p and returns the programs to emit for it. If p doesn't fit
+into the memory syzkaller makes available or into the executor buffer it is partitioned
+into chunks of consecutive calls instead of being dropped. Every chunk also carries the calls
+its own calls depend on: producers of the resources they use and the calls that create and
+previously touched the mappings they point into. Such calls are duplicated into every chunk
+which needs them. Calls which don't fit into a program even on their own are dropped.
+ */
+func Split(p *prog.Prog, m *tracker.MemoryTracker) []*prog.Prog {
+	chunks, _ := SplitWithOrigins(p, m)
+	return chunks
+}
+
+/*
+SplitWithOrigins is Split but also maps the calls of the chunks back to the calls of p
+they were copied from. Calls of p which are returned as is and the mmap calls we add
+are left out.
+ */
+func SplitWithOrigins(p *prog.Prog, m *tracker.MemoryTracker) ([]*prog.Prog, map[*prog.Call]*prog.Call) {
+	if finish(p, m) {
+		return []*prog.Prog{p}, nil
+	}
+	s := newSplitter(p, m)
+	chunks := s.split()
+	log.Logf(1, "Split program of %d calls into %d programs", len(p.Calls), len(chunks))
+	return chunks, s.origins
+}
+
+type splitter struct {
+	prog *prog.Prog
+	tracker *tracker.MemoryTracker
+	deps [][]int /* indices of the calls each call directly depends on */
+	origins map[*prog.Call]*prog.Call
+}
+
+func newSplitter(p *prog.Prog, m *tracker.MemoryTracker) *splitter {
+	s := &splitter{
+		prog: p,
+		tracker: m,
+		deps: make([][]int, len(p.Calls)),
+		origins: make(map[*prog.Call]*prog.Call, 0),
+	}
+	owners := make(map[prog.Arg]int, 0)
+	for i, call := range p.Calls {
+		for _, arg := range callArgs(call) {
+			owners[arg] = i
+		}
+	}
+	for i, call := range p.Calls {
+		for _, arg := range callArgs(call) {
+			if a, ok := arg.(*prog.ResultArg); ok && a.Res != nil {
+				if idx, ok := owners[a.Res]; ok && idx != i {
+					s.deps[i] = append(s.deps[i], idx)
+				}
+			}
+		}
+	}
+	for _, args := range m.MappingArgs() {
+		for j, arg := range args {
+			user, ok := owners[arg]
+			if !ok {
+				continue
+			}
+			for _, prev := range args[:j] {
+				if idx, ok := owners[prev]; ok && idx != user {
+					s.deps[user] = append(s.deps[user], idx)
+				}
+			}
+		}
+	}
+	return s
+}
+
+/*
+split greedily grows a chunk call by call until the memory of its calls and their
+dependencies no longer fits. The resulting chunks are checked against the executor buffer
+when they are built.
+ */
+func (s *splitter) split() []*prog.Prog {
+	chunks := make([]*prog.Prog, 0)
+	own := make([]int, 0)
+	closure := make(map[int]bool, 0)
+	for i := range s.prog.Calls {
+		s.close(closure, i)
+		if s.fits(closure) {
+			own = append(own, i)
+			continue
+		}
+		chunks = append(chunks, s.build(own)...)
+		own = own[:0]
+		closure = make(map[int]bool, 0)
+		s.close(closure, i)
+		if !s.fits(closure) {
+			log.Logf(1, "Dropping call %d: %s, its dependencies don't fit into memory", i, s.prog.Calls[i].Meta.Name)
+			closure = make(map[int]bool, 0)
+			continue
+		}
+		own = append(own, i)
+	}
+	return append(chunks, s.build(own)...)
+}
+
+// close adds call idx and everything it transitively depends on to closure
+func (s *splitter) close(closure map[int]bool, idx int) {
+	stack := []int{idx}
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if closure[i] {
+			continue
+		}
+		closure[i] = true
+		stack = append(stack, s.deps[i]...)
+	}
+}
+
+func (s *splitter) fits(closure map[int]bool) bool {
+	calls := make([]*prog.Call, 0, len(closure))
+	for i, call := range s.prog.Calls {
+		if closure[i] {
+			calls = append(calls, call)
+		}
+	}
+	return s.tracker.FitsInMemory(calls)
+}
+
+/*
+build creates the program for the calls in own. If it is too large for the executor
+it is halved until the pieces fit.
+ */
+func (s *splitter) build(own []int) []*prog.Prog {
+	if len(own) == 0 {
+		return nil
+	}
+	closure := make(map[int]bool, 0)
+	for _, i := range own {
+		s.close(closure, i)
+	}
+	chunk, m := s.extract(closure)
+	if finish(chunk, m) {
+		return []*prog.Prog{chunk}
+	}
+	if len(own) == 1 {
+		log.Logf(1, "Dropping call %d: %s, it doesn't fit into a program", own[0], s.prog.Calls[own[0]].Meta.Name)
+		return nil
+	}
+	half := len(own)/2
+	return append(s.build(own[:half]), s.build(own[half:])...)
+}
+
+/*
+extract copies the calls in closure into a new program along with a tracker for it.
+The copies are independent of the original program so the same call can be part of
+several chunks.
+ */
+func (s *splitter) extract(closure map[int]bool) (*prog.Prog, *tracker.MemoryTracker) {
+	clone := s.prog.Clone()
+	chunk := &prog.Prog{
+		Target: s.prog.Target,
+		Calls: make([]*prog.Call, 0, len(closure)),
+	}
+	calls := make(map[*prog.Call]*prog.Call, len(closure))
+	args := make(map[prog.Arg]prog.Arg, 0)
+	argIdx := make(map[prog.Arg]int, 0)
+	kept := make(map[*prog.ResultArg]bool, 0)
+	for i, call := range s.prog.Calls {
+		if !closure[i] {
+			continue
+		}
+		newCall := clone.Calls[i]
+		calls[call] = newCall
+		s.origins[newCall] = call
+		origArgs, newArgs := callArgs(call), callArgs(newCall)
+		for j, arg := range origArgs {
+			args[arg] = newArgs[j]
+			argIdx[arg] = len(chunk.Calls)
+			if a, ok := newArgs[j].(*prog.ResultArg); ok {
+				kept[a] = true
+			}
+		}
+		chunk.Calls = append(chunk.Calls, newCall)
+	}
+	//Uses by calls which were left out of the chunk would dangle
+	for a := range kept {
+		for use := range a.Uses() {
+			if !kept[use] {
+				delete(a.Uses(), use)
+			}
+		}
+	}
+	return chunk, s.tracker.Project(calls, args, argIdx)
+}
+
+/*
+finish lays out the memory of p and prepends the mmap call backing it. Returns false,
+leaving p without the mmap call, if p doesn't fit into memory or the executor buffer,
+or isn't valid.
+ */
+func finish(p *prog.Prog, m *tracker.MemoryTracker) bool {
+	if err := m.FillOutMemory(p); err != nil {
+		log.Logf(2, "Failed to fill out memory: %s", err)
+		return false
+	}
+	calls := p.Calls
+	if totalMemory := m.GetTotalMemoryAllocations(p); totalMemory > 0 {
+		mmapCall := p.Target.MakeMmap(0, totalMemory)
+		p.Calls = append([]*prog.Call{mmapCall}, calls...)
+	}
+	if err := p.Validate(); err != nil {
+		log.Logf(0, "Dropping invalid program of %d calls: %v", len(calls), err)
+		p.Calls = calls
+		return false
+	}
+	buff := make([]byte, prog.ExecBufferSize)
+	if _, err := p.SerializeForExec(buff); err != nil {
+		log.Logf(2, "Program of %d calls is too large for the executor", len(p.Calls))
+		p.Calls = calls
+		return false
+	}
+	return true
+}
+
+func callArgs(call *prog.Call) []prog.Arg {
+	args := make([]prog.Arg, 0)
+	prog.ForeachArg(call, func(arg prog.Arg, _ *prog.ArgCtx) {
+		args = append(args, arg)
+	})
+	return args
+}
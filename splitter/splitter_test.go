@@ -0,0 +1,140 @@
+package splitter
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/sys/targets"
+	"github.com/shankarapailoor/moonshine/tracker"
+)
+
+var registerTestTarget sync.Once
+
+// testTarget returns a target where open returns an fd that write writes a buffer to
+func testTarget(t *testing.T) *prog.Target {
+	common := func(name string, field string, size uint64) prog.TypeCommon {
+		return prog.TypeCommon{TypeName: name, FldName: field, TypeSize: size}
+	}
+	intType := func(field string, size uint64) *prog.IntType {
+		return &prog.IntType{IntTypeCommon: prog.IntTypeCommon{TypeCommon: common("int", field, size)}}
+	}
+	lenType := func(field string, buf string) *prog.LenType {
+		return &prog.LenType{IntTypeCommon: prog.IntTypeCommon{TypeCommon: common("len", field, 8)}, Buf: buf}
+	}
+	fd := func(dir prog.Dir) *prog.ResourceType {
+		typ := &prog.ResourceType{TypeCommon: common("fd", "fd", 4)}
+		typ.ArgDir = dir
+		return typ
+	}
+	buffer := &prog.BufferType{TypeCommon: common("buffer", "buf", 0)}
+	buffer.IsVarlen = true
+	registerTestTarget.Do(func() {
+		prog.RegisterTarget(&prog.Target{
+			OS: "moonshine",
+			Arch: "splitter",
+			PtrSize: 8,
+			PageSize: 4 << 10,
+			NumPages: 4 << 10,
+			DataOffset: 512 << 20,
+			Syscalls: []*prog.Syscall{
+				{Name: "mmap", CallName: "mmap", NR: 9, Args: []prog.Type{
+					&prog.VmaType{TypeCommon: common("vma", "addr", 8)}, lenType("len", "addr"),
+					intType("prot", 4), intType("flags", 4), fd(prog.DirIn), intType("offset", 8),
+				}},
+				{Name: "open", CallName: "open", NR: 2, Ret: fd(prog.DirOut)},
+				{Name: "write", CallName: "write", NR: 1, Args: []prog.Type{
+					fd(prog.DirIn), &prog.PtrType{TypeCommon: common("ptr", "buf", 8), Type: buffer},
+					lenType("count", "buf"),
+				}},
+			},
+			Resources: []*prog.ResourceDesc{{
+				Name: "fd",
+				Type: intType("", 4),
+				Kind: []string{"fd"},
+				Values: []uint64{^uint64(0)},
+			}},
+		}, func(target *prog.Target) {
+			target.MakeMmap = targets.MakePosixMmap(target)
+		})
+	})
+	target, err := prog.GetTarget("moonshine", "splitter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return target
+}
+
+// writes makes a program which opens a file and writes a buffer of each size to it
+func writes(t *testing.T, sizes ...int) (*prog.Prog, *tracker.MemoryTracker) {
+	target := testTarget(t)
+	m := tracker.NewTracker()
+	open := &prog.Call{Meta: target.SyscallMap["open"]}
+	open.Ret = prog.MakeReturnArg(open.Meta.Ret)
+	p := &prog.Prog{Target: target, Calls: []*prog.Call{open}}
+	for _, size := range sizes {
+		meta := target.SyscallMap["write"]
+		buf := prog.MakePointerArg(meta.Args[1], 0, prog.MakeDataArg(meta.Args[1].(*prog.PtrType).Type, make([]byte, size)))
+		write := &prog.Call{
+			Meta: meta,
+			Args: []prog.Arg{
+				prog.MakeResultArg(meta.Args[0], open.Ret, 0), buf, prog.MakeConstArg(meta.Args[2], uint64(size)),
+			},
+			Ret: prog.MakeReturnArg(meta.Ret),
+		}
+		if err := m.AddAllocation(write, uint64(size), buf); err != nil {
+			t.Fatal(err)
+		}
+		p.Calls = append(p.Calls, write)
+	}
+	return p, m
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name string
+		sizes []int
+		chunks [][]string /* calls of each chunk, without the mmap */
+	}{
+		{"fits", []int{16, 16}, [][]string{{"open", "write", "write"}}},
+		//Writes of 1MB fill half the executor buffer each
+		{"executor buffer", []int{1 << 20, 1 << 20, 1 << 20}, [][]string{
+			{"open", "write"}, {"open", "write"}, {"open", "write"},
+		}},
+		//A write of 32MB doesn't fit into the memory of any program, it is dropped between the chunks
+		{"memory", []int{16, 32 << 20, 16}, [][]string{{"open", "write"}, {"open", "write"}}},
+	}
+	for _, test := range tests {
+		p, m := writes(t, test.sizes...)
+		chunks, origins := SplitWithOrigins(p, m)
+		if len(chunks) != len(test.chunks) {
+			t.Errorf("%s: got %d programs, want %d", test.name, len(chunks), len(test.chunks))
+			continue
+		}
+		for i, chunk := range chunks {
+			if err := chunk.Validate(); err != nil {
+				t.Errorf("%s: program %d is invalid: %v", test.name, i, err)
+			}
+			if chunk.Calls[0].Meta.Name != "mmap" {
+				t.Errorf("%s: memory of program %d isn't mapped by its first call", test.name, i)
+				continue
+			}
+			calls := chunk.Calls[1:]
+			if len(calls) != len(test.chunks[i]) {
+				t.Errorf("%s: program %d has %d calls, want %v", test.name, i, len(calls), test.chunks[i])
+				continue
+			}
+			for j, call := range calls {
+				if call.Meta.Name != test.chunks[i][j] {
+					t.Errorf("%s: call %d of program %d is %s, want %s", test.name, j, i, call.Meta.Name, test.chunks[i][j])
+				}
+				if origins != nil && origins[call] == nil {
+					t.Errorf("%s: call %d of program %d has no origin", test.name, j, i)
+				}
+				if j > 0 && call.Args[0].(*prog.ResultArg).Res != calls[0].Ret {
+					t.Errorf("%s: write %d of program %d doesn't use the fd of its own open", test.name, j, i)
+				}
+			}
+		}
+	}
+}
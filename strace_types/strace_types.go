@@ -117,8 +117,10 @@ type Syscall struct {
 	Pid int64
 	Ret int64
 	Cover []uint64
+	Trace []uint64 /* PCs in the order they were hit, Cover has each of them once */
 	Paused bool
 	Resumed bool
+	Line int /* line of the trace the call starts on, 0 if unknown */
 }
 
 func NewSyscall(pid int64, name string,
@@ -262,6 +264,20 @@ func NewParenthetical() *Parenthetical {
 	return &Parenthetical{tmp:"tmp"};
 }
 
+/*
+EvalMacro and EvalConst evaluate the macros and named constants the parser has
+extensions registered for, and return false for the others. Named constants without
+one are looked up in the target's constants and then in Special_Consts.
+ */
+var (
+	EvalMacro = func(m *Macro, target *prog.Target) (uint64, bool) {
+		return 0, false
+	}
+	EvalConst = func(name string, target *prog.Target) (uint64, bool) {
+		return 0, false
+	}
+)
+
 type Macro struct {
 	MacroName string
 	Args []Type
@@ -289,11 +305,10 @@ func (m *Macro) String() string {
 }
 
 func (m *Macro) Eval(target *prog.Target) uint64 {
-	switch m.MacroName {
-	case "KERNEL_VERSION":
-		return (m.Args[0].Eval(target) << 16) + (m.Args[1].Eval(target) << 8) + m.Args[2].Eval(target)
+	if val, ok := EvalMacro(m, target); ok {
+		return val
 	}
-	panic("Eval called on macro type")
+	panic(fmt.Sprintf("Failed to eval macro: %s", m.MacroName))
 }
 
 type Call struct {
@@ -517,7 +532,9 @@ func NewFlagType(val string) (typ *FlagType) {
 }
 
 func (f *FlagType) Eval(target *prog.Target) uint64 {
-	if val, ok := target.ConstMap[f.String()]; ok {
+	if val, ok := EvalConst(f.String(), target); ok {
+		return val
+	} else if val, ok := target.ConstMap[f.String()]; ok {
 		return val
 	} else if val, ok := Special_Consts[f.String()]; ok {
 		return val
@@ -29,7 +29,6 @@ var (
 		//		"sendmsg": true, //TODO: the addr arg in msg_name struct is all wonky and ordering of args is off
 		//		"recvmsg": true, //TODO: the addr arg in msg_name struct is all wonky and ordering of args is off
 		"gettimeofday": true, // unsupported
-		"kill": true, // unsupported
 		//"keyctl": true,
 		//"shmctl": true,
 		//"getsockname": true,
@@ -41,18 +40,8 @@ var (
 		"getppid": true, // unsupported
 		"umask": true, // unsupported
 		"adjtimex": true, // unsupported
-		"nanosleep": true,
-		"wait4": true,
 		"wait": true,
-		"futex": true,
 		//"ioctl$FIONBIO": true, // unsupported
-		"rt_sigprocmask": true,
-		"rt_sigaction": true,
-		"rt_sigtimedwait":true,
-		"rt_sigreturn": true,
-		"rt_sigqueueinfo": true,
-		"rt_sigsuspend": true,
-		"tgkill": true,
 		"sysfs": true, // unsupported
 		//"chdir": true, // unsupported
 		"clone": true, // unsupported
@@ -63,6 +52,36 @@ var (
 		"sched_get_priority_max": true,
 	}
 
+	/*
+	Blocking and signal related calls. These are converted like any other call
+	but a call is only kept if its entry is true. The defaults can be overridden
+	with the blocking_calls list of the parser config. rt_sigreturn and rt_sigsuspend
+	are off by default since outside of a signal handler they either crash or block forever.
+	 */
+	BlockingCalls = map[string]bool{
+		"futex": true,
+		"wait4": true,
+		"nanosleep": true,
+		"tgkill": true,
+		"rt_sigprocmask": true,
+		"rt_sigaction": true,
+		"rt_sigtimedwait": true,
+		"rt_sigqueueinfo": true,
+		"rt_sigreturn": false,
+		"rt_sigsuspend": false,
+	}
+
+	/*
+	Resource kinds identifying kernel objects other than file descriptors. Unlike fds
+	0 is a valid id for them. Kinds mapped to true have subkinds with ids in separate
+	namespaces, e.g. a message queue and a semaphore set can both have id 0.
+	 */
+	KernelObjectIds = map[string]bool{
+		"ipc": true,
+		"key": false,
+		"timerid": false,
+	}
+
 
 	Accept_labels = map[string]string {
 		"fd": "", // TODO: this is an illegal value. how do we interpret the uniontype?
@@ -680,6 +699,39 @@ var (
 		"SIGFPE": 8,
 		"SIGINT": 2,
 		"SIG_0": 0,
+		"SA_RESTORER": 0x04000000,
+		"SI_USER": 0,
+		"SI_QUEUE": ^uint64(0),
+		"SI_TKILL": ^uint64(5),
+		"FUTEX_FD": 2,
+		"FUTEX_WAKE_OP": 5,
+		"FUTEX_LOCK_PI": 6,
+		"FUTEX_UNLOCK_PI": 7,
+		"FUTEX_TRYLOCK_PI": 8,
+		"FUTEX_WAKE_BITSET": 10,
+		"FUTEX_WAIT_REQUEUE_PI": 11,
+		"FUTEX_CMP_REQUEUE_PI": 12,
+		"FUTEX_PRIVATE_FLAG": 128,
+		"FUTEX_CLOCK_REALTIME": 256,
+		"FUTEX_REQUEUE_PRIVATE": 131,
+		"FUTEX_CMP_REQUEUE_PRIVATE": 132,
+		"FUTEX_WAKE_OP_PRIVATE": 133,
+		"FUTEX_LOCK_PI_PRIVATE": 134,
+		"FUTEX_TRYLOCK_PI_PRIVATE": 136,
+		"FUTEX_WAIT_BITSET_PRIVATE": 137,
+		"FUTEX_WAKE_BITSET_PRIVATE": 138,
+		"FUTEX_BITSET_MATCH_ANY": 0xffffffff,
+		"FUTEX_OP_SET": 0,
+		"FUTEX_OP_ADD": 1,
+		"FUTEX_OP_OR": 2,
+		"FUTEX_OP_ANDN": 3,
+		"FUTEX_OP_XOR": 4,
+		"FUTEX_OP_CMP_EQ": 0,
+		"FUTEX_OP_CMP_NE": 1,
+		"FUTEX_OP_CMP_LT": 2,
+		"FUTEX_OP_CMP_LE": 3,
+		"FUTEX_OP_CMP_GT": 4,
+		"FUTEX_OP_CMP_GE": 5,
 		"S_ISUID": 0x0004000,
 		"S_ISGID": 0x0002000,
 		"RLIM64_INFINITY": ^uint64(0),
@@ -863,6 +915,17 @@ var (
 
 )
 
+func KeepBlockingCalls(calls []string) {
+	for name := range BlockingCalls {
+		BlockingCalls[name] = false
+	}
+	for _, name := range calls {
+		if _, ok := BlockingCalls[name]; ok {
+			BlockingCalls[name] = true
+		}
+	}
+}
+
 func GenBuff(bufVal []byte, size uint64) []byte {
 	var valLen = 0
 	if bufVal != nil {
@@ -921,6 +984,9 @@ func ReturnArg(t prog.Type) *prog.ResultArg {
 func GetSyzType(typ prog.Type) string {
 	switch a := typ.(type) {
 	case *prog.ResourceType:
+		if KernelObjectIds[a.Desc.Kind[0]] && len(a.Desc.Kind) > 1 {
+			return "ResourceType-" + a.Desc.Kind[1]
+		}
 		return "ResourceType-" + a.Desc.Kind[0]
 	case *prog.BufferType:
 		return "BufferType"
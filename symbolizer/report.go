@@ -0,0 +1,170 @@
+package symbolizer
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+)
+
+/*
+A Report compares the coverage of the raw traces with that of the distilled corpus per
+subsystem, so it shows what distillation throws away.
+ */
+type Report struct {
+	Subsystems []*SubsystemCover
+	Total *SubsystemCover
+}
+
+type SubsystemCover struct {
+	Name string
+	TracePCs int
+	DistilledPCs int
+	TraceFuncs int
+	DistilledFuncs int
+	LostFuncs []string /* functions the traces reach but the distilled corpus doesn't */
+}
+
+func (s *SubsystemCover) Kept() float64 {
+	if s.TracePCs == 0 {
+		return 100
+	}
+	return 100 * float64(s.DistilledPCs) / float64(s.TracePCs)
+}
+
+/*
+NewReport symbolizes the PCs of the traces and of the distilled corpus, which have to be
+a subset of them, and aggregates them by subsystem at the given directory depth.
+ */
+func NewReport(s *Symbolizer, traces []uint64, distilled []uint64, depth int) *Report {
+	frames := s.Symbolize(traces)
+	subsystems := make(map[string]*SubsystemCover)
+	traceFuncs := make(map[string]map[string]bool)
+	distilledFuncs := make(map[string]map[string]bool)
+	get := func(pc uint64) (*Frame, *SubsystemCover) {
+		frame, ok := frames[pc]
+		if !ok {
+			frame = &Frame{PC: pc}
+		}
+		name := Subsystem(frame.File, depth)
+		sub, ok := subsystems[name]
+		if !ok {
+			sub = &SubsystemCover{Name: name}
+			subsystems[name] = sub
+			traceFuncs[name] = make(map[string]bool)
+			distilledFuncs[name] = make(map[string]bool)
+		}
+		return frame, sub
+	}
+	seen := make(map[uint64]bool)
+	for _, pc := range traces {
+		if seen[pc] {
+			continue
+		}
+		seen[pc] = true
+		frame, sub := get(pc)
+		sub.TracePCs += 1
+		if frame.Func != "" {
+			traceFuncs[sub.Name][frame.Func] = true
+		}
+	}
+	seen = make(map[uint64]bool)
+	for _, pc := range distilled {
+		if seen[pc] {
+			continue
+		}
+		seen[pc] = true
+		frame, sub := get(pc)
+		sub.DistilledPCs += 1
+		if frame.Func != "" {
+			distilledFuncs[sub.Name][frame.Func] = true
+		}
+	}
+	r := &Report{
+		Total: &SubsystemCover{Name: "total"},
+	}
+	for name, sub := range subsystems {
+		sub.TraceFuncs = len(traceFuncs[name])
+		sub.DistilledFuncs = len(distilledFuncs[name])
+		for fn := range traceFuncs[name] {
+			if !distilledFuncs[name][fn] {
+				sub.LostFuncs = append(sub.LostFuncs, fn)
+			}
+		}
+		sort.Strings(sub.LostFuncs)
+		r.Subsystems = append(r.Subsystems, sub)
+		r.Total.TracePCs += sub.TracePCs
+		r.Total.DistilledPCs += sub.DistilledPCs
+		r.Total.TraceFuncs += sub.TraceFuncs
+		r.Total.DistilledFuncs += sub.DistilledFuncs
+	}
+	//Subsystems losing the most coverage first
+	sort.Slice(r.Subsystems, func(i, j int) bool {
+		a, b := r.Subsystems[i], r.Subsystems[j]
+		if lostA, lostB := a.TracePCs-a.DistilledPCs, b.TracePCs-b.DistilledPCs; lostA != lostB {
+			return lostA > lostB
+		}
+		return a.Name < b.Name
+	})
+	return r
+}
+
+func (r *Report) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%-32s %10s %10s %7s %8s %8s\n",
+		"subsystem", "trace PCs", "kept PCs", "kept%", "funcs", "kept"); err != nil {
+		return err
+	}
+	for _, sub := range append(r.Subsystems, r.Total) {
+		if _, err := fmt.Fprintf(w, "%-32s %10d %10d %6.1f%% %8d %8d\n", sub.Name, sub.TracePCs,
+			sub.DistilledPCs, sub.Kept(), sub.TraceFuncs, sub.DistilledFuncs); err != nil {
+			return err
+		}
+	}
+	for _, sub := range r.Subsystems {
+		if len(sub.LostFuncs) == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "\n%s loses %d functions:\n", sub.Name, len(sub.LostFuncs)); err != nil {
+			return err
+		}
+		for _, fn := range sub.LostFuncs {
+			if _, err := fmt.Fprintf(w, "\t%s\n", fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *Report) WriteHTML(w io.Writer) error {
+	return reportTemplate.Execute(w, r)
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>MoonShine coverage report</title>
+<style>
+	body { font-family: sans-serif; }
+	table { border-collapse: collapse; }
+	th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: right; }
+	td:first-child, th:first-child { text-align: left; }
+	tr.total { font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Coverage of the traces kept by distillation</h1>
+<table>
+<tr><th>subsystem</th><th>trace PCs</th><th>kept PCs</th><th>kept</th><th>functions</th><th>kept functions</th></tr>
+{{range .Subsystems}}<tr><td>{{.Name}}</td><td>{{.TracePCs}}</td><td>{{.DistilledPCs}}</td><td>{{printf "%.1f%%" .Kept}}</td><td>{{.TraceFuncs}}</td><td>{{.DistilledFuncs}}</td></tr>
+{{end}}{{with .Total}}<tr class="total"><td>{{.Name}}</td><td>{{.TracePCs}}</td><td>{{.DistilledPCs}}</td><td>{{printf "%.1f%%" .Kept}}</td><td>{{.TraceFuncs}}</td><td>{{.DistilledFuncs}}</td></tr>{{end}}
+</table>
+<h2>Functions lost by distillation</h2>
+{{range .Subsystems}}{{if .LostFuncs}}<details><summary>{{.Name}} ({{len .LostFuncs}})</summary><ul>
+{{range .LostFuncs}}<li>{{.}}</li>
+{{end}}</ul></details>
+{{end}}{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,191 @@
+package symbolizer
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type Frame struct {
+	PC uint64
+	Func string
+	File string /* relative to the kernel source tree if it's known */
+	Line int
+}
+
+type function struct {
+	name string
+	start uint64
+	end uint64
+}
+
+/*
+A Symbolizer maps kernel PCs to the function, file and line they belong to using the
+symbols and DWARF debug info of a vmlinux built with the kernel that was traced.
+ */
+type Symbolizer struct {
+	file *elf.File
+	dwarf *dwarf.Data
+	funcs []function /* ordered by start */
+}
+
+func Open(vmlinux string) (*Symbolizer, error) {
+	file, err := elf.Open(vmlinux)
+	if err != nil {
+		return nil, err
+	}
+	s := &Symbolizer{
+		file: file,
+	}
+	symbols, err := file.Symbols()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read symbols of %s: %v", vmlinux, err)
+	}
+	for _, sym := range symbols {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Size > 0 {
+			s.funcs = append(s.funcs, function{sym.Name, sym.Value, sym.Value+sym.Size})
+		}
+	}
+	sort.Slice(s.funcs, func(i, j int) bool {
+		return s.funcs[i].start < s.funcs[j].start
+	})
+	//Without debug info we still know the functions
+	if data, err := file.DWARF(); err == nil {
+		s.dwarf = data
+	}
+	return s, nil
+}
+
+func (s *Symbolizer) Close() error {
+	return s.file.Close()
+}
+
+/*
+Symbolize returns the frame of every PC. kcov reports the return address of its callback,
+so each PC is looked up as the address before it, which is inside the call instruction.
+Only the line tables of compile units containing PCs are read as those of a whole
+vmlinux are huge.
+ */
+func (s *Symbolizer) Symbolize(pcs []uint64) map[uint64]*Frame {
+	frames := make(map[uint64]*Frame, len(pcs))
+	addrs := make([]uint64, 0, len(pcs))
+	for _, pc := range pcs {
+		if _, ok := frames[pc]; ok {
+			continue
+		}
+		frames[pc] = &Frame{
+			PC: pc,
+			Func: s.function(pc-1),
+		}
+		addrs = append(addrs, pc-1)
+	}
+	if s.dwarf == nil {
+		return frames
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i] < addrs[j]
+	})
+	r := s.dwarf.Reader()
+	for {
+		entry, err := r.Next()
+		if err != nil || entry == nil {
+			break
+		}
+		if entry.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+			continue
+		}
+		r.SkipChildren()
+		ranges, err := s.dwarf.Ranges(entry)
+		if err != nil || !containsAny(ranges, addrs) {
+			continue
+		}
+		compDir, _ := entry.Val(dwarf.AttrCompDir).(string)
+		lr, err := s.dwarf.LineReader(entry)
+		if err != nil || lr == nil {
+			continue
+		}
+		var prev, cur dwarf.LineEntry
+		first := true
+		for {
+			if err := lr.Next(&cur); err != nil {
+				break
+			}
+			if !first && !prev.EndSequence && prev.File != nil {
+				file := relative(prev.File.Name, compDir)
+				for _, addr := range inRange(addrs, prev.Address, cur.Address) {
+					frame := frames[addr+1]
+					frame.File = file
+					frame.Line = prev.Line
+				}
+			}
+			prev = cur
+			first = false
+		}
+	}
+	return frames
+}
+
+func (s *Symbolizer) function(addr uint64) string {
+	i := sort.Search(len(s.funcs), func(i int) bool {
+		return s.funcs[i].start > addr
+	})
+	if i == 0 || addr >= s.funcs[i-1].end {
+		return ""
+	}
+	return s.funcs[i-1].name
+}
+
+func containsAny(ranges [][2]uint64, addrs []uint64) bool {
+	for _, r := range ranges {
+		if len(inRange(addrs, r[0], r[1])) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// inRange returns the addresses in [start, end) of the ordered addrs
+func inRange(addrs []uint64, start uint64, end uint64) []uint64 {
+	i := sort.Search(len(addrs), func(i int) bool {
+		return addrs[i] >= start
+	})
+	j := i
+	for j < len(addrs) && addrs[j] < end {
+		j++
+	}
+	return addrs[i:j]
+}
+
+func relative(file string, compDir string) string {
+	if compDir != "" && strings.HasPrefix(file, compDir+"/") {
+		return strings.TrimPrefix(file, compDir+"/")
+	}
+	return filepath.Clean(file)
+}
+
+/*
+Subsystem returns the directory a source file belongs to, cut to depth components,
+e.g. net/sctp for net/sctp/socket.c at depth 2. Files outside the source tree, or PCs
+without a file, are grouped under their top directory or "unknown".
+ */
+func Subsystem(file string, depth int) string {
+	if file == "" {
+		return "unknown"
+	}
+	dirs := strings.Split(filepath.Dir(file), "/")
+	if dirs[0] == "" {
+		dirs = dirs[1:]
+	}
+	if len(dirs) > depth {
+		dirs = dirs[:depth]
+	}
+	if len(dirs) == 0 || dirs[0] == "." {
+		return "."
+	}
+	return strings.Join(dirs, "/")
+}
@@ -0,0 +1,237 @@
+package tracker
+
+import (
+	. "github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/strace_types"
+	"sort"
+)
+
+const (
+	allocAlign = 8 // largest alignment of a scalar on the architectures we support
+	callSlack = 1 // calls memory stays reserved for after its last use, see layout
+)
+
+/*
+The kernel holds on to the memory passed to these calls and accesses it after they
+return, so their allocations have to stay reserved until the end of the program.
+ */
+var RetainedMemoryCalls = map[string]bool{
+	"io_submit": true,
+	"rseq": true,
+	"set_robust_list": true,
+	"set_tid_address": true,
+	"sigaltstack": true,
+}
+
+/*
+A span is a range of memory which has to stay reserved from call first up to and
+including call last.
+ */
+type span struct {
+	size uint64
+	align uint64
+	first int
+	last int
+	offset uint64
+}
+
+type layout struct {
+	allocations map[*Allocation]uint64
+	mappings map[*VirtualMapping]uint64
+	allocEnd uint64 /* page aligned end of the region backing the allocations */
+	end uint64
+}
+
+/*
+layout assigns offsets to the allocations and mappings of calls. Memory is reused once
+the calls using it are done with it:
+ - an allocation is used by its own call and by the calls using resources the kernel
+   wrote into it, since the executor reads those back after the call,
+ - a mapping is used by every call pointing into it, which keeps its address stable for
+   all of them,
+ - the kernel keeps using the memory of the calls in RetainedMemoryCalls, and of blocking
+   calls which may still be running, until the end of the program.
+syzkaller may run a call at the same time as the next one, so memory is only reused
+callSlack calls after its last use. The allocations are laid out first as they are
+backed by the single mmap prepended to the program, the mappings follow.
+ */
+func (m *MemoryTracker) layout(calls []*Call) *layout {
+	l := &layout{
+		allocations: make(map[*Allocation]uint64),
+		mappings: make(map[*VirtualMapping]uint64),
+	}
+	owners := make(map[Arg]int)
+	for i, call := range calls {
+		ForeachArg(call, func(arg Arg, _ *ArgCtx) {
+			owners[arg] = i
+		})
+	}
+	lastUses := m.lastUses(calls)
+	spans := make([]*span, 0)
+	allocs := make([]*Allocation, 0)
+	for i, call := range calls {
+		for _, a := range m.allocations[call] {
+			s := &span{
+				size: a.num_bytes,
+				align: allocationAlign(a.arg),
+				first: i,
+				last: i,
+			}
+			if last, ok := lastUses[a]; ok && last > s.last {
+				s.last = last
+			}
+			if _, ok := a.arg.Type().(*VmaType); ok || retainsMemory(call) {
+				s.last = len(calls)-1
+			}
+			s.last += callSlack
+			spans = append(spans, s)
+			allocs = append(allocs, a)
+		}
+	}
+	l.allocEnd = place(spans, 0)
+	if l.allocEnd % PageSize > 0 {
+		l.allocEnd = (l.allocEnd/PageSize+1)*PageSize
+	}
+	for i, s := range spans {
+		l.allocations[allocs[i]] = s.offset
+	}
+
+	spans = make([]*span, 0)
+	mappings := make([]*VirtualMapping, 0)
+	for _, mapping := range m.mappings {
+		s := &span{
+			size: mapping.end - mapping.start,
+			align: PageSize,
+			first: -1,
+			last: -1,
+		}
+		retained := false
+		for _, dep := range mapping.usedBy {
+			if i, ok := owners[dep.arg]; ok {
+				if s.first < 0 || i < s.first {
+					s.first = i
+				}
+				if i > s.last {
+					s.last = i
+				}
+				retained = retained || retainsMemory(calls[i])
+			}
+		}
+		if s.first < 0 {
+			continue
+		}
+		if retained {
+			s.last = len(calls)-1
+		}
+		s.last += callSlack
+		spans = append(spans, s)
+		mappings = append(mappings, mapping)
+	}
+	order := make([]int, len(spans))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return spans[order[i]].first < spans[order[j]].first
+	})
+	sorted := make([]*span, len(spans))
+	for i, idx := range order {
+		sorted[i] = spans[idx]
+	}
+	l.end = place(sorted, l.allocEnd)
+	for i, s := range spans {
+		l.mappings[mappings[i]] = s.offset
+	}
+	return l
+}
+
+/*
+lastUses returns the index of the last call using a resource written into each
+allocation, for the allocations holding resources later calls use.
+ */
+func (m *MemoryTracker) lastUses(calls []*Call) map[*Allocation]int {
+	allocOf := make(map[Arg]*Allocation)
+	for _, call := range calls {
+		for _, a := range m.allocations[call] {
+			ForeachSubArg(a.arg, func(arg Arg, _ *ArgCtx) {
+				allocOf[arg] = a
+			})
+		}
+	}
+	lastUses := make(map[*Allocation]int)
+	for i, call := range calls {
+		ForeachArg(call, func(arg Arg, _ *ArgCtx) {
+			if res, ok := arg.(*ResultArg); ok && res.Res != nil {
+				if a, ok := allocOf[res.Res]; ok {
+					lastUses[a] = i
+				}
+			}
+		})
+	}
+	return lastUses
+}
+
+func retainsMemory(call *Call) bool {
+	if RetainedMemoryCalls[call.Meta.CallName] {
+		return true
+	}
+	_, blocking := strace_types.BlockingCalls[call.Meta.CallName]
+	return blocking
+}
+
+/*
+place assigns each span the lowest offset above base which doesn't overlap a span
+still in use. spans must be ordered by their first call. Returns the end of the highest span.
+ */
+func place(spans []*span, base uint64) uint64 {
+	end := base
+	live := make([]*span, 0) /* ordered by offset */
+	for _, s := range spans {
+		n := 0
+		for _, l := range live {
+			if l.last >= s.first {
+				live[n] = l
+				n++
+			}
+		}
+		live = live[:n]
+		offset := alignUp(base, s.align)
+		pos := 0
+		for ; pos < len(live); pos++ {
+			l := live[pos]
+			if offset+s.size <= l.offset {
+				break
+			}
+			if l.offset+l.size > offset {
+				offset = alignUp(l.offset+l.size, s.align)
+			}
+		}
+		s.offset = offset
+		live = append(live, nil)
+		copy(live[pos+1:], live[pos:])
+		live[pos] = s
+		if offset+s.size > end {
+			end = offset+s.size
+		}
+	}
+	return end
+}
+
+func allocationAlign(arg Arg) uint64 {
+	if _, ok := arg.Type().(*VmaType); ok {
+		return PageSize
+	}
+	if ptr, ok := arg.(*PointerArg); ok && ptr.Res != nil {
+		if typ, ok := ptr.Res.Type().(*StructType); ok && typ.AlignAttr > allocAlign {
+			return typ.AlignAttr
+		}
+	}
+	return allocAlign
+}
+
+func alignUp(offset uint64, align uint64) uint64 {
+	if offset % align > 0 {
+		offset = (offset/align+1)*align
+	}
+	return offset
+}
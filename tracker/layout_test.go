@@ -0,0 +1,163 @@
+package tracker
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/prog"
+)
+
+var (
+	bufType = &prog.BufferType{TypeCommon: prog.TypeCommon{TypeName: "buf", ArgDir: prog.DirIn, IsVarlen: true}}
+	bufPtrType = &prog.PtrType{TypeCommon: prog.TypeCommon{TypeName: "ptr", TypeSize: 8}, Type: bufType}
+	fdType = &prog.ResourceType{TypeCommon: prog.TypeCommon{TypeName: "fd", TypeSize: 4, ArgDir: prog.DirOut}}
+	fdPtrType = &prog.PtrType{TypeCommon: prog.TypeCommon{TypeName: "ptr", TypeSize: 8}, Type: fdType}
+	fdInType = &prog.ResourceType{TypeCommon: prog.TypeCommon{TypeName: "fd", TypeSize: 4}}
+	vmaType = &prog.VmaType{TypeCommon: prog.TypeCommon{TypeName: "vma", TypeSize: 8}}
+)
+
+func newCall(name string, args ...prog.Arg) *prog.Call {
+	types := make([]prog.Type, 0, len(args))
+	for _, arg := range args {
+		types = append(types, arg.Type())
+	}
+	return &prog.Call{
+		Meta: &prog.Syscall{Name: name, CallName: name, Args: types},
+		Args: args,
+	}
+}
+
+// bufCall makes a call passing a buffer of size bytes, allocated with m
+func bufCall(m *MemoryTracker, name string, size int) *prog.Call {
+	arg := prog.MakePointerArg(bufPtrType, 0, prog.MakeDataArg(bufType, make([]byte, size)))
+	call := newCall(name, arg)
+	m.AddAllocation(call, uint64(size), arg)
+	return call
+}
+
+func address(call *prog.Call) uint64 {
+	return call.Args[0].(*prog.PointerArg).Address
+}
+
+func TestPlace(t *testing.T) {
+	tests := []struct {
+		name string
+		spans []*span
+		want []uint64
+	}{
+		{"reuse after last use", []*span{
+			{size: 16, align: 8, first: 0, last: 0},
+			{size: 16, align: 8, first: 1, last: 1},
+		}, []uint64{0, 0}},
+		{"overlapping lifetimes", []*span{
+			{size: 16, align: 8, first: 0, last: 1},
+			{size: 16, align: 8, first: 1, last: 1},
+		}, []uint64{0, 16}},
+		{"alignment", []*span{
+			{size: 3, align: 8, first: 0, last: 2},
+			{size: 5, align: 8, first: 1, last: 2},
+			{size: 10, align: PageSize, first: 2, last: 2},
+		}, []uint64{0, 8, PageSize}},
+		{"gap between live spans", []*span{
+			{size: 8, align: 8, first: 0, last: 0},
+			{size: 8, align: 8, first: 0, last: 3},
+			{size: 8, align: 8, first: 1, last: 3},
+			{size: 16, align: 8, first: 2, last: 3},
+		}, []uint64{0, 8, 0, 16}},
+	}
+	for _, test := range tests {
+		place(test.spans, 0)
+		for i, s := range test.spans {
+			if s.offset != test.want[i] {
+				t.Errorf("%s: span %d placed at %d, want %d", test.name, i, s.offset, test.want[i])
+			}
+		}
+	}
+}
+
+func TestLayoutReusesMemory(t *testing.T) {
+	m := NewTracker()
+	calls := []*prog.Call{
+		bufCall(m, "write", 100),
+		bufCall(m, "write", 100),
+		bufCall(m, "write", 100),
+		bufCall(m, "write", 100),
+	}
+	if err := m.FillOutMemory(&prog.Prog{Calls: calls}); err != nil {
+		t.Fatal(err)
+	}
+	want := []uint64{0, 104, 0, 104}
+	for i, call := range calls {
+		if address(call) != want[i] {
+			t.Errorf("call %d: buffer at %d, want %d", i, address(call), want[i])
+		}
+	}
+	if total := m.GetTotalMemoryAllocations(&prog.Prog{Calls: calls}); total != PageSize {
+		t.Errorf("allocations take %d bytes, want a page", total)
+	}
+}
+
+func TestLayoutKeepsMemoryOfBlockingCalls(t *testing.T) {
+	m := NewTracker()
+	calls := []*prog.Call{
+		bufCall(m, "nanosleep", 16),
+		bufCall(m, "write", 16),
+		bufCall(m, "write", 16),
+		bufCall(m, "write", 16),
+	}
+	if err := m.FillOutMemory(&prog.Prog{Calls: calls}); err != nil {
+		t.Fatal(err)
+	}
+	for i, call := range calls[1:] {
+		if address(call) == address(calls[0]) {
+			t.Errorf("call %d reuses the memory of nanosleep", i+1)
+		}
+	}
+}
+
+func TestLayoutKeepsResourcesUntilUsed(t *testing.T) {
+	m := NewTracker()
+	fd := prog.MakeResultArg(fdType, nil, 0)
+	pipeArg := prog.MakePointerArg(fdPtrType, 0, fd)
+	pipe := newCall("pipe", pipeArg)
+	m.AddAllocation(pipe, 4, pipeArg)
+	calls := []*prog.Call{
+		pipe,
+		bufCall(m, "write", 4),
+		bufCall(m, "write", 4),
+		newCall("close", prog.MakeResultArg(fdInType, fd, 0)),
+	}
+	if err := m.FillOutMemory(&prog.Prog{Calls: calls}); err != nil {
+		t.Fatal(err)
+	}
+	if address(calls[2]) == address(pipe) {
+		t.Errorf("memory pipe wrote the fd into is reused before the fd is closed")
+	}
+}
+
+func TestLayoutKeepsMappingsStable(t *testing.T) {
+	m := NewTracker()
+	mmap := newCall("mmap", prog.MakeVmaPointerArg(vmaType, 0, 2*PageSize))
+	m.CreateMapping(mmap, 0, mmap.Args[0], 0x7f0000000000, 0x7f0000002000)
+	mapping := m.FindMapping(0x7f0000000000, 0x7f0000002000)
+	calls := []*prog.Call{mmap}
+	for i := 0; i < 3; i++ {
+		calls = append(calls, bufCall(m, "write", 2*PageSize))
+	}
+	read := newCall("read", prog.MakePointerArg(bufPtrType, 0, prog.MakeDataArg(bufType, make([]byte, 16))))
+	mapping.AddDependency(NewMemDependency(len(calls), read.Args[0], 0x7f0000001000, 0x7f0000001010))
+	calls = append(calls, read)
+	if err := m.FillOutMemory(&prog.Prog{Calls: calls}); err != nil {
+		t.Fatal(err)
+	}
+	allocEnd := m.GetTotalMemoryAllocations(&prog.Prog{Calls: calls})
+	start := address(mmap)
+	if start < allocEnd || start % PageSize != 0 {
+		t.Fatalf("mapping at %#x overlaps the allocations ending at %#x or isn't page aligned", start, allocEnd)
+	}
+	if address(read) != start+PageSize {
+		t.Errorf("read points to %#x, want %#x in the second page of the mapping", address(read), start+PageSize)
+	}
+	if vma := m.GetTotalVMAAllocations(&prog.Prog{Calls: calls}); vma != 2*PageSize {
+		t.Errorf("mappings take %d bytes, want 2 pages", vma)
+	}
+}
@@ -44,6 +44,7 @@ type VirtualMapping struct {
 	callidx int
 	start uint64
 	end uint64
+	unmapped bool
 }
 
 type ShmRequest struct {
@@ -61,6 +62,33 @@ func (vm *VirtualMapping) GetUsedBy() []*MemDependency {
 	return vm.usedBy
 }
 
+/*
+LatestWrite returns the latest use of the mapping, other than its creation, which writes
+memory overlapping [start, end), or nil if there is none.
+ */
+func (vm *VirtualMapping) LatestWrite(start uint64, end uint64) *MemDependency {
+	for i := len(vm.usedBy)-1; i > 0; i-- {
+		dep := vm.usedBy[i]
+		if dep.start < end && start < dep.end && pointeeDir(dep.arg) != DirIn {
+			return dep
+		}
+	}
+	return nil
+}
+
+// ReadsMemory tells whether the call owning the pointer arg reads the memory it points to
+func ReadsMemory(arg Arg) bool {
+	return pointeeDir(arg) != DirOut
+}
+
+// pointeeDir is the direction of the data a pointer argument points to
+func pointeeDir(arg Arg) Dir {
+	if ptr, ok := arg.Type().(*PtrType); ok {
+		return ptr.Type.Dir()
+	}
+	return arg.Type().Dir()
+}
+
 func (vm *VirtualMapping) AddDependency(md *MemDependency) {
 	vm.usedBy = append(vm.usedBy, md)
 }
@@ -164,11 +192,177 @@ func (m *MemoryTracker) FindLatestOverlappingVMA(start uint64) *VirtualMapping {
 	return ret
 }
 
-func (m *MemoryTracker) AddAllocation(call *Call, size uint64, arg Arg) {
-	switch arg.(type) {
-	case *PointerArg:
-	default:
-		panic("Adding allocation for non pointer")
+/*
+FindMapping returns the latest mapping which is still mapped and
+contains all of [start, end).
+ */
+func (m *MemoryTracker) FindMapping(start uint64, end uint64) *VirtualMapping {
+	var ret *VirtualMapping = nil
+	for _, mapping := range m.mappings {
+		if !mapping.unmapped && mapping.start <= start && end <= mapping.end {
+			ret = mapping
+		}
+	}
+	return ret
+}
+
+// Unmap marks the mappings lying entirely within [start, end) as unmapped
+func (m *MemoryTracker) Unmap(start uint64, end uint64) {
+	for _, mapping := range m.mappings {
+		if start <= mapping.start && mapping.end <= end {
+			mapping.unmapped = true
+		}
+	}
+}
+
+func (m *MemoryTracker) CreatesMapping(call *Call) bool {
+	for _, mapping := range m.mappings {
+		if mapping.createdBy == call {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+RemoveCalls forgets the allocations, shm requests and uses of mappings of removed calls.
+Mappings created by a removed call are kept, such calls can't be removed on their own.
+ */
+func (m *MemoryTracker) RemoveCalls(removed map[*Call]bool) {
+	args := make(map[Arg]bool)
+	for call := range removed {
+		delete(m.allocations, call)
+		ForeachArg(call, func(arg Arg, _ *ArgCtx) {
+			args[arg] = true
+		})
+	}
+	for _, mapping := range m.mappings {
+		usedBy := make([]*MemDependency, 0, len(mapping.usedBy))
+		for i, dep := range mapping.usedBy {
+			if i == 0 || !args[dep.arg] {
+				usedBy = append(usedBy, dep)
+			}
+		}
+		mapping.usedBy = usedBy
+	}
+	requests := make([]*ShmRequest, 0, len(m.shm_requests))
+	for _, req := range m.shm_requests {
+		if !removed[req.call] {
+			requests = append(requests, req)
+		}
+	}
+	m.shm_requests = requests
+}
+
+/*
+Reindex updates the call indices kept by the mappings and their dependencies
+after calls have been removed from the program. newIdx maps old call indices to new ones.
+ */
+func (m *MemoryTracker) Reindex(newIdx map[int]int) {
+	for _, mapping := range m.mappings {
+		if idx, ok := newIdx[mapping.callidx]; ok {
+			mapping.callidx = idx
+		}
+		for _, dep := range mapping.usedBy {
+			if idx, ok := newIdx[dep.Callidx]; ok {
+				dep.Callidx = idx
+			}
+		}
+	}
+}
+
+// MappingUses maps the arguments pointing into a mapping, other than its creation, to the mapping
+func (m *MemoryTracker) MappingUses() map[Arg]*VirtualMapping {
+	uses := make(map[Arg]*VirtualMapping)
+	for _, mapping := range m.mappings {
+		for i, dep := range mapping.usedBy {
+			if i > 0 {
+				uses[dep.arg] = mapping
+			}
+		}
+	}
+	return uses
+}
+
+/*
+MappingArgs returns, for every mapping, the arguments which point into it in the order
+they were tracked. The first argument always belongs to the call that created the mapping.
+ */
+func (m *MemoryTracker) MappingArgs() [][]Arg {
+	ret := make([][]Arg, 0, len(m.mappings))
+	for _, mapping := range m.mappings {
+		args := make([]Arg, 0, len(mapping.usedBy))
+		for _, dep := range mapping.usedBy {
+			args = append(args, dep.arg)
+		}
+		ret = append(ret, args)
+	}
+	return ret
+}
+
+/*
+FitsInMemory checks whether the allocations and mappings of calls, given in program
+order, can be laid out within the memory syzkaller makes available to a program.
+ */
+func (m *MemoryTracker) FitsInMemory(calls []*Call) bool {
+	return m.MemoryNeeded(calls) <= memAllocMaxMem
+}
+
+// MemoryNeeded returns the bytes of memory a program made of calls, in program order, uses
+func (m *MemoryTracker) MemoryNeeded(calls []*Call) uint64 {
+	return m.layout(calls).end
+}
+
+/*
+Project returns a tracker for a copy of some of the calls tracked by m. calls and args
+translate calls and arguments to their copies and argIdx gives the index of the copied
+call owning each argument. Anything belonging to calls which weren't copied is dropped.
+ */
+func (m *MemoryTracker) Project(calls map[*Call]*Call, args map[Arg]Arg, argIdx map[Arg]int) *MemoryTracker {
+	newTracker := NewTracker()
+	newTracker.shm_requests = make([]*ShmRequest, 0)
+	for call, all := range m.allocations {
+		newCall, ok := calls[call]
+		if !ok {
+			continue
+		}
+		for _, a := range all {
+			newTracker.allocations[newCall] = append(newTracker.allocations[newCall],
+				&Allocation{num_bytes: a.num_bytes, arg: args[a.arg]})
+		}
+	}
+	for _, mapping := range m.mappings {
+		newCall, ok := calls[mapping.createdBy]
+		if !ok {
+			continue
+		}
+		newMapping := &VirtualMapping{
+			createdBy: newCall,
+			callidx: argIdx[mapping.usedBy[0].arg],
+			start: mapping.start,
+			end: mapping.end,
+			usedBy: make([]*MemDependency, 0),
+		}
+		for _, dep := range mapping.usedBy {
+			arg, ok := args[dep.arg]
+			if !ok {
+				continue
+			}
+			newMapping.usedBy = append(newMapping.usedBy, NewMemDependency(argIdx[dep.arg], arg, dep.start, dep.end))
+		}
+		newTracker.mappings = append(newTracker.mappings, newMapping)
+	}
+	for _, shmRequest := range m.shm_requests {
+		if newCall, ok := calls[shmRequest.call]; ok {
+			newTracker.AddShmRequest(newCall, shmRequest.shmid, shmRequest.size)
+		}
+	}
+	return newTracker
+}
+
+func (m *MemoryTracker) AddAllocation(call *Call, size uint64, arg Arg) error {
+	if _, ok := arg.(*PointerArg); !ok {
+		return fmt.Errorf("allocation for %s of %s which is not a pointer", arg.Type().Name(), call.Meta.Name)
 	}
 	allocation := new(Allocation)
 	allocation.arg = arg
@@ -177,6 +371,7 @@ func (m *MemoryTracker) AddAllocation(call *Call, size uint64, arg Arg) {
 		m.allocations[call] = make([]*Allocation, 0)
 	}
 	m.allocations[call] = append(m.allocations[call], allocation)
+	return nil
 }
 
 func (m *MemoryTracker) TrackDependency(arg Arg, start uint64, end uint64, mapping *VirtualMapping) {
@@ -234,7 +429,7 @@ func (m *MemoryTracker) Simplify(prog *Prog, distilled *Prog) *MemoryTracker {
 
 
 func (m *MemoryTracker) FillOutMemory(prog *Prog) error {
-	offset := uint64(0)
+	l := m.layout(prog.Calls)
 
 	for _, call := range prog.Calls {
 		log.Logf(3, "call: %s", call.Meta.CallName)
@@ -242,83 +437,65 @@ func (m *MemoryTracker) FillOutMemory(prog *Prog) error {
 			log.Logf(3, "skipping allocations")
 			continue
 		}
-		i := 0
 		for _, a := range m.allocations[call] {
 			switch arg := a.arg.(type) {
 			case *PointerArg:
-				arg.Address = offset
-				offset += a.num_bytes
-				i += 1
-				log.Logf(5, "offset: %v/%v", offset, memAllocMaxMem)
-				if arg.Address >= memAllocMaxMem {
+				arg.Address = l.allocations[a]
+				log.Logf(5, "offset: %v/%v", arg.Address, memAllocMaxMem)
+				if arg.Address+a.num_bytes > memAllocMaxMem {
 					return fmt.Errorf("Unable to allocate space to store arg: %#v" +
 						"in Call: %v. Required memory is larger than what is allowed by Syzkaller." +
 						"Offending address: %d. Skipping seed generation for this prog...\n",
 						arg, call, arg.Address)
 				}
 			default:
-				panic("Pointer Arg Failed")
+				return fmt.Errorf("allocation of call %v is not a pointer", call.Meta.Name)
 			}
 		}
 	}
-	if offset % PageSize > 0 {
-		offset = (offset/PageSize+1)*PageSize
-	}
-	log.Logf(5, "Offset: %d", offset)
+	log.Logf(5, "Offset: %d", l.allocEnd)
 
 	for _, mapping := range m.mappings {
+		offset, ok := l.mappings[mapping]
+		if !ok {
+			continue
+		}
 		for _, dep := range mapping.usedBy {
 			switch arg_ := dep.arg.(type) {
 			case *PointerArg:
-				//Offset should align with the start of a mapping/end of previous mapping.
+				//Offset should align with the start of the mapping
 				arg_.Address = offset + dep.start - mapping.start
 				log.Logf(5, "Dep start: %v, end: %v, mapping: %v, address: %v", dep.start, dep.end, mapping.start, arg_.Address)
-				arg_.Res = nil
-				if arg_.Address >= memAllocMaxMem || arg_.Address+arg_.VmaSize > memAllocMaxMem{
+				size := arg_.VmaSize
+				if _, ok := arg_.Type().(*VmaType); ok {
+					arg_.Res = nil
+				} else if arg_.Res != nil {
+					//Regular pointers into the mapping keep their data
+					size = arg_.Res.Size()
+				}
+				if arg_.Address >= memAllocMaxMem || arg_.Address+size > memAllocMaxMem{
 					return fmt.Errorf("Unable to allocate space for vma Call: %#v " +
 						"Required memory is larger than what is allowed by Syzkaller." +
 						"Offending address: %d. Skipping seed generation for this prog...\n",
 						mapping.GetCall(), arg_.Address)
 				}
 			default:
-				panic("Mapping needs to be Pointer Arg")
+				return fmt.Errorf("use of the mapping created by %v is not a pointer", mapping.GetCall().Meta.Name)
 			}
 		}
-		offset += mapping.GetEnd() - mapping.GetStart()
-		log.Logf(5, "New offset: %v", offset)
 	}
 	return nil
 }
 
+/*
+GetTotalMemoryAllocations returns the size of the region backing the allocations of prog
+once their memory has been laid out.
+ */
 func (m *MemoryTracker) GetTotalMemoryAllocations(prog *Prog) uint64{
-	sum := uint64(0)
-	for _, call := range prog.Calls {
-		if _, ok := m.allocations[call]; !ok {
-			continue
-		}
-		for _, a := range m.allocations[call] {
-			sum += a.num_bytes
-		}
-	}
-	if sum % PageSize > 0 {
-		sum = (sum/PageSize+1)*PageSize
-	}
-	return sum
+	return m.layout(prog.Calls).allocEnd
 }
 
 func (m *MemoryTracker) GetTotalVMAAllocations(prog *Prog) uint64 {
-	sum := uint64(0)
-	callMap := make(map[*Call]bool, 0)
-	for _, call := range prog.Calls {
-		callMap[call] = true
-	}
-
-
-	for _, mapping := range m.mappings {
-		if _, ok := callMap[mapping.createdBy]; ok {
-			sum += (mapping.end - mapping.start)
-		}
-	}
-	return sum
+	l := m.layout(prog.Calls)
+	return l.end - l.allocEnd
 }
-
@@ -0,0 +1,171 @@
+package tracker
+
+import (
+	"fmt"
+	. "github.com/google/syzkaller/prog"
+)
+
+/*
+A Snapshot is a MemoryTracker with its calls and arguments replaced by their positions in
+the program, so it can be stored and restored onto a copy of the program, e.g. one
+deserialized from its text.
+ */
+type Snapshot struct {
+	Allocations []SnapshotAllocation
+	Mappings []SnapshotMapping
+	ShmRequests []SnapshotShmRequest
+}
+
+// ArgRef is the position of an argument: its call and its index in ForeachArg order
+type ArgRef struct {
+	Call int
+	Arg int
+}
+
+type SnapshotAllocation struct {
+	Arg ArgRef
+	Size uint64
+}
+
+type SnapshotMapping struct {
+	CreatedBy int
+	CallIdx int
+	Start uint64
+	End uint64
+	Unmapped bool
+	UsedBy []SnapshotDependency
+}
+
+type SnapshotDependency struct {
+	CallIdx int
+	Arg ArgRef
+	Start uint64
+	End uint64
+}
+
+type SnapshotShmRequest struct {
+	Call int
+	Shmid uint64
+	Size uint64
+}
+
+// Snapshot fails if m refers to calls or arguments which aren't part of p
+func (m *MemoryTracker) Snapshot(p *Prog) (*Snapshot, error) {
+	calls := make(map[*Call]int, len(p.Calls))
+	args := make(map[Arg]ArgRef)
+	for i, call := range p.Calls {
+		calls[call] = i
+		j := 0
+		ForeachArg(call, func(arg Arg, _ *ArgCtx) {
+			args[arg] = ArgRef{i, j}
+			j++
+		})
+	}
+	s := new(Snapshot)
+	for call, all := range m.allocations {
+		if _, ok := calls[call]; !ok {
+			return nil, fmt.Errorf("allocation of a call outside of the program")
+		}
+		for _, a := range all {
+			ref, ok := args[a.arg]
+			if !ok {
+				return nil, fmt.Errorf("allocation of an argument outside of the program")
+			}
+			s.Allocations = append(s.Allocations, SnapshotAllocation{ref, a.num_bytes})
+		}
+	}
+	for _, mapping := range m.mappings {
+		createdBy, ok := calls[mapping.createdBy]
+		if !ok {
+			return nil, fmt.Errorf("mapping created outside of the program")
+		}
+		sm := SnapshotMapping{
+			CreatedBy: createdBy,
+			CallIdx: mapping.callidx,
+			Start: mapping.start,
+			End: mapping.end,
+			Unmapped: mapping.unmapped,
+		}
+		for _, dep := range mapping.usedBy {
+			ref, ok := args[dep.arg]
+			if !ok {
+				return nil, fmt.Errorf("mapping used outside of the program")
+			}
+			sm.UsedBy = append(sm.UsedBy, SnapshotDependency{dep.Callidx, ref, dep.start, dep.end})
+		}
+		s.Mappings = append(s.Mappings, sm)
+	}
+	for _, req := range m.shm_requests {
+		call, ok := calls[req.call]
+		if !ok {
+			return nil, fmt.Errorf("shm request outside of the program")
+		}
+		s.ShmRequests = append(s.ShmRequests, SnapshotShmRequest{call, req.shmid, req.size})
+	}
+	return s, nil
+}
+
+// Restore builds the tracker s was taken of for p, which has to be a copy of its program
+func (s *Snapshot) Restore(p *Prog) (*MemoryTracker, error) {
+	args := make([][]Arg, len(p.Calls))
+	for i, call := range p.Calls {
+		ForeachArg(call, func(arg Arg, _ *ArgCtx) {
+			args[i] = append(args[i], arg)
+		})
+	}
+	arg := func(ref ArgRef) (Arg, error) {
+		if ref.Call < 0 || ref.Call >= len(args) || ref.Arg < 0 || ref.Arg >= len(args[ref.Call]) {
+			return nil, fmt.Errorf("argument %d of call %d is not in the program", ref.Arg, ref.Call)
+		}
+		return args[ref.Call][ref.Arg], nil
+	}
+	call := func(idx int) (*Call, error) {
+		if idx < 0 || idx >= len(p.Calls) {
+			return nil, fmt.Errorf("call %d is not in the program", idx)
+		}
+		return p.Calls[idx], nil
+	}
+	m := NewTracker()
+	for _, a := range s.Allocations {
+		ptr, err := arg(a.Arg)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := ptr.(*PointerArg); !ok {
+			return nil, fmt.Errorf("allocation of argument %d of call %d which is not a pointer", a.Arg.Arg, a.Arg.Call)
+		}
+		if err := m.AddAllocation(p.Calls[a.Arg.Call], a.Size, ptr); err != nil {
+			return nil, err
+		}
+	}
+	for _, sm := range s.Mappings {
+		createdBy, err := call(sm.CreatedBy)
+		if err != nil {
+			return nil, err
+		}
+		mapping := &VirtualMapping{
+			createdBy: createdBy,
+			callidx: sm.CallIdx,
+			start: sm.Start,
+			end: sm.End,
+			unmapped: sm.Unmapped,
+			usedBy: make([]*MemDependency, 0, len(sm.UsedBy)),
+		}
+		for _, dep := range sm.UsedBy {
+			a, err := arg(dep.Arg)
+			if err != nil {
+				return nil, err
+			}
+			mapping.usedBy = append(mapping.usedBy, NewMemDependency(dep.CallIdx, a, dep.Start, dep.End))
+		}
+		m.mappings = append(m.mappings, mapping)
+	}
+	for _, req := range s.ShmRequests {
+		c, err := call(req.Call)
+		if err != nil {
+			return nil, err
+		}
+		m.AddShmRequest(c, req.Shmid, req.Size)
+	}
+	return m, nil
+}
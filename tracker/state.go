@@ -72,4 +72,40 @@ func (s *State) Analyze(c *Call) {
 			}
 		}
 	})
-}
\ No newline at end of file
+}
+
+/*
+RemoveCalls forgets the resources, strings and files the removed calls produced, so
+calls analyzed later don't take them from calls that are no longer part of the program.
+ */
+func (s *State) RemoveCalls(removed map[*Call]bool) {
+	args := make(map[Arg]bool)
+	for call := range removed {
+		ForeachArg(call, func(arg Arg, _ *ArgCtx) {
+			args[arg] = true
+		})
+	}
+	for name, res := range s.Resources {
+		kept := make([]Arg, 0, len(res))
+		for _, arg := range res {
+			if !args[arg] {
+				kept = append(kept, arg)
+			}
+		}
+		s.Resources[name] = kept
+	}
+	for val, call := range s.Strings {
+		if removed[call] {
+			delete(s.Strings, val)
+		}
+	}
+	for val, calls := range s.Files {
+		kept := make([]*Call, 0)
+		for _, call := range calls {
+			if !removed[call] {
+				kept = append(kept, call)
+			}
+		}
+		s.Files[val] = kept
+	}
+}
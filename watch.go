@@ -0,0 +1,281 @@
+package main
+
+import (
+	"github.com/google/syzkaller/pkg/hash"
+	"github.com/google/syzkaller/pkg/log"
+	"github.com/google/syzkaller/prog"
+	"github.com/shankarapailoor/moonshine/configs"
+	"github.com/shankarapailoor/moonshine/distiller"
+	. "github.com/shankarapailoor/moonshine/logging"
+	. "github.com/shankarapailoor/moonshine/parser"
+	"github.com/shankarapailoor/moonshine/splitter"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	watchOutput = "deserialized"
+	watchCorpus = "corpus.db"
+	watchManifest = "deserialized.watch" /* hashes of the programs the watcher wrote to watchOutput */
+	watchCache = "moonshine-cache"
+)
+
+type traceFile struct {
+	size int64
+	modTime time.Time
+	stable bool /* unchanged since the previous poll, so it's done being written */
+	failed bool /* couldn't be parsed, retried once it changes */
+}
+
+type watcher struct {
+	dir string
+	target *prog.Target
+	distillConf *config.DistillConfig
+	cache *ParseCache
+	traces map[string]*traceFile
+	out string /* directory the programs are written to */
+	corpusFile string
+	manifest string
+	corpus map[string]bool /* hashes of the programs the watcher wrote to out */
+	dirty bool /* traces were added, changed or removed since the last cycle */
+	last time.Time
+}
+
+/*
+Watch keeps the corpus in deserialized/ and corpus.db up to date with the traces in dir
+while more keep being dropped there. New traces are parsed as soon as they stop growing,
+into the parse cache, and the corpus is rebuilt from all traces every -watch_period if
+any changed, or right away on SIGHUP. Traces that fail to parse are skipped until they
+change, and a failing cycle leaves the previous corpus in place. The watcher only removes
+programs it wrote itself, which it keeps a manifest of across restarts, so programs put
+into deserialized/ by other runs stay in the corpus.
+ */
+func Watch(target *prog.Target, dir string) {
+	if *flagCache == "" {
+		*flagCache = watchCache
+	}
+	w := &watcher{
+		dir: dir,
+		target: target,
+		distillConf: loadDistillConfig(),
+		cache: openParseCache(target),
+		traces: make(map[string]*traceFile),
+		out: watchOutput,
+		corpusFile: watchCorpus,
+		manifest: watchManifest,
+	}
+	if err := os.MkdirAll(w.out, 0750); err != nil {
+		Failf("failed to create %s: %v", w.out, err)
+	}
+	if err := w.loadManifest(); err != nil {
+		Failf("failed to read %s: %v", w.manifest, err)
+	}
+	trigger := make(chan os.Signal, 1)
+	signal.Notify(trigger, syscall.SIGHUP)
+	poll := time.NewTicker(*flagWatchPoll)
+	defer poll.Stop()
+	log.Logf(0, "Watching %s, %d programs written by earlier runs", dir, len(w.corpus))
+	for {
+		select {
+		case <-poll.C:
+			w.scan()
+			if w.dirty && time.Since(w.last) >= *flagWatchPeriod {
+				w.cycle()
+			}
+		case <-trigger:
+			w.scan()
+			w.cycle()
+		}
+	}
+}
+
+// scan notices traces that were added, changed or removed and parses the new ones
+func (w *watcher) scan() {
+	infos, err := ioutil.ReadDir(w.dir)
+	if err != nil {
+		log.Logf(0, "Failed to read %s: %v", w.dir, err)
+		return
+	}
+	present := make(map[string]bool)
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		name := filepath.Join(w.dir, info.Name())
+		present[name] = true
+		trace, ok := w.traces[name]
+		if !ok || trace.size != info.Size() || !trace.modTime.Equal(info.ModTime()) {
+			w.traces[name] = &traceFile{size: info.Size(), modTime: info.ModTime()}
+			continue
+		}
+		if trace.stable {
+			continue
+		}
+		trace.stable = true
+		w.dirty = true
+		if _, err := w.parse(name); err != nil {
+			log.Logf(0, "Skipping %s until it changes: %v", info.Name(), err)
+			trace.failed = true
+		}
+	}
+	for name, trace := range w.traces {
+		if !present[name] {
+			delete(w.traces, name)
+			w.dirty = w.dirty || trace.stable
+		}
+	}
+}
+
+// parse parses a trace, or takes it from the cache, without letting it bring down the watcher
+func (w *watcher) parse(file string) ([]*Context, error) {
+	return convertFile(file, w.target, w.cache)
+}
+
+// cycle rebuilds the corpus from all traces and logs how it changed
+func (w *watcher) cycle() {
+	w.last = time.Now()
+	w.dirty = false
+	progs, err := w.convert()
+	if err != nil {
+		log.Logf(0, "Corpus not updated: %v", err)
+		return
+	}
+	w.update(progs)
+}
+
+/*
+update replaces the programs the watcher wrote with progs and repacks the corpus. Programs
+already in the output which the watcher didn't write are left alone, even if they are
+among progs.
+ */
+func (w *watcher) update(progs []*prog.Prog) {
+	updated := make(map[string][]byte, len(progs))
+	for _, p := range progs {
+		data := p.Serialize()
+		updated[hash.String(data)] = data
+	}
+	owned := make(map[string]bool, len(updated))
+	added := make([]string, 0)
+	removed := make([]string, 0)
+	for sig, data := range updated {
+		if w.corpus[sig] {
+			owned[sig] = true
+			continue
+		}
+		file := filepath.Join(w.out, sig)
+		if _, err := os.Stat(file); err == nil {
+			continue
+		}
+		if err := ioutil.WriteFile(file, data, 0640); err != nil {
+			log.Logf(0, "Corpus not updated: failed to output program: %v", err)
+			//Still remember what we wrote so far so it isn't left behind
+			for _, sig := range added {
+				w.corpus[sig] = true
+			}
+			w.saveManifest()
+			return
+		}
+		owned[sig] = true
+		added = append(added, sig)
+	}
+	for sig := range w.corpus {
+		if _, ok := updated[sig]; !ok {
+			os.Remove(filepath.Join(w.out, sig))
+			removed = append(removed, sig)
+		}
+	}
+	w.corpus = owned
+	w.saveManifest()
+	if err := protect(func() { pack(w.out, w.corpusFile) }); err != nil {
+		log.Logf(0, "Failed to pack %s: %v", w.corpusFile, err)
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	log.Logf(0, "Corpus has %d programs: %d added, %d removed", len(updated), len(added), len(removed))
+	for _, sig := range added {
+		log.Logf(1, "\tadded %s", sig)
+	}
+	for _, sig := range removed {
+		log.Logf(1, "\tremoved %s", sig)
+	}
+}
+
+// loadManifest reads which programs in the output earlier runs of the watcher wrote
+func (w *watcher) loadManifest() error {
+	w.corpus = make(map[string]bool)
+	data, err := ioutil.ReadFile(w.manifest)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, sig := range strings.Fields(string(data)) {
+		w.corpus[sig] = true
+	}
+	return nil
+}
+
+// saveManifest records the programs the watcher wrote, replacing the manifest atomically
+func (w *watcher) saveManifest() {
+	sigs := make([]string, 0, len(w.corpus))
+	for sig := range w.corpus {
+		sigs = append(sigs, sig+"\n")
+	}
+	sort.Strings(sigs)
+	tmp := w.manifest + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(strings.Join(sigs, "")), 0640); err != nil {
+		log.Logf(0, "Failed to write %s: %v", w.manifest, err)
+		return
+	}
+	if err := os.Rename(tmp, w.manifest); err != nil {
+		log.Logf(0, "Failed to write %s: %v", w.manifest, err)
+	}
+}
+
+// convert turns all parsable traces into the programs of the corpus
+func (w *watcher) convert() (progs []*prog.Prog, err error) {
+	err = protect(func() {
+		progs = w.convertAll()
+	})
+	return
+}
+
+func (w *watcher) convertAll() []*prog.Prog {
+	progs := make([]*prog.Prog, 0)
+	names := make([]string, 0, len(w.traces))
+	for name, trace := range w.traces {
+		if trace.stable && !trace.failed {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	ctxs := make([]*Context, 0)
+	seeds := make(distiller.Seeds, 0)
+	for _, name := range names {
+		parsed, err := w.parse(name)
+		if err != nil {
+			log.Logf(0, "Skipping %s until it changes: %v", path.Base(name), err)
+			w.traces[name].failed = true
+			continue
+		}
+		ctxs = append(ctxs, parsed...)
+		for _, ctx := range parsed {
+			if w.distillConf != nil {
+				seeds = append(seeds, generateSeeds(ctx, w.distillConf)...)
+			} else {
+				progs = append(progs, splitter.Split(ctx.Prog, ctx.State.Tracker)...)
+			}
+		}
+	}
+	if w.distillConf != nil {
+		_, progs = distillSeeds(ctxs, seeds, w.distillConf, w.target)
+	}
+	return progs
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/syzkaller/pkg/hash"
+	"github.com/google/syzkaller/prog"
+)
+
+func newTestWatcher(t *testing.T, dir string) *watcher {
+	w := &watcher{
+		dir: filepath.Join(dir, "traces"),
+		traces: make(map[string]*traceFile),
+		out: filepath.Join(dir, watchOutput),
+		corpusFile: filepath.Join(dir, watchCorpus),
+		manifest: filepath.Join(dir, watchManifest),
+	}
+	for _, d := range []string{w.dir, w.out} {
+		if err := os.MkdirAll(d, 0750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.loadManifest(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestWatchScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moonshine-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w := newTestWatcher(t, dir)
+	trace := filepath.Join(w.dir, "trace")
+	write := func(data string) {
+		if err := ioutil.WriteFile(trace, []byte(data), 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("1 getpid() = 1\n")
+	w.scan()
+	if w.traces[trace] == nil || w.traces[trace].stable || w.dirty {
+		t.Fatalf("new trace is taken before it stops growing")
+	}
+	w.scan()
+	if !w.traces[trace].stable || !w.dirty {
+		t.Fatalf("trace which stopped growing isn't taken")
+	}
+	w.dirty = false
+	write("1 getpid() = 1\n1 getppid() = 1\n")
+	w.scan()
+	if w.traces[trace].stable || w.dirty {
+		t.Fatalf("changed trace is taken before it stops growing")
+	}
+	w.scan()
+	w.dirty = false
+	os.Remove(trace)
+	w.scan()
+	if w.traces[trace] != nil || !w.dirty {
+		t.Fatalf("removed trace is still watched")
+	}
+}
+
+func TestWatchOnlyRemovesItsPrograms(t *testing.T) {
+	dir, err := ioutil.TempDir("", "moonshine-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	newProg := func(name string) (*prog.Prog, string) {
+		p := &prog.Prog{Calls: []*prog.Call{{Meta: &prog.Syscall{Name: name, CallName: name}}}}
+		return p, hash.String(p.Serialize())
+	}
+	kept, keptSig := newProg("getpid")
+	dropped, droppedSig := newProg("getppid")
+	_, foreignSig := newProg("getuid")
+	w := newTestWatcher(t, dir)
+	exists := func(sig string) bool {
+		_, err := os.Stat(filepath.Join(w.out, sig))
+		return err == nil
+	}
+	if err := ioutil.WriteFile(filepath.Join(w.out, foreignSig), []byte("getuid()\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	w.update([]*prog.Prog{kept, dropped})
+	if !exists(keptSig) || !exists(droppedSig) {
+		t.Fatalf("programs weren't written")
+	}
+
+	//A restarted watcher only knows what it wrote from the manifest
+	w = newTestWatcher(t, dir)
+	w.update([]*prog.Prog{kept})
+	if !exists(keptSig) || exists(droppedSig) {
+		t.Errorf("programs the watcher wrote aren't updated")
+	}
+	if !exists(foreignSig) {
+		t.Errorf("program the watcher didn't write was removed")
+	}
+	if len(w.corpus) != 1 || !w.corpus[keptSig] {
+		t.Errorf("watcher owns %v, want only %s", w.corpus, keptSig)
+	}
+}